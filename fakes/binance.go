@@ -0,0 +1,133 @@
+package fakes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// Answers of the Binance spot API (examples of the API documentation, on BTCEUR), by "METHOD path"
+var binanceRecordings = map[string]string{
+	"GET /api/v3/exchangeInfo": `{"timezone":"UTC","serverTime":1565246363776,"rateLimits":[],"symbols":[{"symbol":"BTCEUR","status":"TRADING",
+		"baseAsset":"BTC","quoteAsset":"EUR","filters":[{"filterType":"PRICE_FILTER","minPrice":"0.01000000","maxPrice":"1000000.00000000",
+		"tickSize":"0.01000000"},{"filterType":"LOT_SIZE","minQty":"0.00001000","maxQty":"9000.00000000","stepSize":"0.00001000"}]}]}`,
+	"GET /api/v3/account": `{"makerCommission":10,"takerCommission":10,"canTrade":true,"canWithdraw":true,"canDeposit":true,"updateTime":1565246363776,
+		"accountType":"SPOT","balances":[{"asset":"BTC","free":"0.01000000","locked":"0.00000000"},{"asset":"EUR","free":"4723.84600000","locked":"100.00000000"}],
+		"permissions":["SPOT"]}`,
+	"GET /api/v3/myTrades": `[{"symbol":"BTCEUR","id":28457,"orderId":100234,"orderListId":-1,"price":"20000.00000000","qty":"0.01000000",
+		"quoteQty":"200.00000000","commission":"0.20000000","commissionAsset":"EUR","time":1565246363776,"isBuyer":true,"isMaker":false,"isBestMatch":true}]`,
+	"GET /api/v3/openOrders": `[{"symbol":"BTCEUR","orderId":100235,"orderListId":-1,"clientOrderId":"6gCrw2kRUAF9CvJDGP16IP","price":"10000.00000000",
+		"origQty":"0.01000000","executedQty":"0.00000000","cummulativeQuoteQty":"0.00000000","status":"NEW","timeInForce":"GTC","type":"LIMIT",
+		"side":"BUY","time":1565246363776,"updateTime":1565246363776,"isWorking":true}]`,
+	"GET /api/v3/allOrders": `[{"symbol":"BTCEUR","orderId":100234,"orderListId":-1,"clientOrderId":"3f1c8a7e-5b2d-4d3e-9a6f-0c1b2d3e4f50","price":"0.00000000",
+		"origQty":"0.01000000","executedQty":"0.01000000","cummulativeQuoteQty":"200.00000000","status":"FILLED","timeInForce":"GTC","type":"MARKET",
+		"side":"BUY","time":1565246363776,"updateTime":1565246363776,"isWorking":true}]`,
+	"GET /api/v3/order": `{"symbol":"BTCEUR","orderId":100234,"orderListId":-1,"clientOrderId":"3f1c8a7e-5b2d-4d3e-9a6f-0c1b2d3e4f50","price":"0.00000000",
+		"origQty":"0.01000000","executedQty":"0.01000000","cummulativeQuoteQty":"200.00000000","status":"FILLED","timeInForce":"GTC","type":"MARKET",
+		"side":"BUY","time":1565246363776,"updateTime":1565246363776,"isWorking":true}`,
+	"POST /api/v3/order": `{"symbol":"BTCEUR","orderId":100236,"orderListId":-1,"clientOrderId":"3f1c8a7e-5b2d-4d3e-9a6f-0c1b2d3e4f51","transactTime":1565246363776,
+		"price":"0.00000000","origQty":"0.01000000","executedQty":"0.01000000","cummulativeQuoteQty":"200.00000000","status":"FILLED","timeInForce":"GTC",
+		"type":"MARKET","side":"BUY"}`,
+	"DELETE /api/v3/order": `{"symbol":"BTCEUR","origClientOrderId":"6gCrw2kRUAF9CvJDGP16IP","orderId":100235,"orderListId":-1,"clientOrderId":"cancelMyOrder1",
+		"price":"10000.00000000","origQty":"0.01000000","executedQty":"0.00000000","cummulativeQuoteQty":"0.00000000","status":"CANCELED",
+		"timeInForce":"GTC","type":"LIMIT","side":"BUY"}`,
+	"GET /api/v3/historicalTrades": `[{"id":12345,"price":"20000.00000000","qty":"0.01000000","quoteQty":"200.00000000","time":1565246363775,
+		"isBuyerMaker":true,"isBestMatch":true},{"id":12346,"price":"20000.50000000","qty":"0.25000000","quoteQty":"5000.12500000",
+		"time":1565246364775,"isBuyerMaker":false,"isBestMatch":true},{"id":12347,"price":"19999.00000000","qty":"0.10000000",
+		"quoteQty":"1999.90000000","time":1565246365775,"isBuyerMaker":true,"isBestMatch":true}]`,
+	"GET /api/v3/ticker/bookTicker": `{"symbol":"BTCEUR","bidPrice":"19999.99000000","bidQty":"0.50000000","askPrice":"20000.01000000","askQty":"0.25000000"}`,
+}
+
+// Events of the btceur@trade stream
+var binanceStreamRecording = []string{
+	`{"e":"trade","E":1565246363776,"s":"BTCEUR","t":12345,"p":"20000.00000000","q":"0.01000000","T":1565246363775,"m":true,"M":true}`,
+	`{"e":"trade","E":1565246364776,"s":"BTCEUR","t":12346,"p":"20000.50000000","q":"0.25000000","T":1565246364775,"m":false,"M":true}`,
+	`{"e":"trade","E":1565246365776,"s":"BTCEUR","t":12347,"p":"19999.00000000","q":"0.10000000","T":1565246365775,"m":true,"M":true}`,
+}
+
+// Endpoints which require a signature
+var binanceSigned = map[string]bool{"/api/v3/account": true, "/api/v3/myTrades": true, "/api/v3/openOrders": true, "/api/v3/allOrders": true, "/api/v3/order": true}
+
+// Stub of the Binance spot API replaying recorded answers. Signed requests are checked against key and secret.
+// The trade stream is replayed to the subscribers of /ws, one event every StreamPeriod
+type BinanceStub struct {
+	key          string
+	secret       string
+	stream       []string
+	StreamPeriod time.Duration
+	upgrader     ws.Upgrader
+}
+
+func NewBinanceStub(key string, secret string) *BinanceStub {
+	return &BinanceStub{key: key, secret: secret, stream: binanceStreamRecording, StreamPeriod: time.Second}
+}
+
+func (stub *BinanceStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ws" {
+		stub.serveStream(w, r)
+		return
+	}
+	if binanceSigned[r.URL.Path] {
+		if r.Header.Get("X-MBX-APIKEY") != stub.key {
+			writeBinanceError(w, http.StatusUnauthorized, `{"code":-2015,"msg":"Invalid API-key, IP, or permissions for action."}`)
+			return
+		}
+		query := r.URL.RawQuery
+		i := strings.LastIndex(query, "&signature=")
+		if i < 0 || r.URL.Query().Get("timestamp") == "" {
+			writeBinanceError(w, http.StatusBadRequest, `{"code":-1102,"msg":"Mandatory parameter 'signature' was not sent, was empty/null, or malformed."}`)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(stub.secret))
+		mac.Write([]byte(query[:i]))
+		if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(query[i+len("&signature="):])) {
+			writeBinanceError(w, http.StatusBadRequest, `{"code":-1022,"msg":"Signature for this request is not valid."}`)
+			return
+		}
+	}
+	answer, ok := binanceRecordings[r.Method+" "+r.URL.Path]
+	if !ok {
+		writeBinanceError(w, http.StatusNotFound, `{"code":-1000,"msg":"No recording for this request."}`)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(answer))
+}
+
+// Answer the SUBSCRIBE request, then replay the stream
+func (stub *BinanceStub) serveStream(w http.ResponseWriter, r *http.Request) {
+	conn, err := stub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var request struct {
+		Method string   `json:"method"`
+		Params []string `json:"params"`
+		Id     int      `json:"id"`
+	}
+	if err := conn.ReadJSON(&request); err != nil {
+		return
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"result": nil, "id": request.Id}); err != nil {
+		return
+	}
+	for _, event := range stub.stream {
+		time.Sleep(stub.StreamPeriod)
+		if err := conn.WriteMessage(ws.TextMessage, []byte(event)); err != nil {
+			return
+		}
+	}
+	conn.ReadMessage() // Until the client closes
+}
+
+func writeBinanceError(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,618 @@
+// Local servers standing in for the exchanges and the message broker, for the tests of the adapters and of the feeds
+package fakes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+const (
+	COINBASE_API_PATH   string = "/api/v3/brokerage"
+	COINBASE_MAX_TRADES int    = 1000 // Recent trades kept by product for the public ticker
+)
+
+// Fake of the Coinbase Advanced Trade REST and websocket APIs.
+// Market orders are filled at once at the last trade price, limit orders stay open until cancelled.
+// Requests must be signed with the key of NewCoinbaseKey
+type CoinbaseServer struct {
+	mutex       sync.Mutex
+	keyName     string
+	publicKey   *ecdsa.PublicKey
+	FeeRate     float64 // 0.006 by default
+	products    map[string]*coinbaseProduct
+	balances    map[string]*coinbaseBalance
+	orders      []*coinbaseOrder
+	fills       []coinbaseFill
+	trades      map[string][]map[string]interface{} // Product id -> recent trades, newest first
+	subscribers map[*coinbaseSubscriber]bool
+	upgrader    ws.Upgrader
+	tradeId     int
+	sequence    int64
+}
+
+type coinbaseProduct struct {
+	ProductId      string `json:"product_id"`
+	BaseMinSize    string `json:"base_min_size"`
+	BaseMaxSize    string `json:"base_max_size"`
+	BaseIncrement  string `json:"base_increment"`
+	QuoteIncrement string `json:"quote_increment"`
+	price          float64
+	status         string // Of the status channel
+}
+
+type coinbaseBalance struct {
+	available float64
+	hold      float64
+}
+
+type coinbaseOrder struct {
+	OrderId            string                 `json:"order_id"`
+	ProductId          string                 `json:"product_id"`
+	ClientOrderId      string                 `json:"client_order_id"`
+	Side               string                 `json:"side"`
+	Status             string                 `json:"status"`
+	FilledSize         string                 `json:"filled_size"`
+	FilledValue        string                 `json:"filled_value"`
+	TotalFees          string                 `json:"total_fees"`
+	CreatedTime        time.Time              `json:"created_time"`
+	OrderConfiguration map[string]interface{} `json:"order_configuration"`
+	size               float64
+	price              float64 // Limit price
+}
+
+type coinbaseFill struct {
+	TradeId     string    `json:"trade_id"`
+	OrderId     string    `json:"order_id"`
+	TradeTime   time.Time `json:"trade_time"`
+	Price       string    `json:"price"`
+	Size        string    `json:"size"`
+	Commission  string    `json:"commission"`
+	ProductId   string    `json:"product_id"`
+	Side        string    `json:"side"`
+	SizeInQuote bool      `json:"size_in_quote"`
+}
+
+type coinbaseSubscriber struct {
+	mutex    sync.Mutex // One writer at a time
+	conn     *ws.Conn
+	channels map[string]map[string]bool // channel -> product ids
+}
+
+// Key name and SEC1 PEM secret to put in the account of config.json, and the public key for the server
+func NewCoinbaseKey() (keyName string, secret string, publicKey *ecdsa.PublicKey, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	secret = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return "organizations/fake/apiKeys/" + randomId(), secret, &key.PublicKey, nil
+}
+
+func NewCoinbaseServer(keyName string, publicKey *ecdsa.PublicKey) *CoinbaseServer {
+	return &CoinbaseServer{keyName: keyName, publicKey: publicKey, FeeRate: 0.006, products: map[string]*coinbaseProduct{},
+		balances: map[string]*coinbaseBalance{}, trades: map[string][]map[string]interface{}{}, subscribers: map[*coinbaseSubscriber]bool{}}
+}
+
+func (server *CoinbaseServer) AddProduct(productId string, minSize float64, price float64) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.products[productId] = &coinbaseProduct{productId, formatFloat(minSize), "1000", "0.00000001", "0.01", price, "online"}
+}
+
+func (server *CoinbaseServer) SetBalance(currency string, available float64) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.balances[currency] = &coinbaseBalance{available, 0}
+}
+
+// Last trade price of productId, and market_trades and ticker messages to the subscribers, the best bid and ask one
+// quote increment around price. side is the side of the maker
+func (server *CoinbaseServer) PublishTrade(productId string, price float64, size float64, side string) {
+	server.mutex.Lock()
+	product, ok := server.products[productId]
+	if !ok {
+		server.mutex.Unlock()
+		return
+	}
+	product.price = price
+	server.tradeId++
+	trade := map[string]interface{}{"trade_id": strconv.Itoa(server.tradeId), "product_id": productId, "price": formatFloat(price),
+		"size": formatFloat(size), "side": strings.ToUpper(side), "time": time.Now().UTC()}
+	trades := append([]map[string]interface{}{trade}, server.trades[productId]...)
+	if len(trades) > COINBASE_MAX_TRADES {
+		trades = trades[:COINBASE_MAX_TRADES]
+	}
+	server.trades[productId] = trades
+	increment, _ := strconv.ParseFloat(product.QuoteIncrement, 64)
+	server.mutex.Unlock()
+	server.broadcast("market_trades", productId, []interface{}{map[string]interface{}{"type": "update", "trades": []interface{}{trade}}})
+	ticker := map[string]interface{}{"type": "ticker", "product_id": productId, "price": formatFloat(price),
+		"best_bid": formatFloat(price - increment), "best_ask": formatFloat(price + increment)}
+	server.broadcast("ticker", productId, []interface{}{map[string]interface{}{"type": "update", "tickers": []interface{}{ticker}}})
+}
+
+// Send again the last n trades of productId to the subscribers of market_trades, oldest first: the duplicates a feed
+// may deliver, the clients must drop them
+func (server *CoinbaseServer) RepeatTrades(productId string, n int) {
+	server.mutex.Lock()
+	trades := server.trades[productId]
+	if n > len(trades) {
+		n = len(trades)
+	}
+	var events []interface{}
+	for i := n - 1; i >= 0; i-- {
+		events = append(events, map[string]interface{}{"type": "update", "trades": []interface{}{trades[i]}})
+	}
+	server.mutex.Unlock()
+	if len(events) > 0 {
+		server.broadcast("market_trades", productId, events)
+	}
+}
+
+// Status of productId (online, offline, delisted...), and status message to the subscribers
+func (server *CoinbaseServer) SetStatus(productId string, status string) {
+	server.mutex.Lock()
+	product, ok := server.products[productId]
+	if !ok {
+		server.mutex.Unlock()
+		return
+	}
+	product.status = status
+	event := map[string]interface{}{"type": "update", "products": []interface{}{product.statusMessage()}}
+	server.mutex.Unlock()
+	server.broadcast("status", productId, []interface{}{event})
+}
+
+func (product *coinbaseProduct) statusMessage() map[string]interface{} {
+	return map[string]interface{}{"product_type": "SPOT", "id": product.ProductId, "status": product.status, "status_message": ""}
+}
+
+// Heartbeat to the subscribers of the heartbeats channel every period, until stop is closed
+func (server *CoinbaseServer) Heartbeats(period time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	counter := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-ticker.C:
+			counter++
+			server.broadcast("heartbeats", "", []interface{}{map[string]interface{}{"current_time": t.UTC(), "heartbeat_counter": counter}})
+		}
+	}
+}
+
+func (server *CoinbaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ws" {
+		server.serveWebsocket(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, COINBASE_API_PATH) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, COINBASE_API_PATH+"/market/products/") && strings.HasSuffix(r.URL.Path, "/ticker") {
+		server.serveMarketTrades(w, r)
+		return
+	}
+	if err := server.verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), r.Method+" "+r.Host+r.URL.Path); err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "UNAUTHENTICATED", "message": err.Error()})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, COINBASE_API_PATH)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(path, "/products/"):
+		product, ok := server.products[strings.TrimPrefix(path, "/products/")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "NOT_FOUND", "message": "product not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, product)
+	case r.Method == "GET" && path == "/accounts":
+		var accounts []interface{}
+		for currency, balance := range server.balances {
+			accounts = append(accounts, map[string]interface{}{"uuid": currency, "currency": currency,
+				"available_balance": map[string]string{"value": formatFloat(balance.available), "currency": currency},
+				"hold":              map[string]string{"value": formatFloat(balance.hold), "currency": currency}})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": accounts, "has_next": false, "cursor": ""})
+	case r.Method == "GET" && path == "/best_bid_ask":
+		var pricebooks []interface{}
+		for _, productId := range r.URL.Query()["product_ids"] {
+			if product, ok := server.products[productId]; ok {
+				level := []map[string]string{{"price": formatFloat(product.price), "size": "1"}}
+				pricebooks = append(pricebooks, map[string]interface{}{"product_id": productId, "bids": level, "asks": level})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"pricebooks": pricebooks})
+	case r.Method == "GET" && path == "/orders/historical/fills":
+		fills := []coinbaseFill{}
+		productIds := r.URL.Query()["product_ids"]
+		for _, fill := range server.fills {
+			if len(productIds) == 0 || contains(productIds, fill.ProductId) {
+				fills = append(fills, fill)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"fills": fills, "cursor": ""})
+	case r.Method == "GET" && path == "/orders/historical/batch":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"orders": server.listOrders(r), "has_next": false, "cursor": ""})
+	case r.Method == "POST" && path == "/orders":
+		server.createOrder(w, r)
+	case r.Method == "POST" && path == "/orders/batch_cancel":
+		server.cancelOrders(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Public GET /market/products/<product-id>/ticker: the last trades, newest first
+func (server *CoinbaseServer) serveMarketTrades(w http.ResponseWriter, r *http.Request) {
+	productId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, COINBASE_API_PATH+"/market/products/"), "/ticker")
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	product, ok := server.products[productId]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "NOT_FOUND", "message": "product not found"})
+		return
+	}
+	trades := append([]map[string]interface{}{}, server.trades[productId]...)
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit < len(trades) {
+		trades = trades[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"trades": trades, "best_bid": formatFloat(product.price), "best_ask": formatFloat(product.price)})
+}
+
+// Check the ES256 signature, the validity and the uri of a JWT. The uri is not checked if empty
+func (server *CoinbaseServer) verify(token string, uri string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Nbf int64  `json:"nbf"`
+		Exp int64  `json:"exp"`
+		Uri string `json:"uri"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+	if header.Alg != "ES256" || header.Kid != server.keyName || claims.Sub != server.keyName {
+		return errors.New("unknown key " + header.Kid)
+	}
+	now := time.Now().Unix()
+	if now < claims.Nbf-5 || now > claims.Exp {
+		return errors.New("JWT expired")
+	}
+	if uri != "" && claims.Uri != uri {
+		return fmt.Errorf("JWT for %s used on %s", claims.Uri, uri)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(server.publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Must be called locked
+func (server *CoinbaseServer) listOrders(r *http.Request) []*coinbaseOrder {
+	query := r.URL.Query()
+	var since time.Time
+	if startDate := query.Get("start_date"); startDate != "" {
+		since, _ = time.Parse(time.RFC3339, startDate)
+	}
+	orders := []*coinbaseOrder{}
+	for _, order := range server.orders {
+		if len(query["product_ids"]) > 0 && !contains(query["product_ids"], order.ProductId) {
+			continue
+		}
+		if len(query["order_status"]) > 0 && !contains(query["order_status"], order.Status) {
+			continue
+		}
+		if order.CreatedTime.Before(since) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+// Must be called locked
+func (server *CoinbaseServer) createOrder(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ClientOrderId      string `json:"client_order_id"`
+		ProductId          string `json:"product_id"`
+		Side               string `json:"side"`
+		OrderConfiguration struct {
+			MarketMarketIoc *struct {
+				BaseSize string `json:"base_size"`
+			} `json:"market_market_ioc"`
+			LimitLimitGtc *struct {
+				BaseSize   string `json:"base_size"`
+				LimitPrice string `json:"limit_price"`
+			} `json:"limit_limit_gtc"`
+		} `json:"order_configuration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "INVALID_ARGUMENT", "message": err.Error()})
+		return
+	}
+	reject := func(reason string) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": false, "failure_reason": reason,
+			"error_response": map[string]string{"error": reason, "message": reason}})
+	}
+	for _, order := range server.orders {
+		if order.ClientOrderId == request.ClientOrderId { // Idempotent creation
+			writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "success_response": map[string]string{"order_id": order.OrderId}})
+			return
+		}
+	}
+	product, ok := server.products[request.ProductId]
+	if !ok {
+		reject("UNKNOWN_PRODUCT_ID")
+		return
+	}
+	currencies := strings.Split(request.ProductId, "-")
+	base, quote := server.balance(currencies[0]), server.balance(currencies[1])
+	order := &coinbaseOrder{OrderId: randomId(), ProductId: request.ProductId, ClientOrderId: request.ClientOrderId, Side: request.Side,
+		FilledSize: "0", FilledValue: "0", TotalFees: "0", CreatedTime: time.Now().UTC()}
+
+	switch {
+	case request.OrderConfiguration.MarketMarketIoc != nil:
+		order.size, _ = strconv.ParseFloat(request.OrderConfiguration.MarketMarketIoc.BaseSize, 64)
+		order.OrderConfiguration = map[string]interface{}{"market_market_ioc": request.OrderConfiguration.MarketMarketIoc}
+		value := order.size * product.price
+		fee := value * server.FeeRate
+		if request.Side == "BUY" && quote.available < value+fee || request.Side == "SELL" && base.available < order.size {
+			reject("INSUFFICIENT_FUND")
+			return
+		}
+		if request.Side == "BUY" {
+			quote.available -= value + fee
+			base.available += order.size
+		} else {
+			base.available -= order.size
+			quote.available += value - fee
+		}
+		order.Status = "FILLED"
+		order.FilledSize, order.FilledValue, order.TotalFees = formatFloat(order.size), formatFloat(value), formatFloat(fee)
+		server.tradeId++
+		server.fills = append(server.fills, coinbaseFill{strconv.Itoa(server.tradeId), order.OrderId, time.Now().UTC(), formatFloat(product.price),
+			formatFloat(order.size), formatFloat(fee), order.ProductId, order.Side, false})
+	case request.OrderConfiguration.LimitLimitGtc != nil:
+		order.size, _ = strconv.ParseFloat(request.OrderConfiguration.LimitLimitGtc.BaseSize, 64)
+		order.price, _ = strconv.ParseFloat(request.OrderConfiguration.LimitLimitGtc.LimitPrice, 64)
+		order.OrderConfiguration = map[string]interface{}{"limit_limit_gtc": request.OrderConfiguration.LimitLimitGtc}
+		if request.Side == "BUY" && quote.available < order.size*order.price || request.Side == "SELL" && base.available < order.size {
+			reject("INSUFFICIENT_FUND")
+			return
+		}
+		server.hold(order, base, quote, 1)
+		order.Status = "OPEN"
+	default:
+		reject("UNSUPPORTED_ORDER_CONFIGURATION")
+		return
+	}
+	server.orders = append(server.orders, order)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "success_response": map[string]string{"order_id": order.OrderId,
+		"product_id": order.ProductId, "side": order.Side, "client_order_id": order.ClientOrderId}})
+}
+
+// Must be called locked
+func (server *CoinbaseServer) cancelOrders(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OrderIds []string `json:"order_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "INVALID_ARGUMENT", "message": err.Error()})
+		return
+	}
+	var results []interface{}
+	for _, orderId := range request.OrderIds {
+		reason := "UNKNOWN_CANCEL_ORDER"
+		for _, order := range server.orders {
+			if order.OrderId == orderId && order.Status == "OPEN" {
+				currencies := strings.Split(order.ProductId, "-")
+				server.hold(order, server.balance(currencies[0]), server.balance(currencies[1]), -1)
+				order.Status = "CANCELLED"
+				reason = ""
+			}
+		}
+		results = append(results, map[string]interface{}{"success": reason == "", "failure_reason": reason, "order_id": orderId})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// Put (sign 1) or release (sign -1) the funds of an open limit order
+func (server *CoinbaseServer) hold(order *coinbaseOrder, base *coinbaseBalance, quote *coinbaseBalance, sign float64) {
+	if order.Side == "BUY" {
+		quote.available -= sign * order.size * order.price
+		quote.hold += sign * order.size * order.price
+	} else {
+		base.available -= sign * order.size
+		base.hold += sign * order.size
+	}
+}
+
+// Must be called locked
+func (server *CoinbaseServer) balance(currency string) *coinbaseBalance {
+	if _, ok := server.balances[currency]; !ok {
+		server.balances[currency] = &coinbaseBalance{}
+	}
+	return server.balances[currency]
+}
+
+func (server *CoinbaseServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := server.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	subscriber := &coinbaseSubscriber{conn: conn, channels: map[string]map[string]bool{}}
+	server.mutex.Lock()
+	server.subscribers[subscriber] = true
+	server.mutex.Unlock()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.subscribers, subscriber)
+		server.mutex.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var message struct {
+			Type       string   `json:"type"`
+			ProductIds []string `json:"product_ids"`
+			Channel    string   `json:"channel"`
+			Jwt        string   `json:"jwt"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		// The public channels can be subscribed without JWT
+		public := message.Jwt == "" && contains([]string{"heartbeats", "market_trades", "ticker", "status"}, message.Channel)
+		if err := server.verify(message.Jwt, ""); err != nil && !public {
+			subscriber.write(map[string]string{"type": "error", "message": err.Error()})
+			continue
+		}
+		server.mutex.Lock()
+		switch message.Type {
+		case "subscribe":
+			if subscriber.channels[message.Channel] == nil {
+				subscriber.channels[message.Channel] = map[string]bool{}
+			}
+			for _, productId := range message.ProductIds {
+				subscriber.channels[message.Channel][productId] = true
+			}
+		case "unsubscribe":
+			for _, productId := range message.ProductIds {
+				delete(subscriber.channels[message.Channel], productId)
+			}
+		}
+		subscriptions := map[string][]string{}
+		for channel, productIds := range subscriber.channels {
+			subscriptions[channel] = []string{}
+			for productId := range productIds {
+				subscriptions[channel] = append(subscriptions[channel], productId)
+			}
+		}
+		server.sequence++
+		reply := map[string]interface{}{"channel": "subscriptions", "timestamp": time.Now().UTC(), "sequence_num": server.sequence,
+			"events": []interface{}{map[string]interface{}{"subscriptions": subscriptions}}}
+		var statuses []interface{}
+		for _, productId := range message.ProductIds {
+			if product, ok := server.products[productId]; ok {
+				statuses = append(statuses, product.statusMessage())
+			}
+		}
+		server.mutex.Unlock()
+		subscriber.write(reply)
+		if message.Type == "subscribe" && message.Channel == "market_trades" {
+			subscriber.write(map[string]interface{}{"channel": "market_trades", "timestamp": time.Now().UTC(),
+				"events": []interface{}{map[string]interface{}{"type": "snapshot", "trades": []interface{}{}}}})
+		}
+		if message.Type == "subscribe" && message.Channel == "status" {
+			subscriber.write(map[string]interface{}{"channel": "status", "timestamp": time.Now().UTC(),
+				"events": []interface{}{map[string]interface{}{"type": "snapshot", "products": statuses}}})
+		}
+	}
+}
+
+// Close the websocket connections, as a network failure would. The clients can connect again
+func (server *CoinbaseServer) DropConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for subscriber := range server.subscribers {
+		subscriber.conn.Close()
+	}
+}
+
+// Send events to the subscribers of channel for productId. Every product if productId is empty
+func (server *CoinbaseServer) broadcast(channel string, productId string, events []interface{}) {
+	server.mutex.Lock()
+	var subscribers []*coinbaseSubscriber
+	for subscriber := range server.subscribers {
+		if productIds, ok := subscriber.channels[channel]; ok && (productId == "" || productIds[productId]) {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	server.sequence++
+	message := map[string]interface{}{"channel": channel, "client_id": "", "timestamp": time.Now().UTC(), "sequence_num": server.sequence, "events": events}
+	server.mutex.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber.write(message)
+	}
+}
+
+func (subscriber *coinbaseSubscriber) write(message interface{}) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	subscriber.conn.WriteJSON(message)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,220 @@
+package fakes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Local NATS server speaking the text protocol: CONNECT, PING/PONG, SUB, UNSUB and PUB, delivered as MSG to the
+// subscriptions of the other clients. Subjects match with the * and > wildcards. User and password auth, no TLS,
+// no queue group, no headers
+type NatsServer struct {
+	mutex     sync.Mutex
+	listener  net.Listener
+	clients   map[*natsClient]bool
+	stalled   bool
+	user      string
+	password  string
+	OnPublish func(subject string, payload []byte) // Called with each message published, if not nil
+}
+
+type natsClient struct {
+	mutex         sync.Mutex // Writes
+	conn          net.Conn
+	writer        *bufio.Writer
+	subscriptions map[string]string // sid -> subject
+}
+
+// Listen on addr, ex: 127.0.0.1:4222, or 127.0.0.1:0 for any port
+func NewNatsServer(addr string) (*NatsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &NatsServer{listener: listener, clients: map[*natsClient]bool{}}
+	go server.accept()
+	return server, nil
+}
+
+func (server *NatsServer) URL() string {
+	return "nats://" + server.listener.Addr().String()
+}
+
+// Stop listening and close the connections
+func (server *NatsServer) Close() {
+	server.listener.Close()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for client := range server.clients {
+		client.conn.Close()
+	}
+}
+
+// Require user and password in the CONNECT of the next connections
+func (server *NatsServer) SetAuth(user string, password string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.user, server.password = user, password
+}
+
+// While stalled, the connections stay open but the PINGs aren't answered and the messages aren't delivered
+func (server *NatsServer) Stall(stalled bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.stalled = stalled
+}
+
+func (server *NatsServer) isStalled() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.stalled
+}
+
+// Close the connections, the clients have to reconnect
+func (server *NatsServer) DropConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for client := range server.clients {
+		client.conn.Close()
+	}
+}
+
+func (server *NatsServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &natsClient{conn: conn, writer: bufio.NewWriter(conn), subscriptions: map[string]string{}}
+		server.mutex.Lock()
+		server.clients[client] = true
+		server.mutex.Unlock()
+		go server.serve(client)
+	}
+}
+
+func (server *NatsServer) serve(client *natsClient) {
+	defer func() {
+		server.mutex.Lock()
+		delete(server.clients, client)
+		server.mutex.Unlock()
+		client.conn.Close()
+	}()
+	server.mutex.Lock()
+	user, password := server.user, server.password
+	server.mutex.Unlock()
+	info, _ := json.Marshal(map[string]interface{}{"server_id": "fake", "version": "2.0.0", "proto": 1, "max_payload": 1048576, "auth_required": user != ""})
+	client.write("INFO " + string(info) + "\r\n")
+
+	reader := bufio.NewReader(client.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONNECT": // CONNECT {"user":...,"pass":...}
+			var options struct {
+				User string `json:"user"`
+				Pass string `json:"pass"`
+			}
+			json.Unmarshal([]byte(strings.TrimSpace(line[len(fields[0]):])), &options)
+			if user != "" && (options.User != user || options.Pass != password) {
+				client.write("-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			if !server.isStalled() {
+				client.write("PONG\r\n")
+			}
+		case "PONG":
+		case "SUB": // SUB <subject> [queue group] <sid>
+			if len(fields) < 3 {
+				client.write("-ERR 'Invalid Subject'\r\n")
+				return
+			}
+			server.mutex.Lock()
+			client.subscriptions[fields[len(fields)-1]] = fields[1]
+			server.mutex.Unlock()
+		case "UNSUB": // UNSUB <sid> [max msgs]
+			if len(fields) > 1 {
+				server.mutex.Lock()
+				delete(client.subscriptions, fields[1])
+				server.mutex.Unlock()
+			}
+		case "PUB": // PUB <subject> [reply-to] <#bytes>\r\n<payload>\r\n
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if len(fields) < 3 || err != nil {
+				client.write("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			server.publish(fields[1], payload[:size])
+		default:
+			client.write("-ERR 'Unknown Protocol Operation'\r\n")
+			return
+		}
+	}
+}
+
+func (server *NatsServer) publish(subject string, payload []byte) {
+	if server.OnPublish != nil {
+		server.OnPublish(subject, payload)
+	}
+	type delivery struct {
+		client *natsClient
+		sid    string
+	}
+	var deliveries []delivery
+	server.mutex.Lock()
+	if server.stalled {
+		server.mutex.Unlock()
+		return
+	}
+	for client := range server.clients {
+		for sid, pattern := range client.subscriptions {
+			if natsMatch(pattern, subject) {
+				deliveries = append(deliveries, delivery{client, sid})
+			}
+		}
+	}
+	server.mutex.Unlock()
+	for _, delivery := range deliveries {
+		delivery.client.write(fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", subject, delivery.sid, len(payload), payload))
+	}
+}
+
+func (client *natsClient) write(data string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.writer.WriteString(data)
+	client.writer.Flush()
+}
+
+// * matches one token, > the remaining ones
+func natsMatch(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
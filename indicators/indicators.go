@@ -0,0 +1,99 @@
+// Package indicators implements technical indicators computed incrementally, one value or bar at a time.
+// The same indicators are used in batch over an history with the *Series functions.
+package indicators
+
+import (
+	"errors"
+	"math"
+)
+
+// Returned by the constructors for a period of 0 or less
+var ErrInvalidPeriod = errors.New("indicators: the period must be above 0")
+
+// Input of the indicators needing more than a price
+type Bar struct {
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+}
+
+// Indicator computed from a single value per period, usually the close price
+type Indicator interface {
+	Update(value float64) float64 // Add the value of a new period, returns the new value of the indicator
+	Value() float64
+	Ready() bool // false until enough periods were added
+}
+
+// Indicator computed from bars
+type BarIndicator interface {
+	UpdateBar(bar Bar) float64
+	Value() float64
+	Ready() bool
+}
+
+// Values of the indicator for each value, NaN until the indicator is ready
+func Series(indicator Indicator, values []float64) []float64 {
+	result := make([]float64, len(values))
+	for i, value := range values {
+		v := indicator.Update(value)
+		if !indicator.Ready() {
+			v = math.NaN()
+		}
+		result[i] = v
+	}
+	return result
+}
+
+// Values of the indicator for each bar, NaN until the indicator is ready
+func BarSeries(indicator BarIndicator, bars []Bar) []float64 {
+	result := make([]float64, len(bars))
+	for i, bar := range bars {
+		v := indicator.UpdateBar(bar)
+		if !indicator.Ready() {
+			v = math.NaN()
+		}
+		result[i] = v
+	}
+	return result
+}
+
+// Fixed size window of the last values
+type window struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newWindow(size int) *window {
+	return &window{values: make([]float64, size)}
+}
+
+// Add value, returns the value removed from the window (0 until the window is full)
+func (w *window) push(value float64) float64 {
+	removed := w.values[w.next]
+	if !w.full {
+		removed = 0
+	}
+	w.values[w.next] = value
+	w.next++
+	if w.next == len(w.values) {
+		w.next = 0
+		w.full = true
+	}
+	return removed
+}
+
+func (w *window) count() int {
+	if w.full {
+		return len(w.values)
+	}
+	return w.next
+}
+
+func (w *window) each(f func(value float64)) {
+	for i := 0; i < w.count(); i++ {
+		f(w.values[i])
+	}
+}
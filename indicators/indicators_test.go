@@ -0,0 +1,188 @@
+package indicators
+
+import (
+	"math"
+	"testing"
+)
+
+// Closes of the StockCharts RSI example (cs-rsi.xls)
+var rsiCloses = []float64{44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08, 45.89, 46.03, 45.61, 46.28,
+	46.28, 46.00, 46.03, 46.41, 46.22, 45.64, 46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18, 44.22, 44.57, 43.42,
+	42.66, 43.13}
+
+// Closes of the StockCharts moving averages example (cs-ema.xls)
+var maCloses = []float64{22.27, 22.19, 22.08, 22.17, 22.18, 22.13, 22.23, 22.43, 22.24, 22.29, 22.15, 22.39, 22.38, 22.61,
+	23.36, 24.05, 23.75, 23.83, 23.95, 23.63, 23.82, 23.87, 23.65, 23.19, 23.10, 23.33, 22.68, 23.10, 22.40, 22.17}
+
+// Bars (high, low, close) of the StockCharts ATR example (cs-atr.xls)
+var atrBars = []Bar{{High: 48.70, Low: 47.79, Close: 48.16}, {High: 48.72, Low: 48.14, Close: 48.61}, {High: 48.90, Low: 48.39, Close: 48.75},
+	{High: 48.87, Low: 48.37, Close: 48.63}, {High: 48.82, Low: 48.24, Close: 48.74}, {High: 49.05, Low: 48.64, Close: 49.03},
+	{High: 49.20, Low: 48.94, Close: 49.07}, {High: 49.35, Low: 48.86, Close: 49.32}, {High: 49.92, Low: 49.50, Close: 49.91},
+	{High: 50.19, Low: 49.87, Close: 50.13}, {High: 50.12, Low: 49.20, Close: 49.53}, {High: 49.66, Low: 48.90, Close: 49.50},
+	{High: 49.88, Low: 49.43, Close: 49.75}, {High: 50.19, Low: 49.73, Close: 50.03}, {High: 50.36, Low: 49.26, Close: 50.31},
+	{High: 50.57, Low: 50.09, Close: 50.52}, {High: 50.65, Low: 50.30, Close: 50.41}, {High: 50.43, Low: 49.21, Close: 49.34},
+	{High: 49.63, Low: 48.98, Close: 49.37}, {High: 50.33, Low: 49.61, Close: 50.23}}
+
+// Compare the ready values of got with want, within tolerance (0.006 for the references rounded to 2 decimals).
+// The values before them must be NaN
+func checkSeries(t *testing.T, name string, got []float64, want []float64, tolerance float64) {
+	t.Helper()
+	offset := len(got) - len(want)
+	for i := 0; i < offset; i++ {
+		if !math.IsNaN(got[i]) {
+			t.Errorf("%s[%d] = %f, not ready yet, want NaN", name, i, got[i])
+		}
+	}
+	for i, value := range want {
+		if math.Abs(got[offset+i]-value) > tolerance {
+			t.Errorf("%s[%d] = %f, want %f", name, offset+i, got[offset+i], value)
+		}
+	}
+}
+
+func TestSMA(t *testing.T) {
+	sma, err := NewSMA(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeries(t, "SMA(10)", Series(sma, maCloses), []float64{22.22, 22.21, 22.23, 22.26, 22.30, 22.42, 22.61, 22.77, 22.91,
+		23.08, 23.21, 23.38, 23.52, 23.65, 23.71, 23.68, 23.61, 23.51, 23.43, 23.28, 23.13}, 0.006)
+}
+
+func TestEMA(t *testing.T) {
+	ema, err := NewEMA(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeries(t, "EMA(10)", Series(ema, maCloses), []float64{22.22, 22.21, 22.24, 22.27, 22.33, 22.52, 22.80, 22.97, 23.13,
+		23.28, 23.34, 23.43, 23.51, 23.53, 23.47, 23.40, 23.39, 23.26, 23.23, 23.08, 22.92}, 0.006)
+}
+
+func TestRSI(t *testing.T) {
+	rsi, err := NewRSI(14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeries(t, "RSI(14)", Series(rsi, rsiCloses), []float64{70.46, 66.25, 66.48, 69.35, 66.29, 57.92, 62.88, 63.21, 56.01,
+		62.34, 54.67, 50.39, 40.02, 41.49, 41.90, 45.50, 37.32, 33.09, 37.79}, 0.006)
+}
+
+func TestRSIWithoutLoss(t *testing.T) {
+	rsi, _ := NewRSI(3)
+	for _, value := range []float64{1, 2, 3, 4, 5} {
+		rsi.Update(value)
+	}
+	if !rsi.Ready() || rsi.Value() != 100 {
+		t.Errorf("RSI of a rising series = %f, ready %v, want 100", rsi.Value(), rsi.Ready())
+	}
+}
+
+// EMAs seeded with the SMA of their first values, the signal line starts with the first MACD value of a ready slow EMA
+func TestMACD(t *testing.T) {
+	macdSeries, signalSeries, histogramSeries, err := MACDSeries(rsiCloses[:16], 3, 6, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeries(t, "MACD(3,6,4)", macdSeries, []float64{0.4138, 0.4259, 0.3287, 0.2770, 0.1290, 0.2013, 0.1983, 0.1089}, 0.00005)
+	checkSeries(t, "MACD(3,6,4) signal", signalSeries, []float64{0.3328, 0.3701, 0.3535, 0.3229, 0.2453, 0.2277, 0.2160, 0.1732}, 0.00005)
+	checkSeries(t, "MACD(3,6,4) histogram", histogramSeries, []float64{0.0809, 0.0558, -0.0248, -0.0459, -0.1164, -0.0264, -0.0176, -0.0642}, 0.00005)
+}
+
+func TestBollinger(t *testing.T) {
+	bollinger, err := NewBollinger(5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []float64{1, 2, 3, 4} {
+		bollinger.Update(value)
+		if bollinger.Ready() {
+			t.Fatal("Bollinger(5) ready after less than 5 values")
+		}
+	}
+	// Population standard deviation of 1..5: sqrt(2)
+	if middle := bollinger.Update(5); !bollinger.Ready() || middle != 3 {
+		t.Fatalf("Bollinger(5) middle = %f, ready %v, want 3", middle, bollinger.Ready())
+	}
+	if math.Abs(bollinger.Upper()-(3+2*math.Sqrt2)) > 1e-9 || math.Abs(bollinger.Lower()-(3-2*math.Sqrt2)) > 1e-9 {
+		t.Errorf("Bollinger(5, 2) bands = %f, %f, want %f, %f", bollinger.Upper(), bollinger.Lower(), 3+2*math.Sqrt2, 3-2*math.Sqrt2)
+	}
+	// 2..6 after 1 leaves the window
+	bollinger.Update(6)
+	if bollinger.Value() != 4 || math.Abs(bollinger.Upper()-(4+2*math.Sqrt2)) > 1e-9 {
+		t.Errorf("Bollinger(5, 2) after a new value = %f, upper %f", bollinger.Value(), bollinger.Upper())
+	}
+}
+
+func TestATR(t *testing.T) {
+	atr, err := NewATR(14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSeries(t, "ATR(14)", BarSeries(atr, atrBars), []float64{0.55, 0.59, 0.59, 0.57, 0.61, 0.62, 0.64}, 0.006)
+}
+
+func TestDonchian(t *testing.T) {
+	donchian, err := NewDonchian(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bars := []Bar{{High: 10, Low: 8}, {High: 12, Low: 9}, {High: 11, Low: 7}, {High: 9, Low: 8.5}, {High: 10, Low: 9}}
+	uppers := []float64{10, 12, 12, 12, 11}
+	lowers := []float64{8, 8, 7, 7, 7}
+	for i, bar := range bars {
+		middle := donchian.UpdateBar(bar)
+		if donchian.Upper() != uppers[i] || donchian.Lower() != lowers[i] || middle != (uppers[i]+lowers[i])/2 {
+			t.Errorf("Donchian(3) bar %d = %f / %f / %f, want %f / %f", i, donchian.Upper(), middle, donchian.Lower(), uppers[i], lowers[i])
+		}
+		if donchian.Ready() != (i >= 2) {
+			t.Errorf("Donchian(3) bar %d ready = %v", i, donchian.Ready())
+		}
+	}
+}
+
+func TestVWAP(t *testing.T) {
+	vwap := NewVWAP()
+	if vwap.Ready() {
+		t.Fatal("VWAP ready without volume")
+	}
+	vwap.UpdateBar(Bar{High: 12, Low: 9, Close: 12, Volume: 2})           // Typical price 11
+	value := vwap.UpdateBar(Bar{High: 21, Low: 19, Close: 20, Volume: 3}) // Typical price 20
+	if math.Abs(value-(11*2+20*3)/5.0) > 1e-9 {
+		t.Errorf("VWAP = %f, want %f", value, (11*2+20*3)/5.0)
+	}
+	vwap.Reset()
+	if vwap.Ready() || vwap.UpdateBar(Bar{High: 6, Low: 3, Close: 3, Volume: 1}) != 4 {
+		t.Errorf("VWAP after Reset = %f, want 4", vwap.Value())
+	}
+}
+
+func TestOBV(t *testing.T) {
+	obv := NewOBV()
+	closes := []float64{10, 11, 11, 9, 12}
+	volumes := []float64{100, 50, 70, 30, 20}
+	want := []float64{0, 50, 50, 20, 40}
+	for i := range closes {
+		if value := obv.UpdateBar(Bar{Close: closes[i], Volume: volumes[i]}); value != want[i] {
+			t.Errorf("OBV bar %d = %f, want %f", i, value, want[i])
+		}
+	}
+}
+
+func TestInvalidPeriod(t *testing.T) {
+	for _, period := range []int{0, -1} {
+		errs := map[string]error{}
+		_, errs["SMA"] = NewSMA(period)
+		_, errs["EMA"] = NewEMA(period)
+		_, errs["RSI"] = NewRSI(period)
+		_, errs["MACD"] = NewMACD(12, period, 9)
+		_, errs["Bollinger"] = NewBollinger(period, 2)
+		_, errs["ATR"] = NewATR(period)
+		_, errs["Donchian"] = NewDonchian(period)
+		_, _, _, errs["MACDSeries"] = MACDSeries(maCloses, period, 26, 9)
+		for name, err := range errs {
+			if err != ErrInvalidPeriod {
+				t.Errorf("%s(%d): error %v, want ErrInvalidPeriod", name, period, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package indicators
+
+import (
+	"math"
+)
+
+// Simple moving average
+type SMA struct {
+	period int
+	window *window
+	sum    float64
+	value  float64
+}
+
+func NewSMA(period int) (*SMA, error) {
+	if period <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	return &SMA{period: period, window: newWindow(period)}, nil
+}
+
+func (sma *SMA) Update(value float64) float64 {
+	sma.sum += value - sma.window.push(value)
+	sma.value = sma.sum / float64(sma.window.count())
+	return sma.value
+}
+
+func (sma *SMA) Value() float64 {
+	return sma.value
+}
+
+func (sma *SMA) Ready() bool {
+	return sma.window.full
+}
+
+// Exponential moving average, seeded with the SMA of the first period values
+type EMA struct {
+	period int
+	alpha  float64
+	count  int
+	sum    float64
+	value  float64
+}
+
+func NewEMA(period int) (*EMA, error) {
+	if period <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	return &EMA{period: period, alpha: 2 / float64(period+1)}, nil
+}
+
+func (ema *EMA) Update(value float64) float64 {
+	ema.count++
+	if ema.count <= ema.period {
+		ema.sum += value
+		ema.value = ema.sum / float64(ema.count)
+	} else {
+		ema.value += ema.alpha * (value - ema.value)
+	}
+	return ema.value
+}
+
+func (ema *EMA) Value() float64 {
+	return ema.value
+}
+
+func (ema *EMA) Ready() bool {
+	return ema.count >= ema.period
+}
+
+// Moving average convergence divergence: EMA(fast) - EMA(slow), its signal line EMA(signal) and their difference
+type MACD struct {
+	fast      *EMA
+	slow      *EMA
+	signal    *EMA
+	macd      float64
+	histogram float64
+}
+
+func NewMACD(fast int, slow int, signal int) (*MACD, error) {
+	if fast <= 0 || slow <= 0 || signal <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	fastEMA, _ := NewEMA(fast)
+	slowEMA, _ := NewEMA(slow)
+	signalEMA, _ := NewEMA(signal)
+	return &MACD{fast: fastEMA, slow: slowEMA, signal: signalEMA}, nil
+}
+
+// Returns the MACD line, the signal line is read with Signal and the histogram with Histogram
+func (macd *MACD) Update(value float64) float64 {
+	fast := macd.fast.Update(value)
+	slow := macd.slow.Update(value)
+	macd.macd = fast - slow
+	if macd.slow.Ready() { // The signal line starts with the first MACD value
+		macd.signal.Update(macd.macd)
+		macd.histogram = macd.macd - macd.signal.Value()
+	}
+	return macd.macd
+}
+
+func (macd *MACD) Value() float64 {
+	return macd.macd
+}
+
+func (macd *MACD) Signal() float64 {
+	return macd.signal.Value()
+}
+
+func (macd *MACD) Histogram() float64 {
+	return macd.histogram
+}
+
+func (macd *MACD) Ready() bool {
+	return macd.signal.Ready()
+}
+
+// MACD, signal and histogram series, NaN until ready
+func MACDSeries(values []float64, fast int, slow int, signal int) (macdSeries []float64, signalSeries []float64, histogramSeries []float64, err error) {
+	macd, err := NewMACD(fast, slow, signal)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, value := range values {
+		macd.Update(value)
+		if macd.Ready() {
+			macdSeries = append(macdSeries, macd.Value())
+			signalSeries = append(signalSeries, macd.Signal())
+			histogramSeries = append(histogramSeries, macd.Histogram())
+		} else {
+			macdSeries = append(macdSeries, math.NaN())
+			signalSeries = append(signalSeries, math.NaN())
+			histogramSeries = append(histogramSeries, math.NaN())
+		}
+	}
+	return macdSeries, signalSeries, histogramSeries, nil
+}
@@ -0,0 +1,103 @@
+package indicators
+
+import (
+	"math"
+)
+
+// Relative strength index with Wilder's smoothing, between 0 and 100
+type RSI struct {
+	period   int
+	started  bool
+	count    int // number of changes
+	previous float64
+	avgGain  float64
+	avgLoss  float64
+	value    float64
+}
+
+func NewRSI(period int) (*RSI, error) {
+	if period <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	return &RSI{period: period}, nil
+}
+
+func (rsi *RSI) Update(value float64) float64 {
+	if !rsi.started { // The first value has no change
+		rsi.started = true
+		rsi.previous = value
+		return rsi.value
+	}
+	change := value - rsi.previous
+	rsi.previous = value
+	rsi.count++
+	gain, loss := math.Max(change, 0), math.Max(-change, 0)
+	if rsi.count <= rsi.period { // Simple average of the first changes
+		rsi.avgGain += (gain - rsi.avgGain) / float64(rsi.count)
+		rsi.avgLoss += (loss - rsi.avgLoss) / float64(rsi.count)
+	} else {
+		rsi.avgGain = (rsi.avgGain*float64(rsi.period-1) + gain) / float64(rsi.period)
+		rsi.avgLoss = (rsi.avgLoss*float64(rsi.period-1) + loss) / float64(rsi.period)
+	}
+	if rsi.avgLoss == 0 {
+		rsi.value = 100
+	} else {
+		rsi.value = 100 - 100/(1+rsi.avgGain/rsi.avgLoss)
+	}
+	return rsi.value
+}
+
+func (rsi *RSI) Value() float64 {
+	return rsi.value
+}
+
+func (rsi *RSI) Ready() bool {
+	return rsi.count >= rsi.period
+}
+
+// Bollinger bands: SMA(period) +/- k standard deviations (population)
+type Bollinger struct {
+	k      float64
+	sma    *SMA
+	window *window
+	upper  float64
+	lower  float64
+}
+
+func NewBollinger(period int, k float64) (*Bollinger, error) {
+	sma, err := NewSMA(period)
+	if err != nil {
+		return nil, err
+	}
+	return &Bollinger{k: k, sma: sma, window: newWindow(period)}, nil
+}
+
+// Returns the middle band, the others are read with Upper and Lower
+func (bollinger *Bollinger) Update(value float64) float64 {
+	middle := bollinger.sma.Update(value)
+	bollinger.window.push(value)
+	var variance float64
+	bollinger.window.each(func(v float64) {
+		variance += (v - middle) * (v - middle)
+	})
+	deviation := math.Sqrt(variance / float64(bollinger.window.count()))
+	bollinger.upper = middle + bollinger.k*deviation
+	bollinger.lower = middle - bollinger.k*deviation
+	return middle
+}
+
+func (bollinger *Bollinger) Value() float64 {
+	return bollinger.sma.Value()
+}
+
+func (bollinger *Bollinger) Upper() float64 {
+	return bollinger.upper
+}
+
+func (bollinger *Bollinger) Lower() float64 {
+	return bollinger.lower
+}
+
+func (bollinger *Bollinger) Ready() bool {
+	return bollinger.sma.Ready()
+}
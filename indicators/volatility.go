@@ -0,0 +1,89 @@
+package indicators
+
+import (
+	"math"
+)
+
+// Average true range with Wilder's smoothing
+type ATR struct {
+	period        int
+	count         int
+	previousClose float64
+	value         float64
+}
+
+func NewATR(period int) (*ATR, error) {
+	if period <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	return &ATR{period: period}, nil
+}
+
+func (atr *ATR) UpdateBar(bar Bar) float64 {
+	trueRange := bar.High - bar.Low
+	if atr.count > 0 {
+		trueRange = math.Max(trueRange, math.Max(math.Abs(bar.High-atr.previousClose), math.Abs(bar.Low-atr.previousClose)))
+	}
+	atr.previousClose = bar.Close
+	atr.count++
+	if atr.count <= atr.period { // Simple average of the first true ranges
+		atr.value += (trueRange - atr.value) / float64(atr.count)
+	} else {
+		atr.value = (atr.value*float64(atr.period-1) + trueRange) / float64(atr.period)
+	}
+	return atr.value
+}
+
+func (atr *ATR) Value() float64 {
+	return atr.value
+}
+
+func (atr *ATR) Ready() bool {
+	return atr.count >= atr.period
+}
+
+// Donchian channels: highest high and lowest low of the last period bars
+type Donchian struct {
+	highs *window
+	lows  *window
+	upper float64
+	lower float64
+}
+
+func NewDonchian(period int) (*Donchian, error) {
+	if period <= 0 {
+		return nil, ErrInvalidPeriod
+	}
+	return &Donchian{highs: newWindow(period), lows: newWindow(period)}, nil
+}
+
+// Returns the middle of the channel, the bounds are read with Upper and Lower
+func (donchian *Donchian) UpdateBar(bar Bar) float64 {
+	donchian.highs.push(bar.High)
+	donchian.lows.push(bar.Low)
+	donchian.upper = math.Inf(-1)
+	donchian.lower = math.Inf(1)
+	donchian.highs.each(func(v float64) {
+		donchian.upper = math.Max(donchian.upper, v)
+	})
+	donchian.lows.each(func(v float64) {
+		donchian.lower = math.Min(donchian.lower, v)
+	})
+	return donchian.Value()
+}
+
+func (donchian *Donchian) Value() float64 {
+	return (donchian.upper + donchian.lower) / 2
+}
+
+func (donchian *Donchian) Upper() float64 {
+	return donchian.upper
+}
+
+func (donchian *Donchian) Lower() float64 {
+	return donchian.lower
+}
+
+func (donchian *Donchian) Ready() bool {
+	return donchian.highs.full
+}
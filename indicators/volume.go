@@ -0,0 +1,68 @@
+package indicators
+
+// Volume weighted average price of the typical price (high + low + close) / 3, since the creation or the last Reset
+type VWAP struct {
+	priceVolume float64
+	volume      float64
+	value       float64
+}
+
+func NewVWAP() *VWAP {
+	return &VWAP{}
+}
+
+func (vwap *VWAP) UpdateBar(bar Bar) float64 {
+	vwap.priceVolume += (bar.High + bar.Low + bar.Close) / 3 * bar.Volume
+	vwap.volume += bar.Volume
+	if vwap.volume > 0 {
+		vwap.value = vwap.priceVolume / vwap.volume
+	}
+	return vwap.value
+}
+
+func (vwap *VWAP) Value() float64 {
+	return vwap.value
+}
+
+func (vwap *VWAP) Ready() bool {
+	return vwap.volume > 0
+}
+
+// Start a new session
+func (vwap *VWAP) Reset() {
+	vwap.priceVolume = 0
+	vwap.volume = 0
+	vwap.value = 0
+}
+
+// On balance volume, starts at 0 on the first bar
+type OBV struct {
+	count         int
+	previousClose float64
+	value         float64
+}
+
+func NewOBV() *OBV {
+	return &OBV{}
+}
+
+func (obv *OBV) UpdateBar(bar Bar) float64 {
+	if obv.count > 0 {
+		if bar.Close > obv.previousClose {
+			obv.value += bar.Volume
+		} else if bar.Close < obv.previousClose {
+			obv.value -= bar.Volume
+		}
+	}
+	obv.previousClose = bar.Close
+	obv.count++
+	return obv.value
+}
+
+func (obv *OBV) Value() float64 {
+	return obv.value
+}
+
+func (obv *OBV) Ready() bool {
+	return obv.count > 0
+}
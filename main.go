@@ -2,15 +2,144 @@ package main
 
 import (
 	nibiru "algo-trading/nibiru"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
-	algo := nibiru.NewAlgo()
-	algo.Run() // Start a ticker, which run in a goroutine
-	
-	wsocketClient := nibiru.NewWSocketClient()
-	wsocketClient.Listen(nibiru.GetConfigInstance().Init.Crypto + "-" + nibiru.GetConfigInstance().Init.Currency)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reindex": // Convert documents with string encoded numbers to the current schema
+			elasticClient := nibiru.NewElasticClient()
+			if len(os.Args) > 2 {
+				for _, index := range os.Args[2:] {
+					elasticClient.Reindex(index)
+				}
+			} else {
+				elasticClient.ReindexAll()
+			}
+			return
+		case "dedupe": // Delete the duplicated matches, indexed before they had a deterministic id
+			elasticClient := nibiru.NewElasticClient()
+			if len(os.Args) > 2 {
+				for _, index := range os.Args[2:] {
+					elasticClient.Dedupe(index)
+				}
+			} else {
+				elasticClient.DedupeAll()
+			}
+			return
+		case "ingest": // Websockets only: index the matches and publish the market events to the traders
+			os.Exit(run(true, false))
+		case "trade": // Algo only, fed by an ingester through trade.source
+			os.Exit(run(false, true))
+		case "compact": // Downsample and delete the daily match indices out of retention
+			nibiru.NewCompactor().Compact()
+			return
+		case "export-tax": // One CSV line per lot sold, with acquisition date, cost basis, proceeds and gain
+			file := "tax-report.csv"
+			if len(os.Args) > 2 {
+				file = os.Args[2]
+			}
+			if err := nibiru.ExportTax(file); err != nil {
+				fmt.Printf("export-tax failed: %s\n", err.Error())
+				os.Exit(1)
+			}
+			return
+		default:
+			fmt.Printf("Unknown command: %s\n", os.Args[1])
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(run(true, true))
+}
+
+// Run the bot until a signal, or until a websocket or the market source can't restore its connection, and return
+// the exit code. ingest: the websockets, whose matches are indexed and published to the traders. trade: the candles,
+// the risk manager and the algo, fed by the websocket of the main exchange with ingest, by the market source without
+func run(ingest bool, trade bool) int {
+	var source nibiru.MarketSource
+	if !ingest {
+		var err error
+		if source, err = nibiru.NewMarketSource(nibiru.GetMarketBusInstance()); err != nil {
+			fmt.Printf("trade failed: %s\n", err.Error())
+			return 1
+		}
+	}
+	var algo *nibiru.Algo
+	if trade {
+		nibiru.GetCandleBuilderInstance().Run()
+		nibiru.GetRiskManagerInstance().Run()
+		algo = nibiru.NewAlgo(source)
+		algo.Run() // Start a ticker, which run in a goroutine
+	}
+	var compactor *nibiru.Compactor
+	if ingest && nibiru.GetConfigInstance().Retention.RawMatchDays > 0 {
+		compactor = nibiru.NewCompactor()
+		compactor.Run()
+	}
+
+	// The websocket clients and the market source publish on the market bus, the consumers subscribe before they start
+	bus := nibiru.GetMarketBusInstance()
+	if ingest {
+		nibiru.SubscribeIngestConsumers(bus)
+	}
+	if trade {
+		nibiru.SubscribeTradeConsumers(bus)
+	}
+
+	// The listeners run until a signal, or until one of them fails
+	ctx, cancel := context.WithCancel(context.Background())
+	var listeners sync.WaitGroup
+	lost := make(chan error, 2+len(nibiru.GetConfigInstance().Divergence.Venues))
+	listen := func(listener func(ctx context.Context) error) {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			if err := listener(ctx); err != nil {
+				lost <- err
+			}
+		}()
+	}
+	productId := nibiru.GetConfigInstance().Init.Crypto + "-" + nibiru.GetConfigInstance().Init.Currency
+	if ingest {
+		for _, venue := range nibiru.GetConfigInstance().Divergence.Venues {
+			venue := venue
+			listen(func(ctx context.Context) error { return nibiru.NewVenueWSocketClient(venue).Run(ctx, venue.ProductId) })
+		}
+		nibiru.GetDivergenceMonitorInstance().Run()
+		if server := nibiru.GetMarketSocketServerInstance(); server != nil {
+			listen(server.Run)
+		}
+		listen(func(ctx context.Context) error { return nibiru.NewWSocketClient().Run(ctx, productId) })
+	} else {
+		listen(source.Run)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := nibiru.EXIT_OK
+	select {
+	case sig := <-signals:
+		nibiru.GetLoggerInstance().Info("Shutdown on signal %s", sig.String())
+	case err := <-lost:
+		nibiru.GetLoggerInstance().Error("Shutdown, connection lost: %s", err.Error())
+		exitCode = nibiru.EXIT_CONNECTION_LOST
+	}
+	signal.Stop(signals) // A second signal kills the process
+	if compactor != nil {
+		compactor.Stop()
+	}
+	exitCode = nibiru.Shutdown(algo, func() {
+		cancel()
+		listeners.Wait()
+	}, exitCode)
 	fmt.Printf("[INFO] %s - ALGO FINISHED\n", time.Now().Format("15:04:05"))
-}
\ No newline at end of file
+	return exitCode
+}
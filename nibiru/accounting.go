@@ -0,0 +1,99 @@
+package nibiru
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Fill of an order, from the exchange or, in paper trading, from esFillIndex
+type Fill struct {
+	Time  time.Time
+	Side  string
+	Price float64
+	Size  float64
+	Fee   float64 // In currency
+}
+
+// All the fills of productId, oldest first
+func LoadFills(productId string) ([]Fill, error) {
+	var fills []Fill
+	if simulationActivated {
+		docs, err := NewElasticClient().ListFillOrders(productId)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			fills = append(fills, Fill{doc.FillTime, doc.Side, doc.Price, doc.Size, doc.Fee})
+		}
+	} else {
+		var err error
+		if fills, err = NewExchange().ListFills(productId); err != nil {
+			return nil, err
+		}
+	}
+	sortFills(fills)
+	return fills, nil
+}
+
+// Oldest first
+func sortFills(fills []Fill) {
+	sort.SliceStable(fills, func(i, j int) bool { return fills[i].Time.Before(fills[j].Time) })
+}
+
+// Replay the fills: each buy becomes a lot, each sell consumes lots in the order of method.
+// Returns the open position and the disposals of all the sells
+func BuildLedger(fills []Fill, method string) (*Position, []Disposal) {
+	position := NewPosition(method)
+	var disposals []Disposal
+	for _, fill := range fills {
+		switch fill.Side {
+		case "buy":
+			position.Add(Lot{fill.Time, fill.Price, fill.Size, fill.Fee})
+		case "sell":
+			if fill.Size > position.Size() {
+				GetLoggerInstance().Error("In accounting/BuildLedger. Sell of %f at %s above the position %f, lots bought before the first fill are missing",
+					fill.Size, fill.Time.Format(time.RFC3339), position.Size())
+			}
+			disposals = append(disposals, position.Dispose(fill.Time, fill.Size, fill.Price, fill.Fee)...)
+		}
+	}
+	return position, disposals
+}
+
+// Write the disposals of the traded product to a CSV file, one line per part of lot sold
+func ExportTax(file string) error {
+	productId := GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency
+	fills, err := LoadFills(productId)
+	if err != nil {
+		return err
+	}
+	position, disposals := BuildLedger(fills, GetConfigInstance().Accounting.LotMethod)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"acquisition_date", "disposal_date", "product_id", "size", "cost_basis", "proceeds", "gain"})
+	for _, disposal := range disposals {
+		w.Write([]string{
+			disposal.Acquired.UTC().Format(time.RFC3339),
+			disposal.Disposed.UTC().Format(time.RFC3339),
+			productId,
+			strconv.FormatFloat(disposal.Size, 'f', -1, 64),
+			strconv.FormatFloat(disposal.CostBasis, 'f', 2, 64),
+			strconv.FormatFloat(disposal.Proceeds, 'f', 2, 64),
+			strconv.FormatFloat(disposal.Gain, 'f', 2, 64),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	GetLoggerInstance().Info("ExportTax - %d disposals written to %s, realized: %f, open position: %f", len(disposals), file, position.Realized(), position.Size())
+	return nil
+}
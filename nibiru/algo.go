@@ -1,7 +1,6 @@
 package nibiru
 
 import (
-	"fmt"
 	"time"
 )
 
@@ -10,78 +9,177 @@ type Algo struct {
 	periodShort    int //minutes
 	thresholdShort float64
 	thresholdLong  float64
-	volumeTicker   *time.Ticker
+	loop           *tickerLoop
 	elasticClient  *ElasticClient
 	gdaxClient     *GdaxClient
+	indicators     *MarketIndicators
+	reconciler     *Reconciler
+	volumes        *VolumeWindows // nil when the volumes and the price are read from Elasticsearch
 }
 
-func NewAlgo() *Algo {
+// source is the market source of the trader, nil when the process ingests: the volumes and the price are then read
+// from the matches indexed in Elasticsearch, as with the elastic source, and from the trades of the market bus otherwise
+func NewAlgo(source MarketSource) *Algo {
 	elasticClient := NewElasticClient()
+	gdaxClient := NewGdaxClient()
+	var volumes *VolumeWindows
+	if source != nil && !isElasticSource(source) {
+		volumes = GetVolumeWindowsInstance()
+	}
 	return &Algo{GetConfigInstance().Algo.PeriodLong, GetConfigInstance().Algo.PeriodShort, GetConfigInstance().Algo.ThresholdShort,
-		GetConfigInstance().Algo.ThresholdLong, nil, elasticClient, NewGdaxClient()}
+		GetConfigInstance().Algo.ThresholdLong, nil, elasticClient, gdaxClient, GetMarketIndicatorsInstance(), NewReconciler(gdaxClient), volumes}
 }
 
 func (algo *Algo) Run() {
 	//GetLoggerInstance().Info("In elastic-client/Aggregate. TEST: %f", algo.elasticClient.Aggregate("size", GetConfigInstance().Algo.PeriodLong, "avg"))
 
+	algo.reconciler.Run()
 	GetLoggerInstance().Info("Run Algo ticker")
 	startAlgoTime := time.Now()
-	algo.volumeTicker = time.NewTicker(time.Duration(algo.periodShort) * time.Minute)
-	go func() {
-		for t := range algo.volumeTicker.C {
-			GetLoggerInstance().Info("Algo/Run")
-			if time.Now().Sub(startAlgoTime) >= time.Duration(algo.periodLong)*time.Minute { // Wait for initialization period
-				var side = "buy"
-				var sideOpposite = "sell"
-				portfolioSide := algo.gdaxClient.checkStatus()
-				if portfolioSide == "buy" { // means we have cash and not crypto
-					side = "sell" // If the side is sell this indicates the maker was a sell order and the match is considered an up-tick. A buy side match is a down-tick.
-					// important sell side orders volume means the price is going up, that's what we want to detect when we want to buy
-					sideOpposite = "buy"
-				}
-				GetLoggerInstance().Info("Algo/Run - Side: %s", side)
-				// Average volume orders in the last periodShort minutes
-				sumVolumeShort := algo.elasticClient.Aggregate("size", algo.periodShort, "sum", side)
-				sumVolumeShortOpposite := algo.elasticClient.Aggregate("size", algo.periodShort, "sum", sideOpposite)
-
-				// Sum volume orders in the last periodLong
-				sumVolumeLong := algo.elasticClient.Aggregate("size", algo.periodLong, "sum", side)
-				sumVolumeLongOpposite := algo.elasticClient.Aggregate("size", algo.periodLong, "sum", sideOpposite)
-
-				GetLoggerInstance().Info("Algo/Run - volume short: %f", sumVolumeShort)
-				GetLoggerInstance().Info("Algo/Run - sumVolumeLong: %f", sumVolumeLong)
-				GetLoggerInstance().Info("Algo/Run - volume long rapporte sur short periode: %f", sumVolumeLong/float64(algo.periodLong/algo.periodShort))
-				GetLoggerInstance().Info("Algo/Run - volume short Opposite: %f", sumVolumeShortOpposite)
-				GetLoggerInstance().Info("Algo/Run - sumVolumeLong Opposite: %f", sumVolumeLongOpposite)
-				GetLoggerInstance().Info("Algo/Run - volume long rapporte sur short periode Opposite: %f", sumVolumeLongOpposite/float64(algo.periodLong/algo.periodShort))
-
-				price := algo.elasticClient.GetLatestPrice() // Only for testing, in prod we create market order
-				
-				if side == "sell" {
-					algo.elasticClient.IndexDiffSize(t, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, sumVolumeShort, sumVolumeShortOpposite, price)
-					algo.elasticClient.IndexSubSize(t, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, sumVolumeShort, sumVolumeShortOpposite, price)
-				} else {
-					algo.elasticClient.IndexDiffSize(t, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, sumVolumeShortOpposite, sumVolumeShort, price)
-					algo.elasticClient.IndexSubSize(t, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, sumVolumeShortOpposite, sumVolumeShort, price)
-				}
-								
-				// Volume side des periodShort dernieres minutes / Volume sideOpposite des periodShort dernieres minutes > thresholdShort
-				if sumVolumeShort/sumVolumeShortOpposite > algo.thresholdShort {
-					GetLoggerInstance().Info("Algo/Run - VALIDATE: %f", sumVolumeShort/sumVolumeShortOpposite)
-					algo.gdaxClient.UpdatePosition(portfolioSide, price)
-				} else {
-					// Volume side des periodLong dernieres minutes / Volume sideOpposite des periodLong dernieres minutes > thresholdLong
-					if sumVolumeLong/sumVolumeLongOpposite > algo.thresholdLong {
-						GetLoggerInstance().Info("Algo/Run - VALIDATE: %f", sumVolumeLong/sumVolumeLongOpposite)
-						algo.gdaxClient.UpdatePosition(portfolioSide, price)
-					}
-				}
+	algo.loop = startTickerLoop(time.Duration(algo.periodShort)*time.Minute, func(t time.Time) {
+		GetLoggerInstance().Info("Algo/Run")
+		if time.Now().Sub(startAlgoTime) >= time.Duration(algo.periodLong)*time.Minute { // Wait for initialization period
+			algo.tick(t)
+		}
+	})
+}
+
+func (algo *Algo) tick(t time.Time) {
+	// The volumes miss the matches of a stale feed until it is resynced, and the orders of a product
+	// restricted by the exchange would be rejected
+	if paused, reason := GetFeedMonitorInstance().Paused(mainVenue(), GetConfigInstance().Init.Crypto+"-"+GetConfigInstance().Init.Currency); paused {
+		GetLoggerInstance().Info("Algo/Run - Tick skipped, %s", reason)
+		return
+	}
+
+	// If the side is sell this indicates the maker was a sell order and the match is considered an up-tick. A buy side match is a down-tick.
+	// important sell side orders volume means the price is going up, that's what we want to detect when we want to buy
+	// The first ES error skips the tick, the volumes of the market bus don't fail
+	var err error
+	sumVolume := func(minutes int, side string) float64 {
+		if err != nil {
+			return 0
+		}
+		if algo.volumes != nil {
+			return algo.volumes.Sum(minutes, side, time.Now())
+		}
+		var volume float64
+		volume, err = algo.elasticClient.Aggregate(algo.gdaxClient.productId, "size", minutes, "sum", side)
+		return volume
+	}
+	// Sum volume orders in the last periodShort minutes
+	sumVolumeShortSell := sumVolume(algo.periodShort, "sell")
+	sumVolumeShortBuy := sumVolume(algo.periodShort, "buy")
+
+	// Sum volume orders in the last periodLong
+	sumVolumeLongSell := sumVolume(algo.periodLong, "sell")
+	sumVolumeLongBuy := sumVolume(algo.periodLong, "buy")
+	if err != nil {
+		GetLoggerInstance().Error("Algo/Run - Tick skipped: %s", err.Error())
+		return
+	}
+
+	GetLoggerInstance().Info("Algo/Run - volume short sell: %f, buy: %f", sumVolumeShortSell, sumVolumeShortBuy)
+	GetLoggerInstance().Info("Algo/Run - volume long sell: %f, buy: %f", sumVolumeLongSell, sumVolumeLongBuy)
+	GetLoggerInstance().Info("Algo/Run - volume long rapporte sur short periode sell: %f, buy: %f", sumVolumeLongSell/float64(algo.periodLong/algo.periodShort), sumVolumeLongBuy/float64(algo.periodLong/algo.periodShort))
+
+	if snapshot := algo.indicators.Snapshot(); snapshot.Ready {
+		GetLoggerInstance().Info("Algo/Run - Indicators at %s - RSI: %f, MACD histogram: %f, ATR: %f, VWAP: %f",
+			snapshot.Time.Format(time.RFC3339), snapshot.RSI, snapshot.MACDHistogram, snapshot.ATR, snapshot.VWAP)
+	}
+
+	price, err := algo.latestPrice()
+	if err != nil {
+		GetLoggerInstance().Error("Algo/Run - Tick skipped: %s", err.Error())
+		return
+	}
+	GetRiskManagerInstance().UpdateEquity(algo.gdaxClient.Equity(price))
+	realized, unrealized := algo.gdaxClient.Pnl(price)
+	GetLoggerInstance().Info("Algo/Run - P&L realized: %f, unrealized: %f", realized, unrealized)
+
+	algo.elasticClient.IndexDiffSize(t, GetConfigInstance().Init.Crypto+"-"+GetConfigInstance().Init.Currency, sumVolumeShortSell, sumVolumeShortBuy, price)
+	algo.elasticClient.IndexSubSize(t, GetConfigInstance().Init.Crypto+"-"+GetConfigInstance().Init.Currency, sumVolumeShortSell, sumVolumeShortBuy, price)
+
+	// Buy signal: volume sell / volume buy above the threshold, on periodShort or periodLong
+	canScaleIn, err := algo.gdaxClient.CanScaleIn()
+	if err != nil {
+		algo.skip(err)
+		return
+	}
+	if canScaleIn {
+		strength := algo.strength(sumVolumeShortSell, sumVolumeShortBuy, sumVolumeLongSell, sumVolumeLongBuy)
+		if strength > 1 {
+			GetLoggerInstance().Info("Algo/Run - VALIDATE buy, strength: %f", strength)
+			GetBrokerPublisherInstance().PublishSignal(SignalMessage{t, algo.gdaxClient.productId, "buy", strength, price})
+			if err := algo.gdaxClient.ScaleIn(algo.orderPrice("buy", price), strength); err != nil {
+				algo.skip(err)
+				return
+			}
+		}
+	}
+	// Sell signal: volume buy / volume sell above the threshold
+	if algo.gdaxClient.HasPosition() {
+		strength := algo.strength(sumVolumeShortBuy, sumVolumeShortSell, sumVolumeLongBuy, sumVolumeLongSell)
+		if strength > 1 {
+			GetLoggerInstance().Info("Algo/Run - VALIDATE sell, strength: %f", strength)
+			GetBrokerPublisherInstance().PublishSignal(SignalMessage{t, algo.gdaxClient.productId, "sell", strength, price})
+			if err := algo.gdaxClient.ScaleOut(algo.orderPrice("sell", price)); err != nil {
+				algo.skip(err)
 			}
 		}
-	}()
+	}
+}
+
+// Price of the last match indexed, or of the last trade of the market bus
+func (algo *Algo) latestPrice() (float64, error) {
+	if algo.volumes != nil {
+		return GetMarketQuotesInstance().LastPrice(algo.gdaxClient.productId)
+	}
+	return algo.elasticClient.GetLatestPrice(algo.gdaxClient.productId) // Only for testing, in prod we create market order
+}
+
+// Best ask to buy or best bid to sell, from the quotes of the market bus. price if no quote was received
+func (algo *Algo) orderPrice(side string, price float64) float64 {
+	if quote, err := GetMarketQuotesInstance().OrderPrice(algo.gdaxClient.productId, side); err == nil {
+		return quote
+	}
+	return price
+}
+
+// A temporary exchange error or an order rejected by the RiskManager skips the tick, the next one will retry.
+// Other errors (authentication, bad request, order rejected by the exchange...) won't get better: trading is halted
+func (algo *Algo) skip(err error) {
+	if _, ok := err.(*RiskRejection); ok {
+		GetLoggerInstance().Info("Algo/Run - Tick skipped: %s", err.Error())
+		return
+	}
+	if apiError, ok := err.(*APIError); ok && apiError.Temporary() {
+		GetLoggerInstance().Error("Algo/Run - Tick skipped: %s", err.Error())
+		return
+	}
+	if !GetRiskManagerInstance().Killed() {
+		GetRiskManagerInstance().Kill("exchange error: " + err.Error())
+		return
+	}
+	GetLoggerInstance().Error("Algo/Run - Tick skipped: %s", err.Error())
+}
+
+// Strength of the signal: the highest of the short and long volume ratios, relative to their threshold. Above 1, the signal is validated.
+// A period without opposite volume gives 0: no ratio, no signal
+func (algo *Algo) strength(sumVolumeShort float64, sumVolumeShortOpposite float64, sumVolumeLong float64, sumVolumeLongOpposite float64) float64 {
+	// Volume side des periodShort dernieres minutes / Volume sideOpposite des periodShort dernieres minutes / thresholdShort
+	strengthShort := ratio(sumVolumeShort, sumVolumeShortOpposite) / algo.thresholdShort
+	// Volume side des periodLong dernieres minutes / Volume sideOpposite des periodLong dernieres minutes / thresholdLong
+	strengthLong := ratio(sumVolumeLong, sumVolumeLongOpposite) / algo.thresholdLong
+	if strengthShort > strengthLong {
+		return strengthShort
+	}
+	return strengthLong
 }
 
+// Stop the ticker and the reconciliation, after the tick in progress
 func (algo *Algo) Stop() {
-	algo.volumeTicker.Stop()
-	fmt.Println("Ticker stopped")
+	algo.loop.Stop()
+	algo.reconciler.Stop()
+	GetLoggerInstance().Info("Algo ticker stopped")
 }
@@ -0,0 +1,26 @@
+package nibiru
+
+import (
+	"testing"
+)
+
+// The highest of the short and long ratios over their threshold, 0 for a period without opposite volume
+func TestAlgoStrength(t *testing.T) {
+	algo := &Algo{thresholdShort: 2, thresholdLong: 4}
+	tests := []struct {
+		short, shortOpposite, long, longOpposite float64
+		strength                                 float64
+	}{
+		{6, 2, 8, 4, 1.5},
+		{2, 2, 20, 2, 2.5},
+		{6, 0, 8, 4, 0.5},
+		{6, 2, 8, 0, 1.5},
+		{6, 0, 8, 0, 0},
+		{0, 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		if strength := algo.strength(test.short, test.shortOpposite, test.long, test.longOpposite); strength != test.strength {
+			t.Errorf("strength(%g, %g, %g, %g) = %v, want %v", test.short, test.shortOpposite, test.long, test.longOpposite, strength, test.strength)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package nibiru
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+const (
+	BINANCE_RECV_WINDOW     string  = "5000" // In milliseconds
+	BINANCE_ORDER_NOT_FOUND int     = -2013
+	BINANCE_PUBLIC_RATE     float64 = 10 // Requests per second by IP, below the 6000 weight per minute
+	BINANCE_PRIVATE_RATE    float64 = 5  // Requests per second by account, below the 50 orders per 10 seconds
+)
+
+// Market data endpoints, without signature, limited by IP
+func isBinancePublic(path string) bool {
+	for _, prefix := range []string{"/api/v3/exchangeInfo", "/api/v3/ticker", "/api/v3/trades", "/api/v3/historicalTrades",
+		"/api/v3/aggTrades", "/api/v3/depth", "/api/v3/klines", "/api/v3/time", "/api/v3/ping"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Binance spot API. Account.Key is the API key, Account.Secret the HMAC secret.
+// Product ids BTC-EUR are symbols BTCEUR
+type binanceExchange struct {
+	baseURL    string
+	key        string
+	secret     string
+	httpClient *http.Client
+}
+
+// {"code": -2013, "msg": "Order does not exist."}
+type binanceError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type binanceExchangeInfo struct {
+	Symbols []struct {
+		Symbol  string `json:"symbol"`
+		Filters []struct {
+			FilterType string `json:"filterType"`
+			MinQty     string `json:"minQty"`
+			MaxQty     string `json:"maxQty"`
+			StepSize   string `json:"stepSize"`
+			TickSize   string `json:"tickSize"`
+		} `json:"filters"`
+	} `json:"symbols"`
+}
+
+type binanceAccount struct {
+	Balances []struct {
+		Asset  string  `json:"asset"`
+		Free   float64 `json:"free,string"`
+		Locked float64 `json:"locked,string"`
+	} `json:"balances"`
+}
+
+type binanceTrade struct {
+	Id              int64   `json:"id"`
+	OrderId         int64   `json:"orderId"`
+	Price           float64 `json:"price,string"`
+	Qty             float64 `json:"qty,string"`
+	Commission      float64 `json:"commission,string"`
+	CommissionAsset string  `json:"commissionAsset"`
+	Time            int64   `json:"time"` // In milliseconds
+	IsBuyer         bool    `json:"isBuyer"`
+}
+
+type binanceOrder struct {
+	Symbol              string  `json:"symbol"`
+	OrderId             int64   `json:"orderId"`
+	ClientOrderId       string  `json:"clientOrderId"`
+	Price               float64 `json:"price,string"`
+	OrigQty             float64 `json:"origQty,string"`
+	ExecutedQty         float64 `json:"executedQty,string"`
+	CummulativeQuoteQty float64 `json:"cummulativeQuoteQty,string"`
+	Status              string  `json:"status"` // NEW, PARTIALLY_FILLED, FILLED, CANCELED, PENDING_CANCEL, REJECTED, EXPIRED
+	Type                string  `json:"type"`
+	Side                string  `json:"side"`
+	Time                int64   `json:"time"`
+	TransactTime        int64   `json:"transactTime"` // Instead of time in the answer of POST /api/v3/order
+}
+
+type binanceBookTicker struct {
+	BidPrice float64 `json:"bidPrice,string"`
+	AskPrice float64 `json:"askPrice,string"`
+}
+
+func newBinanceExchange() *binanceExchange {
+	return &binanceExchange{strings.TrimRight(GetConfigInstance().BaseURL, "/"), GetConfigInstance().Account.Key, GetConfigInstance().Account.Secret,
+		&http.Client{Transport: getRestTransport(EXCHANGE_BINANCE)}}
+}
+
+func binanceSymbol(productId string) string {
+	return strings.Replace(productId, "-", "", -1)
+}
+
+// Request on path. Signed requests get a timestamp and the HMAC SHA256 signature of their parameters
+func (binance *binanceExchange) request(method string, path string, params url.Values, signed bool, result interface{}) error {
+	operation := method + " " + path
+	if params == nil {
+		params = url.Values{}
+	}
+	query := params.Encode()
+	if signed {
+		params.Set("timestamp", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+		params.Set("recvWindow", BINANCE_RECV_WINDOW)
+		query = params.Encode()
+		mac := hmac.New(sha256.New, []byte(binance.secret))
+		mac.Write([]byte(query))
+		query += "&signature=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	resource := binance.baseURL + path
+	if query != "" {
+		resource += "?" + query
+	}
+	req, err := http.NewRequest(method, resource, nil)
+	if err != nil {
+		return &APIError{operation, 0, err.Error(), false}
+	}
+	if binance.key != "" {
+		req.Header.Set("X-MBX-APIKEY", binance.key)
+	}
+
+	res, err := binance.httpClient.Do(req)
+	if err != nil {
+		return restError(operation, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return &APIError{operation, res.StatusCode, err.Error(), true}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var binanceErr binanceError
+		if json.Unmarshal(data, &binanceErr) == nil && binanceErr.Msg != "" {
+			return &APIError{operation, res.StatusCode, strconv.Itoa(binanceErr.Code) + " " + binanceErr.Msg, isTemporary(res.StatusCode)}
+		}
+		return &APIError{operation, res.StatusCode, string(data), isTemporary(res.StatusCode)}
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return &APIError{operation, res.StatusCode, "decoding: " + err.Error(), false}
+	}
+	return nil
+}
+
+// true if err is the Binance error code
+func isBinanceError(err error, code int) bool {
+	apiError, ok := err.(*APIError)
+	return ok && strings.HasPrefix(apiError.Message, strconv.Itoa(code)+" ")
+}
+
+// GET /api/v3/exchangeInfo
+func (binance *binanceExchange) GetProduct(productId string) (Product, error) {
+	var info binanceExchangeInfo
+	if err := binance.request("GET", "/api/v3/exchangeInfo", url.Values{"symbol": {binanceSymbol(productId)}}, false, &info); err != nil {
+		return Product{}, err
+	}
+	product := Product{Id: productId}
+	for _, symbol := range info.Symbols {
+		for _, filter := range symbol.Filters {
+			switch filter.FilterType {
+			case "LOT_SIZE":
+				product.BaseMinSize, _ = strconv.ParseFloat(filter.MinQty, 64)
+				product.BaseMaxSize, _ = strconv.ParseFloat(filter.MaxQty, 64)
+				product.BaseIncrement, _ = strconv.ParseFloat(filter.StepSize, 64)
+			case "PRICE_FILTER":
+				product.QuoteIncrement, _ = strconv.ParseFloat(filter.TickSize, 64)
+			}
+		}
+	}
+	return product, nil
+}
+
+// GET /api/v3/account
+func (binance *binanceExchange) GetAccounts() ([]api.Account, error) {
+	var account binanceAccount
+	if err := binance.request("GET", "/api/v3/account", nil, true, &account); err != nil {
+		return nil, err
+	}
+	var accounts []api.Account
+	for _, b := range account.Balances {
+		accounts = append(accounts, api.Account{Id: b.Asset, Balance: b.Free + b.Locked, Hold: b.Locked, Available: b.Free, Currency: b.Asset})
+	}
+	return accounts, nil
+}
+
+// GET /api/v3/myTrades, the last 1000 trades
+func (binance *binanceExchange) ListFills(productId string) ([]Fill, error) {
+	trades, err := binance.myTrades(productId, nil)
+	if err != nil {
+		return nil, err
+	}
+	var fills []Fill
+	for _, trade := range trades {
+		side := "sell"
+		if trade.IsBuyer {
+			side = "buy"
+		}
+		fills = append(fills, Fill{time.Unix(0, trade.Time*int64(time.Millisecond)), side, trade.Price, trade.Qty, binanceFee(productId, trade)})
+	}
+	return fills, nil
+}
+
+func (binance *binanceExchange) myTrades(productId string, params url.Values) ([]binanceTrade, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("symbol", binanceSymbol(productId))
+	params.Set("limit", "1000")
+	var trades []binanceTrade
+	if err := binance.request("GET", "/api/v3/myTrades", params, true, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
+
+// Fee in the currency of productId. Fees paid in another asset (BNB) are not converted
+func binanceFee(productId string, trade binanceTrade) float64 {
+	currencies := strings.Split(productId, "-")
+	switch trade.CommissionAsset {
+	case currencies[1]:
+		return trade.Commission
+	case currencies[0]:
+		return trade.Commission * trade.Price
+	}
+	return 0
+}
+
+// GET /api/v3/openOrders or GET /api/v3/allOrders
+func (binance *binanceExchange) ListOrders(productId string, status string) ([]api.Order, error) {
+	path := "/api/v3/allOrders"
+	if status == "open" {
+		path = "/api/v3/openOrders"
+	}
+	var page []binanceOrder
+	if err := binance.request("GET", path, url.Values{"symbol": {binanceSymbol(productId)}}, true, &page); err != nil {
+		return nil, err
+	}
+	var orders []api.Order
+	for _, o := range page {
+		order := o.order(productId)
+		if status == "" || order.Status == status {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// GET /api/v3/order?origClientOrderId=<client_oid>, the fees come from the trades of the order
+func (binance *binanceExchange) GetOrderByClientOid(productId string, clientOid string, since time.Time) (*api.Order, error) {
+	var o binanceOrder
+	err := binance.request("GET", "/api/v3/order", url.Values{"symbol": {binanceSymbol(productId)}, "origClientOrderId": {clientOid}}, true, &o)
+	if isBinanceError(err, BINANCE_ORDER_NOT_FOUND) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	order := o.order(productId)
+	if order.FilledSize > 0 {
+		trades, err := binance.myTrades(productId, url.Values{"orderId": {strconv.FormatInt(o.OrderId, 10)}})
+		if err != nil {
+			return nil, err
+		}
+		for _, trade := range trades {
+			order.FillFees += binanceFee(productId, trade)
+		}
+	}
+	return &order, nil
+}
+
+// POST /api/v3/order
+func (binance *binanceExchange) CreateOrder(order *api.Order) (api.Order, error) {
+	params := url.Values{"symbol": {binanceSymbol(order.ProductId)}, "side": {strings.ToUpper(order.Side)}, "newClientOrderId": {order.ClientOID},
+		"newOrderRespType": {"RESULT"}}
+	switch order.Type {
+	case "market":
+		params.Set("type", "MARKET")
+		if order.Funds > 0 {
+			params.Set("quoteOrderQty", formatFloat(order.Funds))
+		} else {
+			params.Set("quantity", formatFloat(order.Size))
+		}
+	default:
+		params.Set("type", "LIMIT")
+		if order.PostOnly {
+			params.Set("type", "LIMIT_MAKER")
+		} else {
+			params.Set("timeInForce", "GTC")
+		}
+		params.Set("quantity", formatFloat(order.Size))
+		params.Set("price", formatFloat(order.Price))
+	}
+	var o binanceOrder
+	if err := binance.request("POST", "/api/v3/order", params, true, &o); err != nil {
+		return api.Order{}, err
+	}
+	return o.order(order.ProductId), nil
+}
+
+// DELETE /api/v3/order
+func (binance *binanceExchange) CancelOrder(productId string, orderId string) error {
+	var o binanceOrder
+	return binance.request("DELETE", "/api/v3/order", url.Values{"symbol": {binanceSymbol(productId)}, "orderId": {orderId}}, true, &o)
+}
+
+// GET /api/v3/ticker/bookTicker
+func (binance *binanceExchange) GetTicker(productId string) (ask float64, bid float64, err error) {
+	var ticker binanceBookTicker
+	if err := binance.request("GET", "/api/v3/ticker/bookTicker", url.Values{"symbol": {binanceSymbol(productId)}}, false, &ticker); err != nil {
+		return 0, 0, err
+	}
+	return ticker.AskPrice, ticker.BidPrice, nil
+}
+
+func (binance *binanceExchange) Feed() Feed {
+	return &binanceFeed{GetConfigInstance().WssURL, binance, nil}
+}
+
+// GDAX order with the GDAX statuses
+func (o binanceOrder) order(productId string) api.Order {
+	created := o.Time
+	if created == 0 {
+		created = o.TransactTime
+	}
+	order := api.Order{Id: strconv.FormatInt(o.OrderId, 10), ProductId: productId, ClientOID: o.ClientOrderId, Side: strings.ToLower(o.Side),
+		Type: strings.ToLower(o.Type), Size: o.OrigQty, Price: o.Price, FilledSize: o.ExecutedQty, ExecutedValue: o.CummulativeQuoteQty,
+		CreatedAt: api.Time(time.Unix(0, created*int64(time.Millisecond)))}
+	if order.Type == "limit_maker" {
+		order.Type = "limit"
+		order.PostOnly = true
+	}
+	switch o.Status {
+	case "NEW", "PARTIALLY_FILLED", "PENDING_CANCEL":
+		order.Status = "open"
+	case "REJECTED":
+		order.Status = "rejected"
+	default: // FILLED, CANCELED, EXPIRED
+		order.Status = "done"
+		order.Settled = true
+	}
+	return order
+}
+
+// Trade streams <symbol>@trade, subscribed on the raw stream endpoint (wss://stream.binance.com:9443/ws)
+type binanceFeed struct {
+	url        string
+	exchange   *binanceExchange  // Backfill, disabled without base URL
+	productIds map[string]string // Symbol -> product id
+}
+
+type binanceHistoricalTrade struct {
+	Id           int     `json:"id"`
+	Price        float64 `json:"price,string"`
+	Qty          float64 `json:"qty,string"`
+	Time         int64   `json:"time"`
+	IsBuyerMaker bool    `json:"isBuyerMaker"`
+}
+
+type binanceSubscribe struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	Id     int      `json:"id"`
+}
+
+// Trade event, or the answer to a request when Id is set
+type binanceStreamMessage struct {
+	Event        string          `json:"e"`
+	EventTime    int64           `json:"E"`
+	Symbol       string          `json:"s"`
+	TradeId      int             `json:"t"`
+	Price        float64         `json:"p,string"`
+	Quantity     float64         `json:"q,string"`
+	TradeTime    int64           `json:"T"`
+	BuyerIsMaker bool            `json:"m"`
+	Id           *int            `json:"id"`
+	Result       json.RawMessage `json:"result"`
+	Error        *binanceError   `json:"error"`
+}
+
+func (feed *binanceFeed) URL() string {
+	return feed.url
+}
+
+func (feed *binanceFeed) Subscribe(conn *ws.Conn, productId string) error {
+	symbol := binanceSymbol(productId)
+	if feed.productIds == nil {
+		feed.productIds = map[string]string{}
+	}
+	feed.productIds[symbol] = productId
+	return conn.WriteJSON(binanceSubscribe{"SUBSCRIBE", []string{strings.ToLower(symbol) + "@trade"}, 1})
+}
+
+func (feed *binanceFeed) Decode(data []byte) ([]FeedMessage, error) {
+	var message binanceStreamMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	if message.Error != nil {
+		return []FeedMessage{{Message: api.Message{Type: "error", Message: message.Error.Msg}}}, nil
+	}
+	if message.Id != nil {
+		return []FeedMessage{{Message: api.Message{Type: "subscriptions"}}}, nil
+	}
+	if message.Event != "trade" {
+		return nil, nil
+	}
+	productId, ok := feed.productIds[message.Symbol]
+	if !ok {
+		productId = message.Symbol
+	}
+	return []FeedMessage{{Message: binanceMatch(productId, message.TradeId, message.Price, message.Quantity, message.TradeTime, message.BuyerIsMaker)}}, nil
+}
+
+// GET /api/v3/historicalTrades, oldest first from fromId
+func (feed *binanceFeed) Backfill(productId string, lastTradeId int) ([]api.Message, error) {
+	if feed.exchange.baseURL == "" {
+		return nil, nil
+	}
+	var messages []api.Message
+	for len(messages) < BACKFILL_MAX_TRADES {
+		var trades []binanceHistoricalTrade
+		params := url.Values{"symbol": {binanceSymbol(productId)}, "fromId": {strconv.Itoa(lastTradeId + 1)}, "limit": {"1000"}}
+		if err := feed.exchange.request("GET", "/api/v3/historicalTrades", params, false, &trades); err != nil {
+			return nil, err
+		}
+		for _, trade := range trades {
+			if trade.Id > lastTradeId {
+				messages = append(messages, binanceMatch(productId, trade.Id, trade.Price, trade.Qty, trade.Time, trade.IsBuyerMaker))
+				lastTradeId = trade.Id
+			}
+		}
+		if len(trades) < 1000 {
+			break
+		}
+	}
+	return messages, nil
+}
+
+// The side of the GDAX matches is the side of the maker
+func binanceMatch(productId string, tradeId int, price float64, size float64, tradeTime int64, buyerIsMaker bool) api.Message {
+	side := "sell"
+	if buyerIsMaker {
+		side = "buy"
+	}
+	return api.Message{Type: "match", ProductId: productId, TradeId: tradeId, Price: price, Size: size, Side: side,
+		Time: api.Time(time.Unix(0, tradeTime*int64(time.Millisecond)))}
+}
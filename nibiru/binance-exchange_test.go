@@ -0,0 +1,149 @@
+package nibiru
+
+import (
+	"algo-trading/fakes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+// Adapter on the stub replaying the answers recorded on BTCEUR
+func newBinanceStub(t *testing.T) (*binanceExchange, *fakes.BinanceStub, *httptest.Server) {
+	t.Helper()
+	stub := fakes.NewBinanceStub("key", "secret")
+	httpServer := httptest.NewServer(stub)
+	return &binanceExchange{httpServer.URL, "key", "secret", httpServer.Client()}, stub, httpServer
+}
+
+func TestBinanceProductAndTicker(t *testing.T) {
+	binance, _, httpServer := newBinanceStub(t)
+	defer httpServer.Close()
+	product, err := binance.GetProduct("BTC-EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product != (Product{"BTC-EUR", 0.00001, 9000, 0.00001, 0.01}) {
+		t.Errorf("GetProduct = %+v", product)
+	}
+	ask, bid, err := binance.GetTicker("BTC-EUR")
+	if err != nil || ask != 20000.01 || bid != 19999.99 {
+		t.Errorf("GetTicker = %f, %f, %v, want 20000.01, 19999.99", ask, bid, err)
+	}
+}
+
+func TestBinanceSignature(t *testing.T) {
+	binance, _, httpServer := newBinanceStub(t)
+	defer httpServer.Close()
+	binance.secret = "other"
+	_, err := binance.GetAccounts()
+	if !isBinanceError(err, -1022) {
+		t.Errorf("GetAccounts signed with another secret: %v, want the error -1022", err)
+	}
+	binance.key = "other"
+	_, err = binance.GetAccounts()
+	if apiError, ok := err.(*APIError); !ok || apiError.StatusCode != 401 || !isBinanceError(err, -2015) {
+		t.Errorf("GetAccounts with another key: %v, want a 401 -2015", err)
+	}
+}
+
+func TestBinanceAccountsAndFills(t *testing.T) {
+	binance, _, httpServer := newBinanceStub(t)
+	defer httpServer.Close()
+	accounts, err := binance.GetAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[1] != (api.Account{Id: "EUR", Balance: 4823.846, Hold: 100, Available: 4723.846, Currency: "EUR"}) {
+		t.Errorf("GetAccounts = %+v", accounts)
+	}
+	fills, err := binance.ListFills("BTC-EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fills) != 1 || fills[0] != (Fill{time.Unix(0, 1565246363776*int64(time.Millisecond)), "buy", 20000, 0.01, 0.2}) {
+		t.Errorf("ListFills = %+v", fills)
+	}
+}
+
+func TestBinanceOrders(t *testing.T) {
+	binance, _, httpServer := newBinanceStub(t)
+	defer httpServer.Close()
+	order, err := binance.CreateOrder(&api.Order{Type: "market", Side: "buy", Size: 0.01, ProductId: "BTC-EUR", ClientOID: "3f1c8a7e-5b2d-4d3e-9a6f-0c1b2d3e4f51"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Id != "100236" || order.Type != "market" || order.Status != "done" || order.FilledSize != 0.01 || order.ExecutedValue != 200 {
+		t.Errorf("CreateOrder = %+v", order)
+	}
+
+	found, err := binance.GetOrderByClientOid("BTC-EUR", "3f1c8a7e-5b2d-4d3e-9a6f-0c1b2d3e4f50", time.Now())
+	if err != nil || found == nil {
+		t.Fatalf("GetOrderByClientOid = %v, %v", found, err)
+	}
+	if found.Id != "100234" || found.Status != "done" || found.FillFees != 0.2 {
+		t.Errorf("GetOrderByClientOid = %+v, want order 100234 done, fees 0.2", *found)
+	}
+
+	open, err := binance.ListOrders("BTC-EUR", "open")
+	if err != nil || len(open) != 1 || open[0].Id != "100235" || open[0].Type != "limit" || open[0].Price != 10000 || open[0].Status != "open" {
+		t.Errorf("ListOrders open = %+v, %v", open, err)
+	}
+	done, err := binance.ListOrders("BTC-EUR", "done")
+	if err != nil || len(done) != 1 || done[0].Id != "100234" {
+		t.Errorf("ListOrders done = %+v, %v", done, err)
+	}
+	if err := binance.CancelOrder("BTC-EUR", "100235"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBinanceFeed(t *testing.T) {
+	binance, stub, httpServer := newBinanceStub(t)
+	defer httpServer.Close()
+	stub.StreamPeriod = time.Millisecond
+	feed := &binanceFeed{"ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws", binance, nil}
+
+	matches, err := feed.Backfill("BTC-EUR", 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].TradeId != 12346 || matches[0].Side != "sell" || matches[1].TradeId != 12347 || matches[1].Side != "buy" {
+		t.Errorf("Backfill after trade 12345 = %+v", matches)
+	}
+
+	conn, _, err := ws.DefaultDialer.Dial(feed.URL(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := feed.Subscribe(conn, "BTC-EUR"); err != nil {
+		t.Fatal(err)
+	}
+	var received []api.Message
+	for len(received) < 4 {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := feed.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range messages {
+			received = append(received, message.Message)
+		}
+	}
+	if received[0].Type != "subscriptions" {
+		t.Errorf("Answer to the subscription = %+v", received[0])
+	}
+	for i, match := range received[1:] {
+		if match.Type != "match" || match.ProductId != "BTC-EUR" || match.TradeId != 12345+i {
+			t.Errorf("Stream[%d] = %+v, want the match %d of BTC-EUR", i, match, 12345+i)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package nibiru
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages waiting to be sent to the broker, the next ones are dropped
+const BROKER_QUEUE_SIZE int = 10000
+
+// Signal validated by the algo, published on <subject>.signals.<product>
+type SignalMessage struct {
+	Time      time.Time `json:"time"`
+	ProductId string    `json:"product_id"`
+	Side      string    `json:"side"`
+	Strength  float64   `json:"strength"` // Above 1
+	Price     float64   `json:"price"`
+}
+
+// Publishes in JSON on a NATS broker the trades (<subject>.trades.<venue>.<product>), the tickers, connection and status events of
+// the feeds (<subject>.ticker|connection|status.<venue>.<product>), the signals of the algo and the fills (<subject>.fills.<product>,
+// the filled JournalEntry), for the consumers outside the bot and the traders with "trade": {"source": "broker"}.
+// Publishing never blocks: the messages are queued, and dropped while the broker is unreachable and the queue full
+type BrokerPublisher struct {
+	mutex   sync.RWMutex // Write locked to close, read locked to publish
+	url     string
+	subject string
+	queue   chan brokerMessage
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool
+	dropped int64
+}
+
+type brokerMessage struct {
+	subject string
+	payload []byte
+}
+
+var instanceBrokerPublisher *BrokerPublisher
+var onceBrokerPublisher sync.Once
+
+// nil if Broker.URL isn't set, its methods do nothing then
+func GetBrokerPublisherInstance() *BrokerPublisher {
+	onceBrokerPublisher.Do(func() {
+		config := GetConfigInstance().Broker
+		if config.URL == "" {
+			return
+		}
+		instanceBrokerPublisher = NewBrokerPublisher(config.URL, brokerSubject())
+	})
+	return instanceBrokerPublisher
+}
+
+// Prefix of the subjects, Broker.Subject or nibiru
+func brokerSubject() string {
+	if subject := GetConfigInstance().Broker.Subject; subject != "" {
+		return subject
+	}
+	return "nibiru"
+}
+
+// Connects to the broker at url in the background
+func NewBrokerPublisher(url string, subject string) *BrokerPublisher {
+	publisher := &BrokerPublisher{url: url, subject: subject, queue: make(chan brokerMessage, BROKER_QUEUE_SIZE),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	go publisher.run()
+	return publisher
+}
+
+// Trades, tickers, connection and status events of the market bus, for the tools and the traders fed by the broker
+func (publisher *BrokerPublisher) OnMarketEvent(event MarketEvent) {
+	switch event := event.(type) {
+	case *TradeEvent:
+		publisher.Publish(publisher.subject+".trades."+event.Venue+"."+event.ProductId, event)
+	case *TickerEvent:
+		publisher.Publish(publisher.subject+".ticker."+event.Venue+"."+event.ProductId, event)
+	case *ConnectionEvent:
+		publisher.Publish(publisher.subject+".connection."+event.Venue+"."+event.ProductId, event)
+	case *StatusEvent:
+		publisher.Publish(publisher.subject+".status."+event.Venue+"."+event.ProductId, event)
+	}
+}
+
+func (publisher *BrokerPublisher) PublishSignal(signal SignalMessage) {
+	if publisher == nil {
+		return
+	}
+	publisher.Publish(publisher.subject+".signals."+signal.ProductId, signal)
+}
+
+func (publisher *BrokerPublisher) PublishFill(entry JournalEntry) {
+	if publisher == nil {
+		return
+	}
+	publisher.Publish(publisher.subject+".fills."+entry.ProductId, entry)
+}
+
+// Queue message, encoded in JSON, to be published on subject
+func (publisher *BrokerPublisher) Publish(subject string, message interface{}) {
+	if publisher == nil {
+		return
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		GetLoggerInstance().Error("In broker-publisher/Publish. Encoding on %s: %s", subject, err.Error())
+		return
+	}
+	publisher.mutex.RLock()
+	defer publisher.mutex.RUnlock()
+	if publisher.closed {
+		return
+	}
+	select {
+	case publisher.queue <- brokerMessage{subject, payload}:
+	default:
+		if dropped := atomic.AddInt64(&publisher.dropped, 1); dropped%1000 == 1 {
+			GetLoggerInstance().Error("BrokerPublisher - Queue full, %d messages dropped", dropped)
+		}
+	}
+}
+
+// Send the messages queued, unless the broker is unreachable, and disconnect
+func (publisher *BrokerPublisher) Close() {
+	if publisher == nil {
+		return
+	}
+	publisher.mutex.Lock()
+	if publisher.closed {
+		publisher.mutex.Unlock()
+		return
+	}
+	publisher.closed = true
+	close(publisher.queue)
+	close(publisher.stop)
+	publisher.mutex.Unlock()
+	<-publisher.done
+	GetLoggerInstance().Info("BrokerPublisher - Closed, %d messages dropped", atomic.LoadInt64(&publisher.dropped))
+}
+
+func (publisher *BrokerPublisher) run() {
+	defer close(publisher.done)
+	var conn *natsConn
+	for message := range publisher.queue {
+		if conn == nil {
+			if conn = publisher.connect(); conn == nil { // Closed while the broker is unreachable
+				atomic.AddInt64(&publisher.dropped, int64(len(publisher.queue)+1))
+				for range publisher.queue {
+				}
+				return
+			}
+		}
+		err := conn.publish(message.subject, message.payload)
+		if err == nil && len(publisher.queue) == 0 {
+			err = conn.flush()
+		}
+		if err != nil {
+			GetLoggerInstance().Error("In broker-publisher/run. Connection to %s lost, messages not flushed are lost: %s", redactNatsURL(publisher.url), err.Error())
+			conn.close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.close()
+	}
+}
+
+// Connect with a jittered exponential backoff until it succeeds, nil if the publisher is closed before
+func (publisher *BrokerPublisher) connect() *natsConn {
+	for failures := 0; ; failures++ {
+		if failures > 0 {
+			timer := time.NewTimer(backoff(time.Second, 30*time.Second, failures))
+			select {
+			case <-publisher.stop:
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+		}
+		conn, err := dialNats(publisher.url, "nibiru-publisher")
+		if err != nil {
+			GetLoggerInstance().Error("In broker-publisher/connect: %s", err.Error())
+			continue
+		}
+		GetLoggerInstance().Info("BrokerPublisher - Connected to %s", redactNatsURL(publisher.url))
+		go func() { // Answer the PINGs of the server and PING it, the connection is closed on error
+			for {
+				if _, _, err := conn.next(); err != nil {
+					conn.close()
+					return
+				}
+			}
+		}()
+		return conn
+	}
+}
@@ -0,0 +1,194 @@
+package nibiru
+
+import (
+	"algo-trading/fakes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Next event of events other than a ticker, the tickers sent until the subscriptions are in place are skipped
+func nextEvent(t *testing.T, events chan MarketEvent) MarketEvent {
+	t.Helper()
+	for {
+		select {
+		case event := <-events:
+			if _, ok := event.(*TickerEvent); !ok {
+				return event
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event received")
+		}
+	}
+}
+
+// Publish tickers until one reaches events, once the source and the publisher are connected
+func waitTicker(t *testing.T, publisher *BrokerPublisher, events chan MarketEvent) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		publisher.OnMarketEvent(&TickerEvent{"gdax", "BTC-EUR", time.Now().UTC().Round(0), 20000, 19999, 20001})
+		select {
+		case event := <-events:
+			if _, ok := event.(*TickerEvent); ok {
+				return
+			}
+			t.Fatalf("Event %+v received instead of a ticker", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("No ticker received")
+}
+
+// Events of the ingester published on the broker and read by the broker source of a trader
+func TestBrokerRoundTrip(t *testing.T) {
+	server, err := fakes.NewNatsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	published := make(chan string, 100)
+	server.OnPublish = func(subject string, payload []byte) {
+		if !strings.HasPrefix(subject, "nibiru.ticker.") {
+			published <- subject
+		}
+	}
+	publisher := NewBrokerPublisher(server.URL(), "nibiru")
+	defer publisher.Close()
+
+	bus := NewMarketBus()
+	events := make(chan MarketEvent, 100)
+	bus.Subscribe("test", 100, POLICY_BLOCK, func(event MarketEvent) { events <- event })
+	source := &brokerSource{server.URL(), "nibiru", bus, "BTC-EUR", nil}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- source.Run(ctx) }()
+
+	if up, ok := nextEvent(t, events).(*ConnectionEvent); !ok || up.State != CONNECTION_UP || up.Venue != "gdax" {
+		t.Fatalf("First event %+v, want the source up", up)
+	}
+	waitTicker(t, publisher, events)
+	now := time.Now().UTC().Round(0)
+	sent := []MarketEvent{&TradeEvent{"gdax", "BTC-EUR", 7, now, 20000, 0.5, "buy", false},
+		&StatusEvent{"gdax", "BTC-EUR", now, "online", "", false, true, false, false},
+		&ConnectionEvent{"gdax", "BTC-EUR", "wss://ws-feed", now, CONNECTION_STALE, "no heartbeat"},
+		&TradeEvent{"binance", "BTC-EUR", 8, now, 20010, 0.1, "sell", false}, // Not subscribed
+		&TradeEvent{"gdax", "ETH-EUR", 9, now, 1500, 1, "sell", false}}       // Not subscribed
+	for _, event := range sent {
+		publisher.OnMarketEvent(event)
+	}
+	for _, want := range sent[:3] {
+		if got := nextEvent(t, events); !reflect.DeepEqual(got, want) {
+			t.Errorf("Event %+v, want %+v", got, want)
+		}
+	}
+
+	// The source reconnects and restores the last state of the feed, the publisher reconnects on its next message
+	server.DropConnections()
+	if down, ok := nextEvent(t, events).(*ConnectionEvent); !ok || down.State != CONNECTION_DOWN {
+		t.Fatalf("Event %+v after the drop, want the source down", down)
+	}
+	if restored, ok := nextEvent(t, events).(*ConnectionEvent); !ok || restored.State != CONNECTION_STALE || restored.Err != "no heartbeat" {
+		t.Fatalf("Event %+v after the reconnection, want the last state received", restored)
+	}
+	waitTicker(t, publisher, events)
+
+	publisher.PublishSignal(SignalMessage{now, "BTC-EUR", "buy", 1.5, 20000})
+	publisher.PublishFill(JournalEntry{Time: now, ProductId: "BTC-EUR", Side: "buy"})
+	for _, want := range []string{"nibiru.signals.BTC-EUR", "nibiru.fills.BTC-EUR"} {
+		for subject := ""; subject != want; {
+			select {
+			case subject = <-published:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s not published", want)
+			}
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The source didn't stop")
+	}
+	if stopped, ok := nextEvent(t, events).(*ConnectionEvent); !ok || stopped.State != CONNECTION_STOPPED {
+		t.Errorf("Event %+v after the cancel, want the source stopped", stopped)
+	}
+	bus.Close()
+}
+
+// The credentials of the URL are required by the server and never published
+func TestBrokerAuth(t *testing.T) {
+	server, err := fakes.NewNatsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuth("nibiru", "secret")
+	host := strings.TrimPrefix(server.URL(), "nats://")
+	tests := []struct {
+		url string
+		err string // Part of the error, empty if connected
+	}{
+		{server.URL(), "requires an authentication"},
+		{"nats://nibiru:wrong@" + host, "Authorization Violation"},
+		{"nats://nibiru:secret@" + host, ""},
+		{"nibiru:secret@" + host, ""},
+	}
+	for _, test := range tests {
+		conn, err := dialNats(test.url, "test")
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("dialNats(%s) = %v, want %q", test.url, err, test.err)
+		}
+		if conn != nil {
+			conn.close()
+		}
+	}
+	if redacted := redactNatsURL("nibiru:secret@" + host); strings.Contains(redacted, "secret") || !strings.Contains(redacted, host) {
+		t.Errorf("redactNatsURL = %s, want the host without the password", redacted)
+	}
+}
+
+// A broker which stops answering is detected by the client PINGs, the source goes down then reconnects
+func TestBrokerStalled(t *testing.T) {
+	server, err := fakes.NewNatsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	GetConfigInstance().Broker.PingSeconds = 1
+	defer func() { GetConfigInstance().Broker.PingSeconds = 0 }()
+
+	bus := NewMarketBus()
+	defer bus.Close()
+	events := make(chan MarketEvent, 100)
+	bus.Subscribe("test", 100, POLICY_BLOCK, func(event MarketEvent) { events <- event })
+	source := &brokerSource{server.URL(), "nibiru", bus, "BTC-EUR", nil}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx)
+
+	if up, ok := nextEvent(t, events).(*ConnectionEvent); !ok || up.State != CONNECTION_UP {
+		t.Fatalf("First event %+v, want the source up", up)
+	}
+	server.Stall(true)
+	stalled := time.Now()
+	down, ok := nextEvent(t, events).(*ConnectionEvent)
+	if !ok || down.State != CONNECTION_DOWN || !strings.Contains(down.Err, "no answer of the NATS server") {
+		t.Fatalf("Event %+v while stalled, want the source down", down)
+	}
+	if elapsed := time.Since(stalled); elapsed > 3*time.Second {
+		t.Errorf("Down after %s, want 2s", elapsed)
+	}
+	server.Stall(false)
+	for {
+		if up, ok := nextEvent(t, events).(*ConnectionEvent); ok && up.State == CONNECTION_UP {
+			break
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package nibiru
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay after the end of a candle before closing it when no trade of the next period was received,
+// matches can be received a little after their time
+const candleCloseDelay = time.Duration(2) * time.Second
+
+// OHLCV bar, Time is the start of the candle
+// Buy and sell volumes are computed from the side of the matches, which is the maker side
+type Candle struct {
+	Time       time.Time
+	ProductId  string
+	Interval   string // ex: 1m, 5m, 1h
+	Open       float64
+	High       float64
+	Low        float64
+	Close      float64
+	Volume     float64
+	BuyVolume  float64
+	SellVolume float64
+	TradeCount int // 0 for a flat candle filling a period without trade
+}
+
+func newCandle(start time.Time, productId string, interval string, price float64) *Candle {
+	return &Candle{Time: start, ProductId: productId, Interval: interval, Open: price, High: price, Low: price, Close: price}
+}
+
+func (candle *Candle) add(price float64, size float64, side string) {
+	if candle.TradeCount == 0 { // Until its first trade, a candle is flat at the previous close
+		candle.Open = price
+		candle.High = price
+		candle.Low = price
+	}
+	if price > candle.High {
+		candle.High = price
+	}
+	if price < candle.Low {
+		candle.Low = price
+	}
+	candle.Close = price
+	candle.Volume += size
+	if side == "buy" {
+		candle.BuyVolume += size
+	} else if side == "sell" {
+		candle.SellVolume += size
+	}
+	candle.TradeCount++
+}
+
+func (candle *Candle) id() string {
+	return strings.ToLower(candle.ProductId) + "-" + candle.Interval + "-" + strconv.FormatInt(candle.Time.Unix(), 10)
+}
+
+func (candle *Candle) document() BarDocument {
+	return BarDocument{ES_SCHEMA_VERSION, esTime(candle.Time), candle.ProductId, candle.Interval, candle.Open, candle.High, candle.Low,
+		candle.Close, candle.Volume, candle.BuyVolume, candle.SellVolume, candle.TradeCount}
+}
+
+// Build candles from the matches, at each configured interval, for each product
+type CandleBuilder struct {
+	mutex         sync.Mutex
+	intervals     map[string]time.Duration
+	current       map[string]*Candle // by product and interval, see candleKey
+	subscribers   []func(candle Candle)
+	elasticClient *ElasticClient
+	loop          *tickerLoop
+}
+
+var instanceCandleBuilder *CandleBuilder
+var onceCandleBuilder sync.Once
+
+func GetCandleBuilderInstance() *CandleBuilder {
+	onceCandleBuilder.Do(func() {
+		instanceCandleBuilder = &CandleBuilder{intervals: map[string]time.Duration{}, current: map[string]*Candle{},
+			elasticClient: NewElasticClient()}
+		for _, interval := range GetConfigInstance().Candles.Intervals {
+			duration, err := time.ParseDuration(interval)
+			if err != nil || duration <= 0 {
+				GetLoggerInstance().Error("In candles/GetCandleBuilderInstance. Incorrect interval: %s", interval)
+				continue
+			}
+			instanceCandleBuilder.intervals[interval] = duration
+		}
+	})
+	return instanceCandleBuilder
+}
+
+func candleKey(productId string, interval string) string {
+	return productId + "/" + interval
+}
+
+// Handler is called with every closed candle, from the goroutine which closed it
+func (builder *CandleBuilder) Subscribe(handler func(candle Candle)) {
+	builder.mutex.Lock()
+	defer builder.mutex.Unlock()
+	builder.subscribers = append(builder.subscribers, handler)
+}
+
+// Close the candles of the periods without trade
+func (builder *CandleBuilder) Run() {
+	GetLoggerInstance().Info("Run CandleBuilder ticker")
+	builder.loop = startTickerLoop(time.Second, func(now time.Time) {
+		builder.mutex.Lock()
+		var closed []Candle
+		for key := range builder.current {
+			closed = append(closed, builder.roll(key, now.Add(-candleCloseDelay))...)
+		}
+		builder.mutex.Unlock()
+		builder.publish(closed)
+	})
+}
+
+func (builder *CandleBuilder) Stop() {
+	builder.loop.Stop()
+}
+
+// Trades of the main exchange, backfilled ones included: the candles already closed ignore them
+func (builder *CandleBuilder) OnMarketEvent(event MarketEvent) {
+	if trade, ok := event.(*TradeEvent); ok && trade.Venue == mainVenue() {
+		builder.AddTrade(trade.Time, trade.ProductId, trade.Price, trade.Size, trade.Side)
+	}
+}
+
+func (builder *CandleBuilder) AddTrade(t time.Time, productId string, price float64, size float64, side string) {
+	builder.mutex.Lock()
+	var closed []Candle
+	for interval, duration := range builder.intervals {
+		key := candleKey(productId, interval)
+		candle, ok := builder.current[key]
+		if !ok {
+			candle = newCandle(t.Truncate(duration), productId, interval, price)
+			builder.current[key] = candle
+		}
+		closed = append(closed, builder.roll(key, t)...)
+		candle = builder.current[key]
+		if t.Before(candle.Time) {
+			GetLoggerInstance().Info("CandleBuilder - Late match ignored for the %s candle of %s: %s", interval, productId, t.Format(time.RFC3339))
+			continue
+		}
+		candle.add(price, size, side)
+	}
+	builder.mutex.Unlock()
+	builder.publish(closed)
+}
+
+// Close the candles of key which end before t, replaced by flat candles until the one containing t. Must be called locked
+func (builder *CandleBuilder) roll(key string, t time.Time) []Candle {
+	var closed []Candle
+	candle := builder.current[key]
+	duration := builder.intervals[candle.Interval]
+	for !t.Before(candle.Time.Add(duration)) {
+		closed = append(closed, *candle)
+		candle = newCandle(candle.Time.Add(duration), candle.ProductId, candle.Interval, candle.Close)
+	}
+	builder.current[key] = candle
+	return closed
+}
+
+func (builder *CandleBuilder) publish(closed []Candle) {
+	if len(closed) == 0 {
+		return
+	}
+	builder.mutex.Lock()
+	subscribers := builder.subscribers
+	builder.mutex.Unlock()
+	for _, candle := range closed {
+		if builder.elasticClient.esCandleIndex != "" {
+			builder.elasticClient.IndexCandle(candle)
+		}
+		for _, handler := range subscribers {
+			handler(candle)
+		}
+	}
+}
@@ -0,0 +1,699 @@
+package nibiru
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+const (
+	COINBASE_API_PATH     string  = "/api/v3/brokerage"
+	COINBASE_JWT_TTL      int64   = 120  // In seconds
+	COINBASE_MAX_TRADES   int     = 1000 // Limit of the market trades endpoint
+	COINBASE_PUBLIC_RATE  float64 = 10   // Requests per second by IP
+	COINBASE_PRIVATE_RATE float64 = 30   // Requests per second by user
+)
+
+// Public market data endpoints, limited by IP
+func isCoinbasePublic(path string) bool {
+	return strings.HasPrefix(path, COINBASE_API_PATH+"/market/") || path == COINBASE_API_PATH+"/time"
+}
+
+// Coinbase Advanced Trade API. Account.Key is the key name (organizations/<org>/apiKeys/<key>),
+// Account.Secret its EC private key in PEM
+type coinbaseExchange struct {
+	baseURL    string
+	host       string // Part of the uri claim of the JWT
+	keyName    string
+	privateKey *ecdsa.PrivateKey
+	httpClient *http.Client
+}
+
+type jwtHeader struct {
+	Alg   string `json:"alg"`
+	Typ   string `json:"typ"`
+	Kid   string `json:"kid"`
+	Nonce string `json:"nonce"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Iss string `json:"iss"`
+	Nbf int64  `json:"nbf"`
+	Exp int64  `json:"exp"`
+	Uri string `json:"uri,omitempty"` // "GET api.coinbase.com/api/v3/brokerage/accounts", empty for the websocket
+}
+
+type coinbaseAmount struct {
+	Value    float64 `json:"value,string"`
+	Currency string  `json:"currency"`
+}
+
+type coinbaseAccount struct {
+	Uuid             string         `json:"uuid"`
+	Currency         string         `json:"currency"`
+	AvailableBalance coinbaseAmount `json:"available_balance"`
+	Hold             coinbaseAmount `json:"hold"`
+}
+
+type coinbaseAccounts struct {
+	Accounts []coinbaseAccount `json:"accounts"`
+	HasNext  bool              `json:"has_next"`
+	Cursor   string            `json:"cursor"`
+}
+
+type coinbaseProduct struct {
+	ProductId      string  `json:"product_id"`
+	BaseMinSize    float64 `json:"base_min_size,string"`
+	BaseMaxSize    float64 `json:"base_max_size,string"`
+	BaseIncrement  float64 `json:"base_increment,string"`
+	QuoteIncrement float64 `json:"quote_increment,string"`
+}
+
+type coinbaseFill struct {
+	TradeId     string    `json:"trade_id"`
+	OrderId     string    `json:"order_id"`
+	TradeTime   time.Time `json:"trade_time"`
+	Price       float64   `json:"price,string"`
+	Size        float64   `json:"size,string"`
+	Commission  float64   `json:"commission,string"`
+	ProductId   string    `json:"product_id"`
+	Side        string    `json:"side"` // BUY, SELL
+	SizeInQuote bool      `json:"size_in_quote"`
+}
+
+type coinbaseFills struct {
+	Fills  []coinbaseFill `json:"fills"`
+	Cursor string         `json:"cursor"`
+}
+
+type coinbaseMarket struct {
+	BaseSize  string `json:"base_size,omitempty"`
+	QuoteSize string `json:"quote_size,omitempty"`
+}
+
+type coinbaseLimit struct {
+	BaseSize   string `json:"base_size"`
+	LimitPrice string `json:"limit_price"`
+	PostOnly   bool   `json:"post_only"`
+}
+
+type coinbaseOrderConfiguration struct {
+	MarketMarketIoc *coinbaseMarket `json:"market_market_ioc,omitempty"`
+	LimitLimitGtc   *coinbaseLimit  `json:"limit_limit_gtc,omitempty"`
+}
+
+type coinbaseOrder struct {
+	OrderId            string                     `json:"order_id"`
+	ProductId          string                     `json:"product_id"`
+	ClientOrderId      string                     `json:"client_order_id"`
+	Side               string                     `json:"side"`
+	Status             string                     `json:"status"` // PENDING, OPEN, FILLED, CANCELLED, EXPIRED, FAILED
+	FilledSize         float64                    `json:"filled_size,string"`
+	FilledValue        float64                    `json:"filled_value,string"`
+	TotalFees          float64                    `json:"total_fees,string"`
+	CreatedTime        time.Time                  `json:"created_time"`
+	OrderConfiguration coinbaseOrderConfiguration `json:"order_configuration"`
+}
+
+type coinbaseOrders struct {
+	Orders  []coinbaseOrder `json:"orders"`
+	HasNext bool            `json:"has_next"`
+	Cursor  string          `json:"cursor"`
+}
+
+type coinbaseCreateOrder struct {
+	ClientOrderId      string                     `json:"client_order_id"`
+	ProductId          string                     `json:"product_id"`
+	Side               string                     `json:"side"`
+	OrderConfiguration coinbaseOrderConfiguration `json:"order_configuration"`
+}
+
+type coinbaseCreateOrderResponse struct {
+	Success         bool `json:"success"`
+	SuccessResponse struct {
+		OrderId string `json:"order_id"`
+	} `json:"success_response"`
+	ErrorResponse struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	} `json:"error_response"`
+}
+
+type coinbaseCancelOrders struct {
+	OrderIds []string `json:"order_ids"`
+}
+
+type coinbaseCancelOrdersResponse struct {
+	Results []struct {
+		Success       bool   `json:"success"`
+		FailureReason string `json:"failure_reason"`
+		OrderId       string `json:"order_id"`
+	} `json:"results"`
+}
+
+type coinbaseLevel struct {
+	Price float64 `json:"price,string"`
+	Size  float64 `json:"size,string"`
+}
+
+type coinbaseBestBidAsk struct {
+	Pricebooks []struct {
+		ProductId string          `json:"product_id"`
+		Bids      []coinbaseLevel `json:"bids"`
+		Asks      []coinbaseLevel `json:"asks"`
+	} `json:"pricebooks"`
+}
+
+func newCoinbaseExchange() *coinbaseExchange {
+	privateKey, err := parseECPrivateKey(GetConfigInstance().Account.Secret)
+	if err != nil {
+		GetLoggerInstance().Error("In coinbase-exchange/newCoinbaseExchange. Incorrect account secret: %s", err.Error())
+		os.Exit(1)
+	}
+	baseURL, err := url.Parse(GetConfigInstance().BaseURL)
+	if err != nil {
+		GetLoggerInstance().Error("In coinbase-exchange/newCoinbaseExchange. Incorrect baseURL: %s", err.Error())
+		os.Exit(1)
+	}
+	return &coinbaseExchange{strings.TrimRight(GetConfigInstance().BaseURL, "/"), baseURL.Host, GetConfigInstance().Account.Key, privateKey,
+		&http.Client{Transport: getRestTransport(EXCHANGE_COINBASE)}}
+}
+
+// SEC1 (EC PRIVATE KEY) or PKCS8 PEM. The new lines can be escaped, as in the key file downloaded from Coinbase
+func parseECPrivateKey(secret string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(strings.Replace(secret, `\n`, "\n", -1)))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an EC private key")
+	}
+	return ecKey, nil
+}
+
+// JWT signed with ES256, valid COINBASE_JWT_TTL seconds
+func (coinbase *coinbaseExchange) jwt(uri string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	header, _ := json.Marshal(jwtHeader{"ES256", "JWT", coinbase.keyName, hex.EncodeToString(nonce)})
+	claims, _ := json.Marshal(jwtClaims{coinbase.keyName, "cdp", now, now + COINBASE_JWT_TTL, uri})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, coinbase.privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64) // r and s on 32 bytes each
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Request on COINBASE_API_PATH + path, signed if the exchange has a private key. result is decoded from the JSON response
+func (coinbase *coinbaseExchange) request(method string, path string, query url.Values, body interface{}, result interface{}) error {
+	operation := method + " " + COINBASE_API_PATH + path
+	var reader io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return &APIError{operation, 0, err.Error(), false}
+		}
+		reader = bytes.NewReader(js)
+	}
+	resource := coinbase.baseURL + COINBASE_API_PATH + path
+	if len(query) > 0 {
+		resource += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, resource, reader)
+	if err != nil {
+		return &APIError{operation, 0, err.Error(), false}
+	}
+	if coinbase.privateKey != nil {
+		token, err := coinbase.jwt(method + " " + coinbase.host + COINBASE_API_PATH + path)
+		if err != nil {
+			return &APIError{operation, 0, "signing: " + err.Error(), false}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := coinbase.httpClient.Do(req)
+	if err != nil {
+		return restError(operation, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return &APIError{operation, res.StatusCode, err.Error(), true}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &APIError{operation, res.StatusCode, string(data), isTemporary(res.StatusCode)}
+	}
+	if result != nil {
+		if err := json.Unmarshal(data, result); err != nil {
+			return &APIError{operation, res.StatusCode, "decoding: " + err.Error(), false}
+		}
+	}
+	return nil
+}
+
+// GET /products/<product-id>
+func (coinbase *coinbaseExchange) GetProduct(productId string) (Product, error) {
+	var product coinbaseProduct
+	if err := coinbase.request("GET", "/products/"+productId, nil, nil, &product); err != nil {
+		return Product{}, err
+	}
+	return Product{product.ProductId, product.BaseMinSize, product.BaseMaxSize, product.BaseIncrement, product.QuoteIncrement}, nil
+}
+
+// GET /accounts
+func (coinbase *coinbaseExchange) GetAccounts() ([]api.Account, error) {
+	var accounts []api.Account
+	query := url.Values{"limit": {"250"}}
+	for {
+		var page coinbaseAccounts
+		if err := coinbase.request("GET", "/accounts", query, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, a := range page.Accounts {
+			accounts = append(accounts, api.Account{Id: a.Uuid, Balance: a.AvailableBalance.Value + a.Hold.Value, Hold: a.Hold.Value,
+				Available: a.AvailableBalance.Value, Currency: a.Currency})
+		}
+		if !page.HasNext {
+			return accounts, nil
+		}
+		query.Set("cursor", page.Cursor)
+	}
+}
+
+// GET /orders/historical/fills
+func (coinbase *coinbaseExchange) ListFills(productId string) ([]Fill, error) {
+	var fills []Fill
+	query := url.Values{"product_ids": {productId}, "limit": {"100"}}
+	for {
+		var page coinbaseFills
+		if err := coinbase.request("GET", "/orders/historical/fills", query, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, f := range page.Fills {
+			size := f.Size
+			if f.SizeInQuote && f.Price > 0 {
+				size = f.Size / f.Price
+			}
+			fills = append(fills, Fill{f.TradeTime, strings.ToLower(f.Side), f.Price, size, f.Commission})
+		}
+		if page.Cursor == "" || len(page.Fills) == 0 {
+			return fills, nil
+		}
+		query.Set("cursor", page.Cursor)
+	}
+}
+
+// GET /orders/historical/batch
+func (coinbase *coinbaseExchange) ListOrders(productId string, status string) ([]api.Order, error) {
+	query := url.Values{"product_ids": {productId}}
+	switch status {
+	case "open":
+		query["order_status"] = []string{"OPEN", "PENDING"}
+	case "done":
+		query["order_status"] = []string{"FILLED", "CANCELLED", "EXPIRED"}
+	}
+	return coinbase.listOrders(query)
+}
+
+func (coinbase *coinbaseExchange) listOrders(query url.Values) ([]api.Order, error) {
+	var orders []api.Order
+	for {
+		var page coinbaseOrders
+		if err := coinbase.request("GET", "/orders/historical/batch", query, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, o := range page.Orders {
+			orders = append(orders, o.order())
+		}
+		if !page.HasNext {
+			return orders, nil
+		}
+		query.Set("cursor", page.Cursor)
+	}
+}
+
+// No lookup by client_order_id: the orders created since are listed
+func (coinbase *coinbaseExchange) GetOrderByClientOid(productId string, clientOid string, since time.Time) (*api.Order, error) {
+	query := url.Values{"product_ids": {productId}, "start_date": {since.Add(-time.Minute).UTC().Format(time.RFC3339)}}
+	orders, err := coinbase.listOrders(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		if o.ClientOID == clientOid {
+			return &o, nil
+		}
+	}
+	return nil, nil
+}
+
+// POST /orders
+func (coinbase *coinbaseExchange) CreateOrder(order *api.Order) (api.Order, error) {
+	request := coinbaseCreateOrder{order.ClientOID, order.ProductId, strings.ToUpper(order.Side), coinbaseOrderConfiguration{}}
+	switch order.Type {
+	case "market":
+		market := coinbaseMarket{}
+		if order.Funds > 0 {
+			market.QuoteSize = formatFloat(order.Funds)
+		} else {
+			market.BaseSize = formatFloat(order.Size)
+		}
+		request.OrderConfiguration.MarketMarketIoc = &market
+	default:
+		request.OrderConfiguration.LimitLimitGtc = &coinbaseLimit{formatFloat(order.Size), formatFloat(order.Price), order.PostOnly}
+	}
+	var response coinbaseCreateOrderResponse
+	if err := coinbase.request("POST", "/orders", nil, request, &response); err != nil {
+		return api.Order{}, err
+	}
+	if !response.Success {
+		return api.Order{}, &APIError{"POST " + COINBASE_API_PATH + "/orders", 0, response.ErrorResponse.Error + ": " + response.ErrorResponse.Message, false}
+	}
+	savedOrder := *order
+	savedOrder.Id = response.SuccessResponse.OrderId
+	savedOrder.Status = "pending"
+	return savedOrder, nil
+}
+
+// POST /orders/batch_cancel
+func (coinbase *coinbaseExchange) CancelOrder(productId string, orderId string) error {
+	var response coinbaseCancelOrdersResponse
+	if err := coinbase.request("POST", "/orders/batch_cancel", nil, coinbaseCancelOrders{[]string{orderId}}, &response); err != nil {
+		return err
+	}
+	for _, result := range response.Results {
+		if result.OrderId == orderId && !result.Success {
+			return &APIError{"POST " + COINBASE_API_PATH + "/orders/batch_cancel", 0, result.FailureReason, false}
+		}
+	}
+	return nil
+}
+
+// GET /best_bid_ask
+func (coinbase *coinbaseExchange) GetTicker(productId string) (ask float64, bid float64, err error) {
+	var response coinbaseBestBidAsk
+	if err := coinbase.request("GET", "/best_bid_ask", url.Values{"product_ids": {productId}}, nil, &response); err != nil {
+		return 0, 0, err
+	}
+	for _, book := range response.Pricebooks {
+		if book.ProductId == productId && len(book.Asks) > 0 && len(book.Bids) > 0 {
+			return book.Asks[0].Price, book.Bids[0].Price, nil
+		}
+	}
+	return 0, 0, &APIError{"GET " + COINBASE_API_PATH + "/best_bid_ask", 0, "no price book for " + productId, true}
+}
+
+func (coinbase *coinbaseExchange) Feed() Feed {
+	return &coinbaseFeed{coinbase, GetConfigInstance().WssURL, "", 0}
+}
+
+// GDAX order with the GDAX statuses
+func (o coinbaseOrder) order() api.Order {
+	order := api.Order{Id: o.OrderId, ProductId: o.ProductId, ClientOID: o.ClientOrderId, Side: strings.ToLower(o.Side),
+		FilledSize: o.FilledSize, ExecutedValue: o.FilledValue, FillFees: o.TotalFees, CreatedAt: api.Time(o.CreatedTime)}
+	switch o.Status {
+	case "PENDING", "QUEUED":
+		order.Status = "pending"
+	case "OPEN":
+		order.Status = "open"
+	case "FAILED":
+		order.Status = "rejected"
+	default: // FILLED, CANCELLED, EXPIRED
+		order.Status = "done"
+		order.Settled = true
+	}
+	if market := o.OrderConfiguration.MarketMarketIoc; market != nil {
+		order.Type = "market"
+		order.Size, _ = strconv.ParseFloat(market.BaseSize, 64)
+		order.Funds, _ = strconv.ParseFloat(market.QuoteSize, 64)
+	} else if limit := o.OrderConfiguration.LimitLimitGtc; limit != nil {
+		order.Type = "limit"
+		order.Size, _ = strconv.ParseFloat(limit.BaseSize, 64)
+		order.Price, _ = strconv.ParseFloat(limit.LimitPrice, 64)
+		order.PostOnly = limit.PostOnly
+	}
+	return order
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Advanced Trade websocket: market_trades, heartbeats, ticker and status channels
+type coinbaseFeed struct {
+	exchange  *coinbaseExchange // Signs the subscriptions if it has a private key, backfills if it has a base URL
+	url       string
+	productId string // Subscribed
+	acks      int    // Acknowledgements received since the subscriptions were sent
+}
+
+// Channels subscribed, in order. Each subscription is acknowledged with all the subscriptions of the connection
+var coinbaseChannels = []string{"heartbeats", "market_trades", "ticker", "status"}
+
+// {"subscriptions": {"market_trades": ["BTC-EUR"], ...}}
+type coinbaseSubscriptionsEvent struct {
+	Subscriptions map[string][]string `json:"subscriptions"`
+}
+
+type coinbaseSubscribe struct {
+	Type       string   `json:"type"`
+	ProductIds []string `json:"product_ids,omitempty"`
+	Channel    string   `json:"channel"`
+	Jwt        string   `json:"jwt,omitempty"`
+}
+
+type coinbaseFeedMessage struct {
+	Channel     string          `json:"channel"`
+	Timestamp   time.Time       `json:"timestamp"`
+	SequenceNum int64           `json:"sequence_num"`
+	Events      json.RawMessage `json:"events"`
+	Type        string          `json:"type"` // error
+	Message     string          `json:"message"`
+}
+
+type coinbaseTrade struct {
+	TradeId   string    `json:"trade_id"`
+	ProductId string    `json:"product_id"`
+	Price     float64   `json:"price,string"`
+	Size      float64   `json:"size,string"`
+	Side      string    `json:"side"` // Side of the maker, as the side of the GDAX matches
+	Time      time.Time `json:"time"`
+}
+
+type coinbaseTradesEvent struct {
+	Type   string          `json:"type"` // snapshot, update
+	Trades []coinbaseTrade `json:"trades"`
+}
+
+type coinbaseTicker struct {
+	ProductId string  `json:"product_id"`
+	Price     float64 `json:"price,string"`
+	BestBid   float64 `json:"best_bid,string"`
+	BestAsk   float64 `json:"best_ask,string"`
+}
+
+type coinbaseTickerEvent struct {
+	Type    string           `json:"type"` // snapshot, update
+	Tickers []coinbaseTicker `json:"tickers"`
+}
+
+// The statuses have no trading_disabled, cancel_only... flags
+type coinbaseStatusEvent struct {
+	Type     string          `json:"type"` // snapshot, update
+	Products []ProductStatus `json:"products"`
+}
+
+// Public market trades, newest first
+type coinbaseMarketTrades struct {
+	Trades []coinbaseTrade `json:"trades"`
+}
+
+func (feed *coinbaseFeed) URL() string {
+	return feed.url
+}
+
+func (feed *coinbaseFeed) Subscribe(conn *ws.Conn, productId string) error {
+	feed.productId = productId
+	feed.acks = 0
+	for _, channel := range coinbaseChannels {
+		var token string
+		if feed.exchange.privateKey != nil {
+			var err error
+			if token, err = feed.exchange.jwt(""); err != nil {
+				return err
+			}
+		}
+		if err := conn.WriteJSON(coinbaseSubscribe{"subscribe", []string{productId}, channel, token}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (feed *coinbaseFeed) Decode(data []byte) ([]FeedMessage, error) {
+	var message coinbaseFeedMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	if message.Type == "error" {
+		return []FeedMessage{{Message: api.Message{Type: "error", Message: message.Message}}}, nil
+	}
+	switch message.Channel {
+	case "heartbeats":
+		return []FeedMessage{{Message: api.Message{Type: "heartbeat", Sequence: message.SequenceNum, Time: api.Time(message.Timestamp)}}}, nil
+	case "subscriptions":
+		var events []coinbaseSubscriptionsEvent
+		if err := json.Unmarshal(message.Events, &events); err != nil {
+			return nil, err
+		}
+		missing := feed.missingChannels(events)
+		feed.acks++
+		if missing == "" {
+			return []FeedMessage{{Message: api.Message{Type: "subscriptions", Sequence: message.SequenceNum}}}, nil
+		}
+		if feed.acks < len(coinbaseChannels) { // The next subscriptions are not acknowledged yet
+			return nil, nil
+		}
+		return []FeedMessage{{Message: api.Message{Type: "error", Message: "subscription refused: " + missing}}}, nil
+	case "market_trades":
+		var events []coinbaseTradesEvent
+		if err := json.Unmarshal(message.Events, &events); err != nil {
+			return nil, err
+		}
+		var messages []FeedMessage
+		for _, event := range events {
+			if event.Type == "snapshot" { // Trades before the subscription
+				continue
+			}
+			for _, trade := range event.Trades {
+				match, err := trade.match()
+				if err != nil {
+					return nil, err
+				}
+				match.Sequence = message.SequenceNum
+				messages = append(messages, FeedMessage{Message: match})
+			}
+		}
+		return messages, nil
+	case "ticker":
+		var events []coinbaseTickerEvent
+		if err := json.Unmarshal(message.Events, &events); err != nil {
+			return nil, err
+		}
+		var messages []FeedMessage
+		for _, event := range events {
+			for _, ticker := range event.Tickers {
+				messages = append(messages, FeedMessage{Message: api.Message{Type: "ticker", ProductId: ticker.ProductId, Price: ticker.Price,
+					Sequence: message.SequenceNum, Time: api.Time(message.Timestamp)}, BestBid: ticker.BestBid, BestAsk: ticker.BestAsk})
+			}
+		}
+		return messages, nil
+	case "status":
+		var events []coinbaseStatusEvent
+		if err := json.Unmarshal(message.Events, &events); err != nil {
+			return nil, err
+		}
+		var messages []FeedMessage
+		for _, event := range events {
+			messages = append(messages, FeedMessage{Message: api.Message{Type: "status", Sequence: message.SequenceNum}, Products: event.Products})
+		}
+		return messages, nil
+	}
+	return nil, nil
+}
+
+// Channels and products subscribed but not acknowledged, empty if none. The heartbeats are not by product
+func (feed *coinbaseFeed) missingChannels(events []coinbaseSubscriptionsEvent) string {
+	var missing []string
+	for _, channel := range coinbaseChannels {
+		var products map[string]bool
+		for _, event := range events {
+			if productIds, ok := event.Subscriptions[channel]; ok {
+				products = map[string]bool{}
+				for _, productId := range productIds {
+					products[productId] = true
+				}
+			}
+		}
+		if products == nil {
+			missing = append(missing, channel)
+		} else if channel != "heartbeats" && !products[feed.productId] {
+			missing = append(missing, channel+" "+feed.productId)
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+// Public GET /market/products/<product-id>/ticker returns the last COINBASE_MAX_TRADES trades at most
+func (feed *coinbaseFeed) Backfill(productId string, lastTradeId int) ([]api.Message, error) {
+	if feed.exchange.baseURL == "" {
+		return nil, nil
+	}
+	var trades coinbaseMarketTrades
+	query := url.Values{"limit": {strconv.Itoa(COINBASE_MAX_TRADES)}}
+	if err := feed.exchange.request("GET", "/market/products/"+productId+"/ticker", query, nil, &trades); err != nil {
+		return nil, err
+	}
+	var messages []api.Message
+	for _, trade := range trades.Trades {
+		match, err := trade.match()
+		if err != nil {
+			return nil, err
+		}
+		if match.TradeId <= lastTradeId {
+			return reverseMessages(messages), nil
+		}
+		match.ProductId = productId
+		messages = append(messages, match)
+	}
+	if len(messages) == COINBASE_MAX_TRADES {
+		GetLoggerInstance().Error("In coinbase-exchange/Backfill. More than %d trades since trade %d, the oldest ones are lost", COINBASE_MAX_TRADES, lastTradeId)
+	}
+	return reverseMessages(messages), nil
+}
+
+func (trade coinbaseTrade) match() (api.Message, error) {
+	tradeId, err := strconv.Atoi(trade.TradeId)
+	if err != nil {
+		return api.Message{}, fmt.Errorf("trade_id %s: %s", trade.TradeId, err.Error())
+	}
+	return api.Message{Type: "match", ProductId: trade.ProductId, TradeId: tradeId, Price: trade.Price, Size: trade.Size,
+		Side: strings.ToLower(trade.Side), Time: api.Time(trade.Time)}, nil
+}
@@ -0,0 +1,215 @@
+package nibiru
+
+import (
+	"algo-trading/fakes"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+// Adapter signed with a new key, on a fake with BTC-EUR at 20000 and 10000 EUR
+func newFakeCoinbase(t *testing.T) (*coinbaseExchange, *fakes.CoinbaseServer, *httptest.Server) {
+	t.Helper()
+	keyName, secret, publicKey, err := fakes.NewCoinbaseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fakes.NewCoinbaseServer(keyName, publicKey)
+	server.AddProduct("BTC-EUR", 0.0001, 20000)
+	server.SetBalance("EUR", 10000)
+	httpServer := httptest.NewServer(server)
+	privateKey, err := parseECPrivateKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, _ := url.Parse(httpServer.URL)
+	return &coinbaseExchange{httpServer.URL, baseURL.Host, keyName, privateKey, httpServer.Client()}, server, httpServer
+}
+
+func balances(t *testing.T, coinbase *coinbaseExchange) map[string]api.Account {
+	t.Helper()
+	accounts, err := coinbase.GetAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byCurrency := map[string]api.Account{}
+	for _, account := range accounts {
+		byCurrency[account.Currency] = account
+	}
+	return byCurrency
+}
+
+func TestCoinbaseProductAndTicker(t *testing.T) {
+	coinbase, _, httpServer := newFakeCoinbase(t)
+	defer httpServer.Close()
+	product, err := coinbase.GetProduct("BTC-EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product != (Product{"BTC-EUR", 0.0001, 1000, 0.00000001, 0.01}) {
+		t.Errorf("GetProduct = %+v", product)
+	}
+	if _, err := coinbase.GetProduct("ETH-EUR"); err == nil {
+		t.Error("GetProduct of an unknown product without error")
+	}
+	ask, bid, err := coinbase.GetTicker("BTC-EUR")
+	if err != nil || ask != 20000 || bid != 20000 {
+		t.Errorf("GetTicker = %f, %f, %v, want 20000, 20000", ask, bid, err)
+	}
+}
+
+func TestCoinbaseSignature(t *testing.T) {
+	coinbase, _, httpServer := newFakeCoinbase(t)
+	defer httpServer.Close()
+	_, secret, _, _ := fakes.NewCoinbaseKey()
+	coinbase.privateKey, _ = parseECPrivateKey(secret)
+	_, err := coinbase.GetAccounts()
+	if apiError, ok := err.(*APIError); !ok || apiError.StatusCode != 401 {
+		t.Errorf("GetAccounts signed with another key: %v, want a 401", err)
+	}
+}
+
+func TestCoinbaseMarketOrder(t *testing.T) {
+	coinbase, _, httpServer := newFakeCoinbase(t)
+	defer httpServer.Close()
+	since := time.Now()
+	order, err := coinbase.CreateOrder(&api.Order{Type: "market", Side: "buy", Size: 0.1, ProductId: "BTC-EUR", ClientOID: "client-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Id == "" || order.Status != "pending" {
+		t.Errorf("CreateOrder = %+v", order)
+	}
+	// Created again with the same client id: the same order
+	again, err := coinbase.CreateOrder(&api.Order{Type: "market", Side: "buy", Size: 0.1, ProductId: "BTC-EUR", ClientOID: "client-1"})
+	if err != nil || again.Id != order.Id {
+		t.Errorf("CreateOrder with the same client id = %s, %v, want %s", again.Id, err, order.Id)
+	}
+
+	found, err := coinbase.GetOrderByClientOid("BTC-EUR", "client-1", since)
+	if err != nil || found == nil {
+		t.Fatalf("GetOrderByClientOid = %v, %v", found, err)
+	}
+	if found.Id != order.Id || found.Status != "done" || found.Type != "market" || found.Size != 0.1 || found.FilledSize != 0.1 {
+		t.Errorf("GetOrderByClientOid = %+v", *found)
+	}
+	if missing, err := coinbase.GetOrderByClientOid("BTC-EUR", "client-2", since); err != nil || missing != nil {
+		t.Errorf("GetOrderByClientOid of an unknown client id = %v, %v, want nil", missing, err)
+	}
+
+	fills, err := coinbase.ListFills("BTC-EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fills) != 1 || fills[0].Side != "buy" || fills[0].Price != 20000 || fills[0].Size != 0.1 || math.Abs(fills[0].Fee-12) > 1e-9 {
+		t.Errorf("ListFills = %+v, want a buy of 0.1 at 20000, fee 12", fills)
+	}
+	accounts := balances(t, coinbase)
+	if math.Abs(accounts["EUR"].Available-7988) > 1e-9 || accounts["BTC"].Available != 0.1 {
+		t.Errorf("Balances after the buy = %f EUR, %f BTC, want 7988, 0.1", accounts["EUR"].Available, accounts["BTC"].Available)
+	}
+
+	if _, err := coinbase.CreateOrder(&api.Order{Type: "market", Side: "sell", Size: 1, ProductId: "BTC-EUR", ClientOID: "client-3"}); err == nil {
+		t.Error("Sell of more than the balance without error")
+	}
+}
+
+func TestCoinbaseLimitOrder(t *testing.T) {
+	coinbase, _, httpServer := newFakeCoinbase(t)
+	defer httpServer.Close()
+	order, err := coinbase.CreateOrder(&api.Order{Type: "limit", Side: "buy", Size: 0.1, Price: 19000, ProductId: "BTC-EUR", ClientOID: "client-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := coinbase.ListOrders("BTC-EUR", "open")
+	if err != nil || len(open) != 1 || open[0].Id != order.Id || open[0].Price != 19000 || open[0].Status != "open" {
+		t.Fatalf("ListOrders open = %+v, %v", open, err)
+	}
+	if eur := balances(t, coinbase)["EUR"]; eur.Hold != 1900 || eur.Available != 8100 || eur.Balance != 10000 {
+		t.Errorf("EUR with the order open = %+v, want a hold of 1900", eur)
+	}
+
+	if err := coinbase.CancelOrder("BTC-EUR", order.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinbase.CancelOrder("BTC-EUR", order.Id); err == nil {
+		t.Error("Second cancel without error")
+	}
+	if open, err := coinbase.ListOrders("BTC-EUR", "open"); err != nil || len(open) != 0 {
+		t.Errorf("ListOrders open after the cancel = %+v, %v", open, err)
+	}
+	if done, err := coinbase.ListOrders("BTC-EUR", "done"); err != nil || len(done) != 1 || done[0].Status != "done" {
+		t.Errorf("ListOrders done after the cancel = %+v, %v", done, err)
+	}
+	if eur := balances(t, coinbase)["EUR"]; eur.Hold != 0 || eur.Available != 10000 {
+		t.Errorf("EUR after the cancel = %+v, want no hold", eur)
+	}
+}
+
+func TestCoinbaseBackfill(t *testing.T) {
+	coinbase, server, httpServer := newFakeCoinbase(t)
+	defer httpServer.Close()
+	for i := 1; i <= 5; i++ {
+		server.PublishTrade("BTC-EUR", 20000+float64(i), 0.01, "buy")
+	}
+	feed := &coinbaseFeed{coinbase, "", "", 0}
+	matches, err := feed.Backfill("BTC-EUR", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("Backfill after trade 2 = %d matches, want 3", len(matches))
+	}
+	for i, match := range matches {
+		if match.Type != "match" || match.TradeId != i+3 || match.Price != 20000+float64(i+3) || match.ProductId != "BTC-EUR" {
+			t.Errorf("Backfill[%d] = %+v, want trade %d", i, match, i+3)
+		}
+	}
+}
+
+// Each subscription is acknowledged with the subscriptions of the connection: the feed waits for the last one
+func TestCoinbaseSubscriptions(t *testing.T) {
+	ack := func(subscriptions string) []byte {
+		return []byte(`{"channel":"subscriptions","sequence_num":1,"events":[{"subscriptions":` + subscriptions + `}]}`)
+	}
+	tests := []struct {
+		acks  [][]byte
+		types []string // Of the messages decoded from each acknowledgement, "" for none
+		error string
+	}{
+		{[][]byte{ack(`{"heartbeats":["heartbeats"]}`), ack(`{"heartbeats":["heartbeats"],"market_trades":["BTC-EUR"]}`),
+			ack(`{"heartbeats":["heartbeats"],"market_trades":["BTC-EUR"],"ticker":["BTC-EUR"]}`),
+			ack(`{"heartbeats":["heartbeats"],"market_trades":["BTC-EUR"],"ticker":["BTC-EUR"],"status":["BTC-EUR"]}`)},
+			[]string{"", "", "", "subscriptions"}, ""},
+		{[][]byte{ack(`{"heartbeats":[],"market_trades":["BTC-EUR"],"ticker":["BTC-EUR"],"status":["BTC-EUR"]}`)},
+			[]string{"subscriptions"}, ""},
+		{[][]byte{ack(`{"heartbeats":[]}`), ack(`{"heartbeats":[]}`), ack(`{"heartbeats":[],"ticker":["BTC-EUR"]}`),
+			ack(`{"heartbeats":[],"ticker":["BTC-EUR"],"status":["BTC-EUR"]}`)},
+			[]string{"", "", "", "error"}, "subscription refused: market_trades"},
+		{[][]byte{ack(`{"heartbeats":[]}`), ack(`{"heartbeats":[],"market_trades":["ETH-EUR"]}`), ack(`{"heartbeats":[],"market_trades":["ETH-EUR"],"ticker":["BTC-EUR"]}`),
+			ack(`{"heartbeats":[],"market_trades":["ETH-EUR"],"ticker":["BTC-EUR"],"status":["BTC-EUR"]}`)},
+			[]string{"", "", "", "error"}, "subscription refused: market_trades BTC-EUR"},
+	}
+	for i, test := range tests {
+		feed := &coinbaseFeed{&coinbaseExchange{}, "", "BTC-EUR", 0}
+		for j, data := range test.acks {
+			messages, err := feed.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.types[j] == "" {
+				if len(messages) != 0 {
+					t.Errorf("Test %d: acknowledgement %d decoded to %+v, want nothing", i, j, messages)
+				}
+				continue
+			}
+			if len(messages) != 1 || messages[0].Type != test.types[j] || messages[0].Message.Message != test.error {
+				t.Errorf("Test %d: acknowledgement %d decoded to %+v, want %s %s", i, j, messages, test.types[j], test.error)
+			}
+		}
+	}
+}
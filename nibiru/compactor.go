@@ -0,0 +1,120 @@
+package nibiru
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const compactionPeriod = time.Hour
+const BAR_INTERVAL string = "1m"
+
+// Downsample daily match indices older than Retention.RawMatchDays to 1 minute bars, then delete them
+type Compactor struct {
+	elasticClient *ElasticClient
+	rawMatchDays  int
+	loop          *tickerLoop
+}
+
+func NewCompactor() *Compactor {
+	return &Compactor{NewElasticClient(), GetConfigInstance().Retention.RawMatchDays, nil}
+}
+
+func (compactor *Compactor) Run() {
+	GetLoggerInstance().Info("Run Compactor ticker")
+	compactor.loop = startTickerLoopNow(compactionPeriod, func(time.Time) {
+		compactor.Compact()
+	})
+}
+
+// Waits for the compaction in progress, an index is never deleted before its bars are indexed
+func (compactor *Compactor) Stop() {
+	compactor.loop.Stop()
+}
+
+func (compactor *Compactor) Compact() {
+	if !compactor.elasticClient.dailyIndices || compactor.rawMatchDays <= 0 {
+		GetLoggerInstance().Info("Compactor - Nothing to do, dailyIndices is off or rawMatchDays is 0")
+		return
+	}
+	now := time.Now().UTC()
+	limit := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -compactor.rawMatchDays)
+
+	indices, err := compactor.elasticClient.listIndices(compactor.elasticClient.matchSearchIndex("", ""))
+	if err != nil {
+		GetLoggerInstance().Error("In compactor/Compact. Failed listing indices: %s", err.Error())
+		return
+	}
+	for _, index := range indices {
+		productId, day, ok := compactor.parseDailyMatchIndex(index)
+		if !ok || !day.Before(limit) {
+			continue
+		}
+		nbBars, err := compactor.downsample(index, productId)
+		if err != nil {
+			GetLoggerInstance().Error("In compactor/Compact. Failed downsampling %s, raw matches kept: %s", index, err.Error())
+			continue
+		}
+		if err := compactor.elasticClient.deleteIndex(index); err != nil {
+			GetLoggerInstance().Error("In compactor/Compact. Failed deleting %s: %s", index, err.Error())
+			continue
+		}
+		GetLoggerInstance().Info("Compactor - %s downsampled to %d bars and deleted", index, nbBars)
+	}
+}
+
+// Product and day of an index named <esMatchIndex>-<product>-<yyyy.mm.dd>
+func (compactor *Compactor) parseDailyMatchIndex(index string) (productId string, day time.Time, ok bool) {
+	prefix := compactor.elasticClient.esMatchIndex + "-"
+	if !strings.HasPrefix(index, prefix) || len(index) < len(prefix)+len(DAILY_INDEX_FORMAT)+2 {
+		return "", time.Time{}, false
+	}
+	suffix := index[len(index)-len(DAILY_INDEX_FORMAT):]
+	day, err := time.Parse(DAILY_INDEX_FORMAT, suffix)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	productId = strings.ToUpper(index[len(prefix) : len(index)-len(DAILY_INDEX_FORMAT)-1])
+	return productId, day, true
+}
+
+// Build the 1 minute bars of a daily index and index them. Bars have a deterministic id, so it can be run again
+func (compactor *Compactor) downsample(index string, productId string) (int, error) {
+	requestBody := `{
+		"size": 1000,
+		"sort": [ { "matchTime": { "order": "asc" } } ]
+	}`
+	var bars []*Candle
+	err := compactor.elasticClient.scroll(index, requestBody, func(hits []RawHitType) error {
+		for _, hit := range hits {
+			match := MatchDocument{}
+			if err := json.Unmarshal(hit.Source, &match); err != nil {
+				return err
+			}
+			start := match.MatchTime.UTC().Truncate(time.Minute)
+			if len(bars) == 0 || !bars[len(bars)-1].Time.Equal(start) {
+				bars = append(bars, newCandle(start, productId, BAR_INTERVAL, match.Price))
+			}
+			bars[len(bars)-1].add(match.Price, match.Size, match.Side)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var items []BulkItem
+	for _, bar := range bars {
+		items = append(items, BulkItem{compactor.elasticClient.barIndex(productId, bar.Time), compactor.elasticClient.esType, bar.id(), bar.document()})
+		if len(items) == 1000 {
+			if err := compactor.elasticClient.bulk(items); err != nil {
+				return 0, err
+			}
+			items = nil
+		}
+	}
+	if err := compactor.elasticClient.bulk(items); err != nil {
+		return 0, err
+	}
+	return len(bars), nil
+}
@@ -0,0 +1,219 @@
+package nibiru
+
+import (
+	"sync"
+	"time"
+)
+
+// Other exchange listened to by the ingest, compared with the main one (Config.Exchange)
+type VenueConfig struct {
+	Name      string  `json:"name"`     // Suffix of its match index, exchange name by default
+	Exchange  string  `json:"exchange"` // gdax, coinbase or binance
+	WssURL    string  `json:"wssURL"`
+	BaseURL   string  `json:"baseURL"`   // REST API, to backfill the gaps of the feed. Not backfilled if empty
+	ProductId string  `json:"productId"` // Same asset as Init.Crypto, in the GDAX format (BTC-USDT)
+	Fee       float64 `json:"fee"`       // Taker fee, in %
+}
+
+func (venue VenueConfig) name() string {
+	if venue.Name != "" {
+		return venue.Name
+	}
+	return venue.Exchange
+}
+
+// Name of the main exchange in the divergence series
+func mainVenue() string {
+	if GetConfigInstance().Exchange == "" {
+		return EXCHANGE_GDAX
+	}
+	return GetConfigInstance().Exchange
+}
+
+// Buy on BuyVenue and sell on SellVenue makes NetSpread %, fees deducted
+type ArbitrageEvent struct {
+	Time        time.Time
+	BuyVenue    string
+	SellVenue   string
+	BuyPrice    float64
+	SellPrice   float64
+	GrossSpread float64 // In %
+	NetSpread   float64 // In %
+}
+
+type venueTrade struct {
+	time  time.Time
+	price float64
+	size  float64
+	side  string
+}
+
+// Trades of a venue in the window
+type venueState struct {
+	productId string
+	fee       float64
+	lastPrice float64
+	lastTime  time.Time
+	trades    []venueTrade
+}
+
+func (state *venueState) prune(since time.Time) {
+	i := 0
+	for i < len(state.trades) && state.trades[i].time.Before(since) {
+		i++
+	}
+	state.trades = state.trades[i:]
+}
+
+// VWAP, buy and sell volumes of the window. The side is the side of the maker, as in the matches
+func (state *venueState) volumes() (vwap float64, buyVolume float64, sellVolume float64) {
+	var value float64
+	for _, trade := range state.trades {
+		value += trade.price * trade.size
+		if trade.side == "buy" {
+			buyVolume += trade.size
+		} else {
+			sellVolume += trade.size
+		}
+	}
+	if buyVolume+sellVolume > 0 {
+		vwap = value / (buyVolume + sellVolume)
+	}
+	return vwap, buyVolume, sellVolume
+}
+
+// Compare the last price, the VWAP and the volumes of the asset on every venue. The spread series is indexed
+// in Divergence.EsDivergenceIndex, and an ArbitrageEvent emitted when the spread net of fees exceeds Divergence.Threshold
+type DivergenceMonitor struct {
+	mutex         sync.Mutex
+	venues        map[string]*venueState
+	subscribers   []func(ArbitrageEvent)
+	elasticClient *ElasticClient
+	loop          *tickerLoop
+}
+
+var divergenceMonitorInstance *DivergenceMonitor
+var onceDivergenceMonitor sync.Once
+
+func GetDivergenceMonitorInstance() *DivergenceMonitor {
+	onceDivergenceMonitor.Do(func() {
+		config := GetConfigInstance()
+		venues := map[string]*venueState{mainVenue(): {productId: config.Init.Crypto + "-" + config.Init.Currency, fee: config.Divergence.Fee}}
+		for _, venue := range config.Divergence.Venues {
+			venues[venue.name()] = &venueState{productId: venue.ProductId, fee: venue.Fee}
+		}
+		divergenceMonitorInstance = &DivergenceMonitor{sync.Mutex{}, venues, nil, NewElasticClient(), nil}
+	})
+	return divergenceMonitorInstance
+}
+
+func (monitor *DivergenceMonitor) Subscribe(handler func(event ArbitrageEvent)) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.subscribers = append(monitor.subscribers, handler)
+}
+
+func (monitor *DivergenceMonitor) OnMarketEvent(event MarketEvent) {
+	if trade, ok := event.(*TradeEvent); ok {
+		monitor.AddTrade(trade.Venue, trade.Time, trade.ProductId, trade.Price, trade.Size, trade.Side)
+	}
+}
+
+// Trade of productId on venue. Trades of other products are ignored
+func (monitor *DivergenceMonitor) AddTrade(venue string, t time.Time, productId string, price float64, size float64, side string) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	state, ok := monitor.venues[venue]
+	if !ok || state.productId != productId || len(monitor.venues) < 2 { // Nothing to compare with
+		return
+	}
+	state.lastPrice = price
+	state.lastTime = t
+	state.trades = append(state.trades, venueTrade{t, price, size, side})
+}
+
+func (monitor *DivergenceMonitor) Run() {
+	if len(GetConfigInstance().Divergence.Venues) == 0 {
+		return
+	}
+	interval := GetConfigInstance().Divergence.IntervalSeconds
+	if interval <= 0 {
+		interval = 10
+	}
+	GetLoggerInstance().Info("Run DivergenceMonitor ticker")
+	monitor.loop = startTickerLoop(time.Duration(interval)*time.Second, monitor.compare)
+}
+
+func (monitor *DivergenceMonitor) Stop() {
+	monitor.loop.Stop()
+}
+
+// Index the spread of each pair of venues with a recent trade, and emit the arbitrage events
+func (monitor *DivergenceMonitor) compare(now time.Time) {
+	config := GetConfigInstance().Divergence
+	window := time.Duration(config.WindowMinutes) * time.Minute
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	maxStale := time.Duration(config.MaxStaleSeconds) * time.Second
+	if maxStale <= 0 {
+		maxStale = time.Minute
+	}
+
+	monitor.mutex.Lock()
+	var names []string
+	for name, state := range monitor.venues {
+		state.prune(now.Add(-window))
+		if state.lastPrice > 0 && now.Sub(state.lastTime) <= maxStale {
+			names = append(names, name)
+		}
+	}
+	var docs []DivergenceDocument
+	var events []ArbitrageEvent
+	for i := 0; i < len(names); i++ {
+		for j := i + 1; j < len(names); j++ {
+			a, b := monitor.venues[names[i]], monitor.venues[names[j]]
+			vwapA, buyA, sellA := a.volumes()
+			vwapB, buyB, sellB := b.volumes()
+			doc := DivergenceDocument{ES_SCHEMA_VERSION, esTime(now), a.productId, b.productId, names[i], names[j], a.lastPrice, b.lastPrice,
+				spread(a.lastPrice, b.lastPrice), vwapA, vwapB, spread(vwapA, vwapB), buyA, sellA, buyB, sellB}
+			docs = append(docs, doc)
+
+			// Buy on the cheapest venue, sell on the other one
+			buy, sell, buyName, sellName := a, b, names[i], names[j]
+			if a.lastPrice > b.lastPrice {
+				buy, sell, buyName, sellName = b, a, names[j], names[i]
+			}
+			gross := spread(buy.lastPrice, sell.lastPrice)
+			if net := gross - buy.fee - sell.fee; config.Threshold > 0 && net > config.Threshold {
+				events = append(events, ArbitrageEvent{now, buyName, sellName, buy.lastPrice, sell.lastPrice, gross, net})
+			}
+		}
+	}
+	subscribers := monitor.subscribers
+	monitor.mutex.Unlock()
+
+	for _, doc := range docs {
+		if config.EsDivergenceIndex != "" {
+			monitor.elasticClient.IndexDivergence(doc)
+		}
+	}
+	for _, event := range events {
+		GetLoggerInstance().Info("DivergenceMonitor - ARBITRAGE buy on %s at %f, sell on %s at %f, spread: %f%%, net of fees: %f%%",
+			event.BuyVenue, event.BuyPrice, event.SellVenue, event.SellPrice, event.GrossSpread, event.NetSpread)
+		if config.EsArbitrageIndex != "" {
+			monitor.elasticClient.IndexArbitrage(event)
+		}
+		for _, handler := range subscribers {
+			handler(event)
+		}
+	}
+}
+
+// (b - a) / a, in %
+func spread(a float64, b float64) float64 {
+	if a == 0 {
+		return 0
+	}
+	return (b - a) / a * 100
+}
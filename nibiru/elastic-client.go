@@ -3,25 +3,23 @@ package nibiru
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const ES_TYPE string = "order"
 const REQUEST_TIMEOUT int = 10 // in seconds
+const DAILY_INDEX_FORMAT string = "2006.01.02"
+const MONTHLY_INDEX_FORMAT string = "2006.01"
 
-type Order struct {
-	MatchTime time.Time `json:"matchTime"`
-	ProductId string    `json:"product_id"`
-	Size      float64   `json:"size"`
-	Price     float64   `json:"price"`
-	Side      string    `json:"side"`
-}
+// Date of the daily match indices in the search patterns, so that they don't match the other indices prefixed by esMatchIndex (diff-size, sub-size...)
+const DAILY_INDEX_PATTERN string = "20*"
 
 type ElasticClient struct {
 	elasticURL   string
@@ -30,6 +28,14 @@ type ElasticClient struct {
 	esFillIndex  string
 	esDiffSizeIndex  string
 	esSubSizeIndex string
+	esBarIndex   string
+	esCandleIndex string
+	esRiskIndex  string
+	esAlertIndex string
+	esDivergenceIndex string
+	esArbitrageIndex  string
+	venue        string // Matches of another exchange than the main one
+	dailyIndices bool
 	esType       string
 	esUser       string
 	esPassword   string
@@ -37,110 +43,129 @@ type ElasticClient struct {
 
 func NewElasticClient() *ElasticClient {
 	var httpClient = &http.Client{Timeout: time.Duration(REQUEST_TIMEOUT) * time.Second}
-	return &ElasticClient{GetConfigInstance().ElasticURL, httpClient, GetConfigInstance().EsMatchIndex, GetConfigInstance().EsFillIndex, GetConfigInstance().EsDiffSizeIndex, GetConfigInstance().EsSubSizeIndex, ES_TYPE, GetConfigInstance().EsUser, GetConfigInstance().EsPassword}
+	return &ElasticClient{GetConfigInstance().ElasticURL, httpClient, GetConfigInstance().EsMatchIndex, GetConfigInstance().EsFillIndex, GetConfigInstance().EsDiffSizeIndex, GetConfigInstance().EsSubSizeIndex, GetConfigInstance().Retention.EsBarIndex, GetConfigInstance().Candles.EsCandleIndex, GetConfigInstance().Risk.EsRiskIndex, GetConfigInstance().Reconciliation.EsAlertIndex, GetConfigInstance().Divergence.EsDivergenceIndex, GetConfigInstance().Divergence.EsArbitrageIndex, "", GetConfigInstance().Retention.DailyIndices, ES_TYPE, GetConfigInstance().EsUser, GetConfigInstance().EsPassword}
+}
+
+// Error returned by an Elasticsearch request
+type ESError struct {
+	Operation  string
+	Resource   string
+	StatusCode int // 0 when no response was received
+	Message    string
+}
+
+func (e *ESError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s %s: %s", e.Operation, e.Resource, e.Message)
+	}
+	return fmt.Sprintf("%s %s: status code %d: %s", e.Operation, e.Resource, e.StatusCode, e.Message)
 }
 
+// Same as request, but stops the program on error
 func (elasticClient *ElasticClient) operation(ope string, requestBody string, resource string) string {
-	re := regexp.MustCompile("\\s") // remove all spaces
-	requestBody = re.ReplaceAllString(requestBody, "")
+	resp, err := elasticClient.request(ope, requestBody, resource)
+	if err != nil {
+		GetLoggerInstance().Error("In elastic-client/%s. %s", ope, err.Error())
+		os.Exit(1)
+	}
+	return resp
+}
 
+func (elasticClient *ElasticClient) request(ope string, requestBody string, resource string) (string, error) {
 	u, _ := url.ParseRequestURI(elasticClient.elasticURL)
-	u.Path = resource
+	r, _ := url.Parse(resource) // resource may contain a query string, ex: /index/_search?scroll=1m
+	u.Path = r.Path
+	u.RawQuery = r.RawQuery
 	urlStr := u.String()
 
 	req, err := http.NewRequest(ope, urlStr, bytes.NewBufferString(requestBody))
+	if err != nil {
+		return "", &ESError{ope, resource, 0, "Request failed: " + err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
 	if elasticClient.esUser != "" {
 		req.SetBasicAuth(elasticClient.esUser, elasticClient.esPassword)
 	}
 
+	resp, err := elasticClient.httpClient.Do(req)
 	if err != nil {
-		GetLoggerInstance().Error("In elastic-client/%s. Request failed: %s", ope, err.Error())
-		os.Exit(1)
+		return "", &ESError{ope, resource, 0, "Request failed: " + err.Error()}
 	}
-	resp, _ := elasticClient.httpClient.Do(req)
 	defer resp.Body.Close()
-	if resp.StatusCode >= 200 || resp.StatusCode < 300 { // OK
-		bodyBytes, err2 := ioutil.ReadAll(resp.Body)
-		if err2 != nil {
-			GetLoggerInstance().Error("In elastic-client/%s. Failed reading response: %s", ope, err2.Error())
-			os.Exit(1)
-		} else {
-			return string(bodyBytes)
-		}
-	} else {
-		GetLoggerInstance().Error("In elastic-client/%s. Status code KO: %d", ope, resp.StatusCode)
-		os.Exit(1)
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", &ESError{ope, resource, resp.StatusCode, "Failed reading response: " + err.Error()}
 	}
-	return ""
-}
-
-func (elasticClient *ElasticClient) Aggregate(field string, intervalMinutes int, aggFunction string, side string) float64 {
-	t := time.Now().Add(time.Duration(intervalMinutes) * time.Minute * -1).Format(time.RFC3339) // now - intervalMinutes
-	var index = elasticClient.esMatchIndex
-
-	requestBody := `{
-	    "aggs" : {
-	        "price_ranges" : {
-	            "range" : {
-	                "field" : "matchTime",
-	                "ranges" : [
-	                    { "from" : "` + t + `" }
-	                ]
-	            },
-			    "aggs" : {
-			        "result" : { "` + aggFunction + `" : { "field" : "` + field + `" } }
-			    }
-	        }
-	    }
-	}`
-
-	if side != "" {
-		index += "_" + side
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &ESError{ope, resource, resp.StatusCode, string(bodyBytes)}
 	}
-	resource := "/" + index + "/_search"
-	resp := elasticClient.operation("GET", requestBody, resource)
+	return string(bodyBytes), nil
+}
 
-	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/Aggregate. Response NIL")
-		os.Exit(1)
+// Compute aggFunction(field) on the matches of productId of the last intervalMinutes
+func (elasticClient *ElasticClient) Aggregate(productId string, field string, intervalMinutes int, aggFunction string, side string) (float64, error) {
+	to := time.Now()
+	query := TimeSeriesQuery{
+		From:      to.Add(time.Duration(intervalMinutes) * time.Minute * -1), // now - intervalMinutes
+		To:        to,
+		Metrics:   []Metric{{Name: "result", Type: aggFunction, Field: field}},
+		Side:      side,
+		ProductId: productId,
 	}
-	//GetLoggerInstance().Info("In elastic-client/Aggregate. Response: %s", resp)
-	esResponse := &ESResponse{}
-	err := json.Unmarshal([]byte(resp), esResponse)
+	result, err := elasticClient.Query(query)
 	if err != nil {
-		GetLoggerInstance().Error("In elastic-client/Aggregate. Failed unmarshaling response: %s", err.Error())
-		os.Exit(1)
+		return 0, err
+	}
+	return result.Value("result"), nil
+}
+
+// Client indexing the matches of venue in esMatchIndex_<venue>, apart from the matches of the main exchange
+func (elasticClient *ElasticClient) ForVenue(venue string) *ElasticClient {
+	venueClient := *elasticClient
+	venueClient.esMatchIndex += "_" + strings.ToLower(venue)
+	venueClient.venue = venue
+	return &venueClient
+}
+
+// Index a match once in its daily index, or twice (all sides and per side index) without daily indices
+func (elasticClient *ElasticClient) IndexMatch(matchTime time.Time, productId string, tradeId int, size float64, price float64, side string) {
+	if elasticClient.dailyIndices {
+		elasticClient.IndexOrder(matchTime, productId, tradeId, size, price, side)
+		return
 	}
-	return esResponse.Aggregations.PriceRanges.Buckets[0].Result.Value
+	elasticClient.IndexOrder(matchTime, productId, tradeId, size, price, "")
+	elasticClient.IndexOrder(matchTime, productId, tradeId, size, price, side)
 }
 
-func (elasticClient *ElasticClient) IndexOrder(matchTime time.Time, productId string, size float64, price float64, side string) {
-	t := matchTime.Format(time.RFC3339)
+// A match with a trade id is indexed with a deterministic id, so indexing it again overwrites it
+func (elasticClient *ElasticClient) IndexOrder(matchTime time.Time, productId string, tradeId int, size float64, price float64, side string) {
 	var index = elasticClient.esMatchIndex
-	requestBody := `{
-				"matchTime": "` + t + `",
-				"product_id": "` + productId + `",
-				"size": "` + strconv.FormatFloat(size, 'E', -1, 64) + `",
-				"price": "` + strconv.FormatFloat(price, 'E', -1, 64) + `"`
-	if side != "" {
-		requestBody += `, "side": "` + side + `"`
+	if elasticClient.dailyIndices {
+		index = elasticClient.dailyMatchIndex(productId, matchTime)
+	} else if side != "" {
 		index += "_" + side
 	}
-	requestBody += `}`
-	
 	resource := "/" + index + "/orders"
-	//GetLoggerInstance().Error("In elastic-client/IndexOrder - size: %f, price: %f ", size, price)
-	resp := elasticClient.operation("POST", requestBody, resource)
+	if id := matchId(productId, tradeId); id != "" {
+		resource += "/" + id
+	}
+	doc := MatchDocument{ES_SCHEMA_VERSION, esTime(matchTime), productId, size, price, side, elasticClient.venue, tradeId}
+	elasticClient.indexDocument(resource, doc, "IndexOrder")
+}
 
-	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/IndexOrder. Response NIL")
-		os.Exit(1)
+// <product>-<trade id>, empty when the trade id is unknown
+func matchId(productId string, tradeId int) string {
+	if tradeId <= 0 {
+		return ""
 	}
+	return strings.ToLower(productId) + "-" + strconv.Itoa(tradeId)
 }
 
-func (elasticClient *ElasticClient) GetLatestPrice() float64 {
+// Price of the last match of productId indexed, an *ESError if there is none
+func (elasticClient *ElasticClient) GetLatestPrice(productId string) (float64, error) {
 	requestBody := `{
 	  "size": 1,
+	  "query": { "term": { "product_id": "` + productId + `" } },
 	  "sort": [
 	    {
 	      "matchTime": {
@@ -149,79 +174,407 @@ func (elasticClient *ElasticClient) GetLatestPrice() float64 {
 	    }
 	  ]
 	}`
-	resource := "/" + elasticClient.esMatchIndex + "/orders/_search"
-	resp := elasticClient.operation("GET", requestBody, resource)
-
-	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/GetLatestRecord. Response NIL")
-		os.Exit(1)
+	resource := "/" + elasticClient.matchSearchIndex(productId, "") + "/orders/_search"
+	resp, err := elasticClient.request("GET", requestBody, resource)
+	if err != nil {
+		return 0, err
 	}
 	esResponse := &ESResponse{}
-	err := json.Unmarshal([]byte(resp), esResponse)
-	if err != nil {
-		GetLoggerInstance().Error("In elastic-client/GetLatestRecord. Failed unmarshaling response: %s", err.Error())
-		os.Exit(1)
+	if err := json.Unmarshal([]byte(resp), esResponse); err != nil {
+		return 0, &ESError{"GET", resource, 200, "Failed unmarshaling response: " + err.Error()}
 	}
-	return esResponse.Hits.Hits[0].Source.Price
+	if len(esResponse.Hits.Hits) == 0 {
+		return 0, &ESError{"GET", resource, 200, "No match indexed"}
+	}
+	return esResponse.Hits.Hits[0].Source.Price, nil
 }
 
-func (elasticClient *ElasticClient) IndexFillOrder(fillTime time.Time, productId string, size float64, price float64, side string) {
-	t := fillTime.Format(time.RFC3339)
-	requestBody := `{
-				"fillTime": "` + t + `",
-				"product_id": "` + productId + `",
-				"size": "` + strconv.FormatFloat(size, 'E', -1, 64) + `",
-				"price": "` + strconv.FormatFloat(price, 'E', -1, 64) + `",
-				"side": "` + side + `"
-				}`
-	resource := "/" + elasticClient.esFillIndex + "/orders"
-	//GetLoggerInstance().Error("In elastic-client/IndexOrder - size: %f, price: %f ", size, price)
-	resp := elasticClient.operation("POST", requestBody, resource)
+func (elasticClient *ElasticClient) IndexFillOrder(fillTime time.Time, productId string, size float64, price float64, side string, fee float64) {
+	doc := FillDocument{ES_SCHEMA_VERSION, esTime(fillTime), productId, size, price, side, fee}
+	elasticClient.indexDocument("/"+elasticClient.esFillIndex+"/orders", doc, "IndexFillOrder")
+}
 
-	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/IndexFillOrder. Response NIL")
-		os.Exit(1)
+// Candles have a deterministic id, a candle indexed twice is overwritten
+func (elasticClient *ElasticClient) IndexCandle(candle Candle) {
+	index := elasticClient.esCandleIndex + "-" + strings.ToLower(candle.ProductId) + "-" + candle.Time.UTC().Format(MONTHLY_INDEX_FORMAT)
+	elasticClient.indexDocument("/"+index+"/"+elasticClient.esType+"/"+candle.id(), candle.document(), "IndexCandle")
+}
+
+func (elasticClient *ElasticClient) IndexRiskRejection(t time.Time, productId string, side string, price float64, size float64, reason string) {
+	if elasticClient.esRiskIndex == "" {
+		return
 	}
+	doc := RiskRejectionDocument{ES_SCHEMA_VERSION, esTime(t), productId, side, price, size, reason}
+	elasticClient.indexDocument("/"+elasticClient.esRiskIndex+"/"+elasticClient.esType, doc, "IndexRiskRejection")
+}
+
+func (elasticClient *ElasticClient) IndexDivergence(doc DivergenceDocument) {
+	elasticClient.indexDocument("/"+elasticClient.esDivergenceIndex+"/"+elasticClient.esType, doc, "IndexDivergence")
+}
+
+func (elasticClient *ElasticClient) IndexArbitrage(event ArbitrageEvent) {
+	doc := ArbitrageDocument{ES_SCHEMA_VERSION, esTime(event.Time), event.BuyVenue, event.SellVenue, event.BuyPrice, event.SellPrice, event.GrossSpread, event.NetSpread}
+	elasticClient.indexDocument("/"+elasticClient.esArbitrageIndex+"/"+elasticClient.esType, doc, "IndexArbitrage")
+}
+
+func (elasticClient *ElasticClient) IndexAlert(t time.Time, productId string, source string, item string, believed float64, actual float64) {
+	if elasticClient.esAlertIndex == "" {
+		return
+	}
+	doc := AlertDocument{ES_SCHEMA_VERSION, esTime(t), productId, source, item, believed, actual}
+	elasticClient.indexDocument("/"+elasticClient.esAlertIndex+"/"+elasticClient.esType, doc, "IndexAlert")
 }
 
 func (elasticClient *ElasticClient) IndexDiffSize(t time.Time, productId string, sizeSell float64, sizeBuy float64, price float64) {
-	sizeSellByBuy := sizeSell / sizeBuy
-	sizeBuyBySell := sizeBuy / sizeSell
+	sizeSellByBuy := ratio(sizeSell, sizeBuy)
+	sizeBuyBySell := ratio(sizeBuy, sizeSell)
 	GetLoggerInstance().Info("Algo/Run - IndexDiffSize - sizeSellByBuy: %f, sizeBuyBySell: %f", sizeSellByBuy, sizeBuyBySell)
-	GetLoggerInstance().Info("Algo/Run - IndexDiffSize - sizeSellByBuy: %f", sizeSellByBuy)
-	GetLoggerInstance().Info("Algo/Run - IndexDiffSize - sizeSellByBuy: %s", strconv.FormatFloat(sizeSellByBuy, 'E', -1, 64) )
-	GetLoggerInstance().Info("Algo/Run - IndexDiffSize - sizeBuyBySellStr: %s", strconv.FormatFloat(sizeBuyBySell, 'E', -1, 64))
+	doc := DiffSizeDocument{ES_SCHEMA_VERSION, esTime(t), productId, sizeSellByBuy, sizeBuyBySell, price}
+	elasticClient.indexDocument("/"+elasticClient.esDiffSizeIndex+"/orders", doc, "IndexDiffSize")
+}
+
+func (elasticClient *ElasticClient) IndexSubSize(t time.Time, productId string, sizeSell float64, sizeBuy float64, price float64) {
+	doc := SubSizeDocument{ES_SCHEMA_VERSION, esTime(t), productId, sizeSell - sizeBuy, price}
+	elasticClient.indexDocument("/"+elasticClient.esSubSizeIndex+"/orders", doc, "IndexSubSize")
+}
+
+// Fills of productId indexed in paper trading, oldest first
+func (elasticClient *ElasticClient) ListFillOrders(productId string) ([]FillDocument, error) {
 	requestBody := `{
-				"time": "` + t.Format(time.RFC3339) + `",
-				"product_id": "` + productId + `",
-				"diff_size_sell_by_buy": "` + strconv.FormatFloat(sizeSellByBuy, 'E', -1, 64) + `",
-				"diff_size_buy_by_sell": "` + strconv.FormatFloat(sizeBuyBySell, 'E', -1, 64) + `",
-				"price": "` + strconv.FormatFloat(price, 'E', -1, 64) + `"
-				}`
-	resource := "/" + elasticClient.esDiffSizeIndex + "/orders"
-	//GetLoggerInstance().Error("In elastic-client/IndexDiffSize - size: %f, price: %f ", size, price)
-	resp := elasticClient.operation("POST", requestBody, resource)
+		"size": 500,
+		"query": { "term": { "product_id": "` + productId + `" } },
+		"sort": [ { "fillTime": { "order": "asc" } } ]
+	}`
+	var fills []FillDocument
+	err := elasticClient.scroll(elasticClient.esFillIndex, requestBody, func(hits []RawHitType) error {
+		for _, hit := range hits {
+			fill := FillDocument{}
+			if err := json.Unmarshal(hit.Source, &fill); err != nil {
+				return err
+			}
+			fills = append(fills, fill)
+		}
+		return nil
+	})
+	return fills, err
+}
+
+// Matches of productId since from, oldest first, at most size. Without daily indices, the matches are read from the per
+// side indices, the main one has no side
+func (elasticClient *ElasticClient) ListMatches(productId string, from time.Time, size int) ([]MatchDocument, error) {
+	requestBody := `{
+		"size": ` + strconv.Itoa(size) + `,
+		"query": { "bool": { "filter": [
+			{ "term": { "product_id": "` + productId + `" } },
+			{ "range": { "matchTime": { "gte": "` + esTime(from).Format(time.RFC3339Nano) + `" } } }
+		] } },
+		"sort": [ { "matchTime": { "order": "asc" } } ]
+	}`
+	index := elasticClient.matchSearchIndex(productId, "")
+	if !elasticClient.dailyIndices {
+		index = elasticClient.matchSearchIndex(productId, "buy") + "," + elasticClient.matchSearchIndex(productId, "sell")
+	}
+	resp, err := elasticClient.request("GET", requestBody, "/"+index+"/orders/_search?ignore_unavailable=true")
+	if err != nil {
+		return nil, err
+	}
+	response := &RawHitsResponse{}
+	if err := json.Unmarshal([]byte(resp), response); err != nil {
+		return nil, err
+	}
+	matches := make([]MatchDocument, 0, len(response.Hits.Hits))
+	for _, hit := range response.Hits.Hits {
+		match := MatchDocument{}
+		if err := json.Unmarshal(hit.Source, &match); err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// Index name(s) to search matches of productId (all products if empty) and side (all sides if empty)
+func (elasticClient *ElasticClient) matchSearchIndex(productId string, side string) string {
+	if elasticClient.dailyIndices {
+		if productId == "" {
+			return elasticClient.esMatchIndex + "-*-" + DAILY_INDEX_PATTERN
+		}
+		return elasticClient.esMatchIndex + "-" + strings.ToLower(productId) + "-" + DAILY_INDEX_PATTERN
+	}
+	if side != "" {
+		return elasticClient.esMatchIndex + "_" + side
+	}
+	return elasticClient.esMatchIndex
+}
+
+func (elasticClient *ElasticClient) dailyMatchIndex(productId string, t time.Time) string {
+	return elasticClient.esMatchIndex + "-" + strings.ToLower(productId) + "-" + t.UTC().Format(DAILY_INDEX_FORMAT)
+}
+
+func (elasticClient *ElasticClient) barIndex(productId string, t time.Time) string {
+	return elasticClient.esBarIndex + "-" + strings.ToLower(productId) + "-" + t.UTC().Format(MONTHLY_INDEX_FORMAT)
+}
+
+// Marshal the document and POST it to resource (/<index>/<type> or /<index>/<type>/<id>)
+func (elasticClient *ElasticClient) indexDocument(resource string, doc interface{}, caller string) {
+	requestBody, err := json.Marshal(doc)
+	if err != nil {
+		GetLoggerInstance().Error("In elastic-client/%s. Failed marshaling document: %s", caller, err.Error())
+		return
+	}
+	resp := elasticClient.operation("POST", string(requestBody), resource)
 
 	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/IndexDiffSize. Response NIL")
+		GetLoggerInstance().Error("In elastic-client/%s. Response NIL", caller)
 		os.Exit(1)
 	}
 }
 
-func (elasticClient *ElasticClient) IndexSubSize(t time.Time, productId string, sizeSell float64, sizeBuy float64, price float64) {
-	sizeSellByBuy := sizeSell - sizeBuy
+// Dates are stored in UTC with a millisecond precision
+func esTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// JSON can't encode +Inf or NaN, a ratio with a null denominator is stored as 0
+func ratio(numerator float64, denominator float64) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
+
+// Convert documents written with string encoded numbers (schema version 1) to the current schema version.
+// Each document is rewritten in place, with the same id. A document with a number that can't be parsed is left
+// unchanged, in its schema version, and counted as failed. Returns the number of documents converted.
+func (elasticClient *ElasticClient) Reindex(index string) int {
 	requestBody := `{
-				"time": "` + t.Format(time.RFC3339) + `",
-				"product_id": "` + productId + `",
-				"sub_size_sell_by_buy": "` + strconv.FormatFloat(sizeSellByBuy, 'E', -1, 64) + `",
-				"price": "` + strconv.FormatFloat(price, 'E', -1, 64) + `"
-				}`
-	resource := "/" + elasticClient.esSubSizeIndex + "/orders"
-	//GetLoggerInstance().Error("In elastic-client/IndexDiffSize - size: %f, price: %f ", size, price)
-	resp := elasticClient.operation("POST", requestBody, resource)
+		"size": 500,
+		"query": {
+			"bool": {
+				"must_not": { "term": { "schema_version": ` + strconv.Itoa(ES_SCHEMA_VERSION) + ` } }
+			}
+		}
+	}`
+	var nbDocs, nbFailed = 0, 0
+	err := elasticClient.scroll(index, requestBody, func(hits []RawHitType) error {
+		var items []BulkItem
+		for _, hit := range hits {
+			source := map[string]interface{}{}
+			if err := json.Unmarshal(hit.Source, &source); err != nil {
+				GetLoggerInstance().Error("In elastic-client/Reindex. Failed unmarshaling document %s: %s", hit.Id, err.Error())
+				nbFailed++
+				continue
+			}
+			if err := convertNumericFields(source); err != nil {
+				GetLoggerInstance().Error("In elastic-client/Reindex. Document %s left unchanged: %s", hit.Id, err.Error())
+				nbFailed++
+				continue
+			}
+			source["schema_version"] = ES_SCHEMA_VERSION
+			items = append(items, BulkItem{hit.Index, hit.Type, hit.Id, source})
+		}
+		nbDocs += len(items)
+		return elasticClient.bulk(items)
+	})
+	if err != nil {
+		GetLoggerInstance().Error("In elastic-client/Reindex. %s: %s", index, err.Error())
+	}
+	GetLoggerInstance().Info("Reindex %s: %d documents converted, %d failed", index, nbDocs, nbFailed)
+	return nbDocs
+}
 
-	if resp == "" {
-		GetLoggerInstance().Error("In elastic-client/IndexSubSize. Response NIL")
-		os.Exit(1)
+// Parse the numeric fields stored as strings, source is unchanged on error
+func convertNumericFields(source map[string]interface{}) error {
+	values := map[string]float64{}
+	for _, field := range numericFields {
+		if str, ok := source[field].(string); ok {
+			value, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return fmt.Errorf("field %s: %s", field, err.Error())
+			}
+			values[field] = value
+		}
+	}
+	for field, value := range values {
+		source[field] = value
 	}
+	return nil
+}
+
+// Reindex all the indices written by the bot
+func (elasticClient *ElasticClient) ReindexAll() {
+	indices := []string{elasticClient.esMatchIndex, elasticClient.esMatchIndex + "_buy", elasticClient.esMatchIndex + "_sell",
+		elasticClient.esFillIndex, elasticClient.esDiffSizeIndex, elasticClient.esSubSizeIndex}
+	if elasticClient.dailyIndices {
+		indices = append(indices, elasticClient.matchSearchIndex("", ""))
+	}
+	for _, index := range indices {
+		elasticClient.Reindex(index)
+	}
+}
+
+// Delete the duplicated matches of index (a match index, pattern allowed), keeping one document by trade.
+// Matches are identified by product and trade id, or by product, time, price, size and side when indexed without trade id.
+// Returns the number of documents deleted
+func (elasticClient *ElasticClient) Dedupe(index string) int {
+	if !elasticClient.isMatchIndex(index) {
+		GetLoggerInstance().Error("In elastic-client/Dedupe. %s is not a match index of %s, not deduped", index, elasticClient.esMatchIndex)
+		return 0
+	}
+	// Duplicates have the same matchTime: sorted by time, the keys are only compared within a time
+	requestBody := `{
+		"size": 1000,
+		"sort": [ { "matchTime": { "order": "asc" } } ]
+	}`
+	var window string // matchTime of the keys in seen
+	seen := map[string]bool{}
+	var nbDocs = 0
+	err := elasticClient.scroll(index, requestBody, func(hits []RawHitType) error {
+		var items []BulkItem
+		for _, hit := range hits {
+			source := map[string]interface{}{}
+			if err := json.Unmarshal(hit.Source, &source); err != nil {
+				GetLoggerInstance().Error("In elastic-client/Dedupe. Failed unmarshaling document %s: %s", hit.Id, err.Error())
+				continue
+			}
+			if matchTime := fmt.Sprint(source["matchTime"]); matchTime != window {
+				window = matchTime
+				seen = map[string]bool{}
+			}
+			// Numbers are compared as stored, run reindex first on the documents of schema version 1
+			key := fmt.Sprintf("%s|%v|%v", hit.Index, source["product_id"], source["trade_id"])
+			if source["trade_id"] == nil {
+				key = fmt.Sprintf("%s|%v|%v|%v|%v", hit.Index, source["product_id"], source["price"], source["size"], source["side"])
+			}
+			if seen[key] {
+				items = append(items, BulkItem{hit.Index, hit.Type, hit.Id, nil})
+				continue
+			}
+			seen[key] = true
+		}
+		nbDocs += len(items)
+		return elasticClient.bulk(items)
+	})
+	if err != nil {
+		GetLoggerInstance().Error("In elastic-client/Dedupe. %s: %s", index, err.Error())
+	}
+	GetLoggerInstance().Info("Dedupe %s: %d documents deleted", index, nbDocs)
+	return nbDocs
+}
+
+// esMatchIndex, its side and venue indices, its daily indices, or a pattern of them
+func (elasticClient *ElasticClient) isMatchIndex(index string) bool {
+	return index == elasticClient.esMatchIndex || strings.HasPrefix(index, elasticClient.esMatchIndex+"_") ||
+		strings.HasPrefix(index, elasticClient.esMatchIndex+"-")
+}
+
+// Dedupe all the match indices, of the main exchange and of the venues
+func (elasticClient *ElasticClient) DedupeAll() {
+	clients := []*ElasticClient{elasticClient}
+	for _, venue := range GetConfigInstance().Divergence.Venues {
+		clients = append(clients, elasticClient.ForVenue(venue.name()))
+	}
+	for _, client := range clients {
+		if client.dailyIndices {
+			client.Dedupe(client.matchSearchIndex("", ""))
+			continue
+		}
+		for _, index := range []string{client.esMatchIndex, client.esMatchIndex + "_buy", client.esMatchIndex + "_sell"} {
+			client.Dedupe(index)
+		}
+	}
+}
+
+// Fields stored as strings in schema version 1
+var numericFields = []string{"size", "price", "diff_size_sell_by_buy", "diff_size_buy_by_sell", "sub_size_sell_by_buy"}
+
+// Iterate over all the documents matching requestBody, page by page. Stops at the first error
+func (elasticClient *ElasticClient) scroll(index string, requestBody string, handle func(hits []RawHitType) error) error {
+	resp, err := elasticClient.request("POST", requestBody, "/"+index+"/_search?scroll=1m")
+	for err == nil {
+		esResponse := &RawHitsResponse{}
+		if err = json.Unmarshal([]byte(resp), esResponse); err != nil {
+			return err
+		}
+		if len(esResponse.Hits.Hits) == 0 || esResponse.ScrollId == "" {
+			return nil
+		}
+		if err = handle(esResponse.Hits.Hits); err != nil {
+			return err
+		}
+		resp, err = elasticClient.request("POST", `{"scroll": "1m", "scroll_id": "`+esResponse.ScrollId+`"}`, "/_search/scroll")
+	}
+	return err
+}
+
+type BulkItem struct {
+	Index string
+	Type  string
+	Id    string      // Generated by Elasticsearch if empty
+	Doc   interface{} // The document with Id is deleted if nil
+}
+
+// Index or delete documents in one request
+func (elasticClient *ElasticClient) bulk(items []BulkItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var requestBody strings.Builder
+	for _, item := range items {
+		meta := map[string]string{"_index": item.Index, "_type": item.Type}
+		if item.Id != "" {
+			meta["_id"] = item.Id
+		}
+		if item.Doc == nil {
+			action, _ := json.Marshal(map[string]interface{}{"delete": meta})
+			requestBody.Write(action)
+			requestBody.WriteString("\n")
+			continue
+		}
+		action, _ := json.Marshal(map[string]interface{}{"index": meta})
+		doc, err := json.Marshal(item.Doc)
+		if err != nil {
+			return err
+		}
+		requestBody.Write(action)
+		requestBody.WriteString("\n")
+		requestBody.Write(doc)
+		requestBody.WriteString("\n")
+	}
+	resp, err := elasticClient.request("POST", requestBody.String(), "/_bulk")
+	if err != nil {
+		return err
+	}
+	bulkResponse := &BulkResponse{}
+	if err := json.Unmarshal([]byte(resp), bulkResponse); err != nil {
+		return err
+	}
+	if bulkResponse.Errors {
+		return &ESError{"POST", "/_bulk", 200, "Some documents were not indexed"}
+	}
+	return nil
+}
+
+// Names of the indices matching pattern
+func (elasticClient *ElasticClient) listIndices(pattern string) ([]string, error) {
+	resp, err := elasticClient.request("GET", "", "/_cat/indices/"+pattern+"?format=json&h=index")
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Index string `json:"index"`
+	}
+	if err := json.Unmarshal([]byte(resp), &rows); err != nil {
+		return nil, err
+	}
+	var indices []string
+	for _, row := range rows {
+		indices = append(indices, row.Index)
+	}
+	return indices, nil
+}
+
+func (elasticClient *ElasticClient) deleteIndex(index string) error {
+	_, err := elasticClient.request("DELETE", "", "/"+index)
+	return err
 }
@@ -2,14 +2,17 @@ package nibiru
 
 import (
 	"encoding/json"
+	"time"
 )
 
+const ES_SCHEMA_VERSION int = 2 // Version 1: numbers stored as 'E' formatted strings
+
 type ESResponse struct {
-	Took         int              `json:"took"`
-	TimeOut      bool             `json:"timed_out"`
-	Shards       ShardsType       `json:"_shards"`
-	Hits         HitsType         `json:"hits"`
-	Aggregations AggregationsType `json:"aggregations"`
+	Took     int        `json:"took"`
+	TimeOut  bool       `json:"timed_out"`
+	Shards   ShardsType `json:"_shards"`
+	Hits     HitsType   `json:"hits"`
+	ScrollId string     `json:"_scroll_id"`
 }
 
 type ShardsType struct {
@@ -33,31 +36,154 @@ type HitsArrayType struct {
 }
 
 type SourceType struct {
-	MatchTime string  `json:"matchTime"`
-	ProductId string  `json:"product_id"`
-	Size      float64 `json:"size,string"`
-	Price     float64 `json:"price,string"`
-	Side      string  `json:"side"`
+	SchemaVersion int     `json:"schema_version"`
+	MatchTime     string  `json:"matchTime"`
+	ProductId     string  `json:"product_id"`
+	Size          float64 `json:"size"`
+	Price         float64 `json:"price"`
+	Side          string  `json:"side"`
+}
+
+// Hits whose source is kept raw, used when documents of any schema version are read (reindex)
+type RawHitsResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []RawHitType `json:"hits"`
+	} `json:"hits"`
+}
+
+type RawHitType struct {
+	Index  string          `json:"_index"`
+	Type   string          `json:"_type"`
+	Id     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+type BulkResponse struct {
+	Took   int  `json:"took"`
+	Errors bool `json:"errors"`
+}
+
+// Response of a TimeSeriesQuery, metrics are read by name from each bucket
+type ESSeriesResponse struct {
+	Aggregations struct {
+		Series struct {
+			Buckets []map[string]json.RawMessage `json:"buckets"`
+		} `json:"series"`
+	} `json:"aggregations"`
+}
+
+type ValueType struct {
+	Value *float64 `json:"value"` // null when the bucket is empty
+}
+
+type PercentilesType struct {
+	Values map[string]*float64 `json:"values"`
+}
+
+// Documents indexed by ElasticClient
+
+type MatchDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	MatchTime     time.Time `json:"matchTime"`
+	ProductId     string    `json:"product_id"`
+	Size          float64   `json:"size"`
+	Price         float64   `json:"price"`
+	Side          string    `json:"side,omitempty"`
+	Venue         string    `json:"venue,omitempty"`    // Empty for the main exchange
+	TradeId       int       `json:"trade_id,omitempty"` // Part of the document id, 0 when unknown
+}
+
+type FillDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	FillTime      time.Time `json:"fillTime"`
+	ProductId     string    `json:"product_id"`
+	Size          float64   `json:"size"`
+	Price         float64   `json:"price"`
+	Side          string    `json:"side"`
+	Fee           float64   `json:"fee"` // In currency
+}
+
+type DiffSizeDocument struct {
+	SchemaVersion     int       `json:"schema_version"`
+	Time              time.Time `json:"time"`
+	ProductId         string    `json:"product_id"`
+	DiffSizeSellByBuy float64   `json:"diff_size_sell_by_buy"`
+	DiffSizeBuyBySell float64   `json:"diff_size_buy_by_sell"`
+	Price             float64   `json:"price"`
+}
+
+type SubSizeDocument struct {
+	SchemaVersion    int       `json:"schema_version"`
+	Time             time.Time `json:"time"`
+	ProductId        string    `json:"product_id"`
+	SubSizeSellByBuy float64   `json:"sub_size_sell_by_buy"`
+	Price            float64   `json:"price"`
+}
+
+// OHLCV bar, Time is the start of the bar
+// Buy and sell volumes are computed from the side of the matches, which is the maker side
+type BarDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	ProductId     string    `json:"product_id"`
+	Interval      string    `json:"interval"`
+	Open          float64   `json:"open"`
+	High          float64   `json:"high"`
+	Low           float64   `json:"low"`
+	Close         float64   `json:"close"`
+	Volume        float64   `json:"volume"`
+	BuyVolume     float64   `json:"buy_volume"`
+	SellVolume    float64   `json:"sell_volume"`
+	TradeCount    int       `json:"trade_count"`
 }
 
-type AggregationsType struct {
-	PriceRanges PriceRangesType `json:"price_ranges"`
+type RiskRejectionDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	ProductId     string    `json:"product_id"`
+	Side          string    `json:"side"`
+	Price         float64   `json:"price"`
+	Size          float64   `json:"size"`
+	Reason        string    `json:"reason"`
 }
 
-type PriceRangesType struct {
-	Buckets []BucketsType `json:"buckets"`
+type DivergenceDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	ProductIdA    string    `json:"product_id_a"`
+	ProductIdB    string    `json:"product_id_b"`
+	VenueA        string    `json:"venue_a"`
+	VenueB        string    `json:"venue_b"`
+	PriceA        float64   `json:"price_a"`
+	PriceB        float64   `json:"price_b"`
+	PriceSpread   float64   `json:"price_spread"` // (b - a) / a, in %
+	VwapA         float64   `json:"vwap_a"`
+	VwapB         float64   `json:"vwap_b"`
+	VwapSpread    float64   `json:"vwap_spread"`
+	BuyVolumeA    float64   `json:"buy_volume_a"`
+	SellVolumeA   float64   `json:"sell_volume_a"`
+	BuyVolumeB    float64   `json:"buy_volume_b"`
+	SellVolumeB   float64   `json:"sell_volume_b"`
 }
 
-type BucketsType struct {
-	Key          string      `json:"key"`
-	From         json.Number `json:"from,Number"`
-	FromAsString string      `json:"from_as_string"`
-	To           json.Number `json:"to,Number"`
-	ToAsString   string      `json:"to_as_string"`
-	DocCount     int         `json:"doc_count"`
-	Result       ResultType  `json:"result"`
+type ArbitrageDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	BuyVenue      string    `json:"buy_venue"`
+	SellVenue     string    `json:"sell_venue"`
+	BuyPrice      float64   `json:"buy_price"`
+	SellPrice     float64   `json:"sell_price"`
+	GrossSpread   float64   `json:"gross_spread"`
+	NetSpread     float64   `json:"net_spread"`
 }
 
-type ResultType struct {
-	Value float64 `json:"value"`
+type AlertDocument struct {
+	SchemaVersion int       `json:"schema_version"`
+	Time          time.Time `json:"time"`
+	ProductId     string    `json:"product_id"`
+	Source        string    `json:"source"`
+	Item          string    `json:"item"`
+	Believed      float64   `json:"believed"`
+	Actual        float64   `json:"actual"`
 }
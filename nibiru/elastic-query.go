@@ -0,0 +1,186 @@
+package nibiru
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	METRIC_SUM         string = "sum"
+	METRIC_AVG         string = "avg"
+	METRIC_MIN         string = "min"
+	METRIC_MAX         string = "max"
+	METRIC_PERCENTILES string = "percentiles"
+	METRIC_VWAP        string = "vwap" // Volume weighted average price: sum(price * size) / sum(size)
+)
+
+type Metric struct {
+	Name     string // Key of the value in TimeSeriesBucket.Values
+	Type     string // One of the METRIC_* constants
+	Field    string // Ignored by vwap
+	Percents []float64
+}
+
+// Matches in [From, To), aggregated in one bucket or, if Interval is set, in a date histogram
+type TimeSeriesQuery struct {
+	From      time.Time
+	To        time.Time
+	Interval  string // date_histogram interval, ex: 1m, 5m, 1h
+	Metrics   []Metric
+	Side      string // Optional
+	ProductId string // Optional
+}
+
+type TimeSeriesBucket struct {
+	Time     time.Time
+	DocCount int
+	// Metrics of the bucket, by name. Percentiles are named <name>_<percent>, ex: price_99.9
+	// Metrics without value (empty bucket) are missing
+	Values map[string]float64
+}
+
+type TimeSeriesResult struct {
+	Buckets []TimeSeriesBucket
+}
+
+// Value of the metric in the last bucket, 0 if there is no bucket or no value
+func (result *TimeSeriesResult) Value(name string) float64 {
+	if len(result.Buckets) == 0 {
+		return 0
+	}
+	return result.Buckets[len(result.Buckets)-1].Values[name]
+}
+
+func (elasticClient *ElasticClient) Query(query TimeSeriesQuery) (*TimeSeriesResult, error) {
+	index := elasticClient.matchSearchIndex(query.ProductId, query.Side)
+	requestBody, err := json.Marshal(buildSeriesRequest(query))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := elasticClient.request("GET", string(requestBody), "/"+index+"/_search")
+	if err != nil {
+		return nil, err
+	}
+
+	esResponse := &ESSeriesResponse{}
+	if err := json.Unmarshal([]byte(resp), esResponse); err != nil {
+		return nil, &ESError{"GET", "/" + index + "/_search", 200, "Failed unmarshaling response: " + err.Error()}
+	}
+	result := &TimeSeriesResult{}
+	for _, rawBucket := range esResponse.Aggregations.Series.Buckets {
+		bucket, err := parseSeriesBucket(query, rawBucket)
+		if err != nil {
+			return nil, &ESError{"GET", "/" + index + "/_search", 200, "Failed unmarshaling bucket: " + err.Error()}
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	return result, nil
+}
+
+func buildSeriesRequest(query TimeSeriesQuery) map[string]interface{} {
+	filters := []interface{}{
+		map[string]interface{}{"range": map[string]interface{}{"matchTime": map[string]interface{}{
+			"gte": query.From.UnixNano() / int64(time.Millisecond), "lt": query.To.UnixNano() / int64(time.Millisecond), "format": "epoch_millis"}}},
+	}
+	if query.Side != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"side": query.Side}})
+	}
+	if query.ProductId != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"product_id": query.ProductId}})
+	}
+
+	metrics := map[string]interface{}{}
+	for _, metric := range query.Metrics {
+		switch metric.Type {
+		case METRIC_PERCENTILES:
+			metrics[metric.Name] = map[string]interface{}{metric.Type: map[string]interface{}{"field": metric.Field, "percents": metric.Percents}}
+		case METRIC_VWAP:
+			metrics[metric.Name+"_pv"] = map[string]interface{}{"sum": map[string]interface{}{"script": map[string]interface{}{
+				"source": "doc['price'].value * doc['size'].value", "lang": "painless"}}}
+			metrics[metric.Name+"_v"] = map[string]interface{}{"sum": map[string]interface{}{"field": "size"}}
+		default:
+			metrics[metric.Name] = map[string]interface{}{metric.Type: map[string]interface{}{"field": metric.Field}}
+		}
+	}
+
+	var series map[string]interface{}
+	if query.Interval != "" {
+		series = map[string]interface{}{"date_histogram": map[string]interface{}{
+			"field":         "matchTime",
+			"interval":      query.Interval,
+			"min_doc_count": 0,
+			"extended_bounds": map[string]interface{}{ // Return empty buckets on the whole range
+				"min": query.From.UnixNano() / int64(time.Millisecond),
+				"max": query.To.UnixNano()/int64(time.Millisecond) - 1,
+			},
+		}}
+	} else {
+		series = map[string]interface{}{"range": map[string]interface{}{
+			"field":  "matchTime",
+			"ranges": []interface{}{map[string]interface{}{"from": query.From.UnixNano() / int64(time.Millisecond), "to": query.To.UnixNano() / int64(time.Millisecond)}},
+		}}
+	}
+	series["aggs"] = metrics
+
+	return map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": filters}},
+		"aggs":  map[string]interface{}{"series": series},
+	}
+}
+
+func parseSeriesBucket(query TimeSeriesQuery, rawBucket map[string]json.RawMessage) (TimeSeriesBucket, error) {
+	bucket := TimeSeriesBucket{Values: map[string]float64{}}
+	var key float64 // Start of the bucket in ms
+	if query.Interval != "" {
+		if err := json.Unmarshal(rawBucket["key"], &key); err != nil {
+			return bucket, err
+		}
+	} else {
+		if err := json.Unmarshal(rawBucket["from"], &key); err != nil {
+			return bucket, err
+		}
+	}
+	bucket.Time = time.Unix(0, int64(key)*int64(time.Millisecond))
+	if err := json.Unmarshal(rawBucket["doc_count"], &bucket.DocCount); err != nil {
+		return bucket, err
+	}
+
+	for _, metric := range query.Metrics {
+		switch metric.Type {
+		case METRIC_PERCENTILES:
+			percentiles := PercentilesType{}
+			if err := json.Unmarshal(rawBucket[metric.Name], &percentiles); err != nil {
+				return bucket, err
+			}
+			for percent, value := range percentiles.Values {
+				p, err := strconv.ParseFloat(percent, 64)
+				if err != nil || value == nil {
+					continue
+				}
+				bucket.Values[metric.Name+"_"+strconv.FormatFloat(p, 'f', -1, 64)] = *value
+			}
+		case METRIC_VWAP:
+			pv, v := ValueType{}, ValueType{}
+			if err := json.Unmarshal(rawBucket[metric.Name+"_pv"], &pv); err != nil {
+				return bucket, err
+			}
+			if err := json.Unmarshal(rawBucket[metric.Name+"_v"], &v); err != nil {
+				return bucket, err
+			}
+			if pv.Value != nil && v.Value != nil && *v.Value != 0 {
+				bucket.Values[metric.Name] = *pv.Value / *v.Value
+			}
+		default:
+			value := ValueType{}
+			if err := json.Unmarshal(rawBucket[metric.Name], &value); err != nil {
+				return bucket, err
+			}
+			if value.Value != nil {
+				bucket.Values[metric.Name] = *value.Value
+			}
+		}
+	}
+	return bucket, nil
+}
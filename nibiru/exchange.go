@@ -0,0 +1,363 @@
+package nibiru
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+// Values of Config.Exchange
+const (
+	EXCHANGE_GDAX     string = "gdax"     // Legacy GDAX / Coinbase Pro API (default)
+	EXCHANGE_COINBASE string = "coinbase" // Coinbase Advanced Trade API
+	EXCHANGE_BINANCE  string = "binance"  // Binance spot API
+)
+
+// Trades fetched at most to fill a gap of the websocket feed, the oldest ones are lost beyond
+const BACKFILL_MAX_TRADES int = 10000
+
+// Operations of an exchange used by GdaxClient, the Reconciler and the accounting.
+// Product ids, sides ("buy", "sell") and order statuses ("open", "done") use the GDAX vocabulary,
+// errors are *APIError
+type Exchange interface {
+	GetProduct(productId string) (Product, error)
+	GetAccounts() ([]api.Account, error)
+	ListFills(productId string) ([]Fill, error) // Settled fills, in any order
+	ListOrders(productId string, status string) ([]api.Order, error)
+	// Order created by the client with clientOid since the given time. nil if the exchange doesn't know it
+	GetOrderByClientOid(productId string, clientOid string, since time.Time) (*api.Order, error)
+	CreateOrder(order *api.Order) (api.Order, error) // Market or limit order, with its ClientOID
+	CancelOrder(productId string, orderId string) error
+	GetTicker(productId string) (ask float64, bid float64, err error)
+	Feed() Feed
+}
+
+// Websocket market data of an exchange
+type Feed interface {
+	URL() string
+	Subscribe(conn *ws.Conn, productId string) error
+	// Websocket message to messages of the GDAX feed: trades are "match" messages, the acknowledgement of the
+	// subscriptions a "subscriptions" message and failures "error" messages.
+	// The "heartbeat" messages have the last_trade_id of their product in TradeId, if the exchange gives it
+	Decode(data []byte) ([]FeedMessage, error)
+	// Matches after lastTradeId through the REST API, oldest first. Empty if the feed has no REST URL
+	Backfill(productId string, lastTradeId int) ([]api.Message, error)
+}
+
+// Message of a feed, with the fields of the ticker and status channels missing in api.Message
+type FeedMessage struct {
+	api.Message
+	BestBid  float64
+	BestAsk  float64
+	Products []ProductStatus // Of a "status" message
+}
+
+// Trading status of a product, from the status channel
+type ProductStatus struct {
+	Id              string `json:"id"`
+	Status          string `json:"status"` // online, offline, delisted...
+	StatusMessage   string `json:"status_message"`
+	TradingDisabled bool   `json:"trading_disabled"`
+	CancelOnly      bool   `json:"cancel_only"`
+	PostOnly        bool   `json:"post_only"`
+	LimitOnly       bool   `json:"limit_only"`
+}
+
+func NewExchange() Exchange {
+	switch GetConfigInstance().Exchange {
+	case "", EXCHANGE_GDAX:
+		return &gdaxExchange{initClient()}
+	case EXCHANGE_COINBASE:
+		return newCoinbaseExchange()
+	case EXCHANGE_BINANCE:
+		return newBinanceExchange()
+	}
+	GetLoggerInstance().Error("In exchange/NewExchange. Incorrect value of exchange: %s. Values accepted: %s, %s, %s", GetConfigInstance().Exchange, EXCHANGE_GDAX, EXCHANGE_COINBASE, EXCHANGE_BINANCE)
+	os.Exit(1)
+	return nil
+}
+
+// Public market data of another exchange, without account. Gaps are not backfilled if baseURL is empty
+func newFeed(exchange string, url string, baseURL string) Feed {
+	httpClient := &http.Client{Transport: getRestTransport(exchange)}
+	baseURL = strings.TrimRight(baseURL, "/")
+	switch exchange {
+	case EXCHANGE_COINBASE:
+		return &coinbaseFeed{&coinbaseExchange{baseURL: baseURL, httpClient: httpClient}, url, "", 0}
+	case EXCHANGE_BINANCE:
+		return &binanceFeed{url, &binanceExchange{baseURL: baseURL, httpClient: httpClient}, nil}
+	}
+	if baseURL == "" {
+		return &gdaxFeed{url, nil, nil}
+	}
+	return &gdaxFeed{url, &api.Client{BaseURL: baseURL, HttpClient: httpClient}, nil}
+}
+
+var restTransports = map[string]*restTransport{}
+var restTransportsMutex sync.Mutex
+
+// One by exchange, shared by all its clients, so that its rate limits apply to the whole process
+func getRestTransport(exchange string) *restTransport {
+	if exchange == "" {
+		exchange = EXCHANGE_GDAX
+	}
+	restTransportsMutex.Lock()
+	defer restTransportsMutex.Unlock()
+	if _, ok := restTransports[exchange]; !ok {
+		restTransports[exchange] = newRestTransport(restLimitsOf(exchange))
+	}
+	return restTransports[exchange]
+}
+
+func initClient() api.Client {
+	return api.Client{
+		BaseURL:    GetConfigInstance().BaseURL,
+		Secret:     GetConfigInstance().Account.Secret,
+		Key:        GetConfigInstance().Account.Key,
+		Passphrase: GetConfigInstance().Account.Passphrase,
+		HttpClient: &http.Client{Transport: getRestTransport(EXCHANGE_GDAX)},
+	}
+}
+
+// Legacy GDAX API, through go-coinbase-exchange
+type gdaxExchange struct {
+	client api.Client
+}
+
+// GET /products/<product-id>
+func (gdax *gdaxExchange) GetProduct(productId string) (Product, error) {
+	product := Product{}
+	if _, err := gdax.client.Request("GET", "/products/"+productId, nil, &product); err != nil {
+		return product, restError("GET /products/"+productId, err)
+	}
+	return product, nil
+}
+
+// GET /accounts
+func (gdax *gdaxExchange) GetAccounts() ([]api.Account, error) {
+	accounts, err := gdax.client.GetAccounts()
+	if err != nil {
+		return nil, restError("GET /accounts", err)
+	}
+	return accounts, nil
+}
+
+// GET /fills
+func (gdax *gdaxExchange) ListFills(productId string) ([]Fill, error) {
+	var fills []Fill
+	var page []api.Fill
+	cursor := gdax.client.ListFills(api.ListFillsParams{ProductId: productId})
+	for cursor.HasMore {
+		if err := cursor.NextPage(&page); err != nil {
+			return nil, restError("GET /fills", err)
+		}
+		for _, f := range page {
+			if f.Settled {
+				fills = append(fills, Fill{f.CreatedAt.Time(), f.Side, f.Price, f.Size, f.Fee})
+			}
+		}
+	}
+	return fills, nil
+}
+
+// GET /orders
+func (gdax *gdaxExchange) ListOrders(productId string, status string) ([]api.Order, error) {
+	var orders, page []api.Order
+	cursor := gdax.client.ListOrders(api.ListOrdersParams{Status: status})
+	for cursor.HasMore {
+		if err := cursor.NextPage(&page); err != nil {
+			return nil, restError("GET /orders", err)
+		}
+		for _, o := range page {
+			if o.ProductId == productId {
+				orders = append(orders, o)
+			}
+		}
+	}
+	return orders, nil
+}
+
+// GET /orders/client:<client_oid>
+func (gdax *gdaxExchange) GetOrderByClientOid(productId string, clientOid string, since time.Time) (*api.Order, error) {
+	var order api.Order
+	res, err := gdax.client.Request("GET", "/orders/client:"+clientOid, nil, &order)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, restError("GET /orders/client:"+clientOid, err)
+	}
+	return &order, nil
+}
+
+// POST /orders
+func (gdax *gdaxExchange) CreateOrder(order *api.Order) (api.Order, error) {
+	savedOrder, err := gdax.client.CreateOrder(order)
+	if err != nil {
+		return savedOrder, restError("POST /orders", err)
+	}
+	return savedOrder, nil
+}
+
+// DELETE /orders/<order-id>
+func (gdax *gdaxExchange) CancelOrder(productId string, orderId string) error {
+	if err := gdax.client.CancelOrder(orderId); err != nil {
+		return restError("DELETE /orders/"+orderId, err)
+	}
+	return nil
+}
+
+// GET /products/<product-id>/ticker
+func (gdax *gdaxExchange) GetTicker(productId string) (ask float64, bid float64, err error) {
+	ticker, err := gdax.client.GetTicker(productId)
+	if err != nil {
+		return 0, 0, restError("GET /products/"+productId+"/ticker", err)
+	}
+	return ticker.Ask, ticker.Bid, nil
+}
+
+func (gdax *gdaxExchange) Feed() Feed {
+	return &gdaxFeed{GetConfigInstance().WssURL, &gdax.client, nil}
+}
+
+// Channels heartbeat and matches for the trades, ticker for the best bid and ask, status for the trading status
+type gdaxFeed struct {
+	url      string
+	client   *api.Client // Backfill, nil to disable it
+	channels []WsChannel // Of the last subscription, checked against its acknowledgement
+}
+
+func (feed *gdaxFeed) URL() string {
+	return feed.url
+}
+
+func (feed *gdaxFeed) Subscribe(conn *ws.Conn, productId string) error {
+	productIds := []string{productId}
+	feed.channels = []WsChannel{{"heartbeat", productIds}, {"matches", productIds}, {"ticker", productIds}, {"status", nil}}
+	return conn.WriteJSON(WsSubscribeMessage{"subscribe", feed.channels})
+}
+
+// Fields missing in api.Message
+type gdaxExtraFields struct {
+	LastTradeId int             `json:"last_trade_id"` // heartbeat
+	BestBid     float64         `json:"best_bid,string"`
+	BestAsk     float64         `json:"best_ask,string"`
+	Products    []ProductStatus `json:"products"`
+	Channels    []WsChannel     `json:"channels"`
+}
+
+func (feed *gdaxFeed) Decode(data []byte) ([]FeedMessage, error) {
+	message := FeedMessage{}
+	if err := json.Unmarshal(data, &message.Message); err != nil {
+		return nil, err
+	}
+	switch message.Type {
+	case "heartbeat", "ticker", "status", "subscriptions":
+		var extra gdaxExtraFields
+		if err := json.Unmarshal(data, &extra); err != nil {
+			return nil, err
+		}
+		if message.Type == "heartbeat" {
+			message.TradeId = extra.LastTradeId
+		}
+		message.BestBid, message.BestAsk = extra.BestBid, extra.BestAsk
+		if message.Type == "status" {
+			message.Products = feed.subscribedStatus(extra.Products)
+		}
+		if message.Type == "subscriptions" {
+			if missing := feed.missingChannels(extra.Channels); missing != "" {
+				return []FeedMessage{{Message: api.Message{Type: "error", Message: "subscription refused: " + missing}}}, nil
+			}
+		}
+	case "error":
+		if message.Reason != "" {
+			message.Message.Message += ": " + message.Reason
+		}
+	}
+	return []FeedMessage{message}, nil
+}
+
+// Statuses of the products subscribed. A product missing from the status channel is delisted
+func (feed *gdaxFeed) subscribedStatus(products []ProductStatus) []ProductStatus {
+	var subscribed []ProductStatus
+	for _, channel := range feed.channels {
+		if channel.Name != "matches" {
+			continue
+		}
+		for _, productId := range channel.ProductIds {
+			status := ProductStatus{Id: productId, Status: "delisted"}
+			for _, product := range products {
+				if product.Id == productId {
+					status = product
+				}
+			}
+			subscribed = append(subscribed, status)
+		}
+	}
+	return subscribed
+}
+
+// Channels and products subscribed but not acknowledged, empty if none
+func (feed *gdaxFeed) missingChannels(acknowledged []WsChannel) string {
+	var missing []string
+	for _, channel := range feed.channels {
+		var products map[string]bool
+		for _, ack := range acknowledged {
+			if ack.Name == channel.Name {
+				products = map[string]bool{}
+				for _, productId := range ack.ProductIds {
+					products[productId] = true
+				}
+			}
+		}
+		if products == nil {
+			missing = append(missing, channel.Name)
+			continue
+		}
+		for _, productId := range channel.ProductIds {
+			if !products[productId] {
+				missing = append(missing, channel.Name+" "+productId)
+			}
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+// GET /products/<product-id>/trades, newest first, paginated with after towards the oldest ones
+func (feed *gdaxFeed) Backfill(productId string, lastTradeId int) ([]api.Message, error) {
+	if feed.client == nil {
+		return nil, nil
+	}
+	var messages []api.Message
+	var page []api.Trade
+	cursor := feed.client.ListTrades(productId)
+	for cursor.HasMore && len(messages) < BACKFILL_MAX_TRADES {
+		if err := cursor.NextPage(&page); err != nil {
+			return nil, restError("GET /products/"+productId+"/trades", err)
+		}
+		for _, trade := range page {
+			if trade.TradeId <= lastTradeId {
+				return reverseMessages(messages), nil
+			}
+			messages = append(messages, api.Message{Type: "match", ProductId: productId, TradeId: trade.TradeId,
+				Time: trade.Time, Price: trade.Price, Size: trade.Size, Side: trade.Side})
+		}
+		if len(page) == 0 {
+			break
+		}
+	}
+	return reverseMessages(messages), nil
+}
+
+func reverseMessages(messages []api.Message) []api.Message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
@@ -0,0 +1,96 @@
+package nibiru
+
+import (
+	"sync"
+)
+
+// State of the websocket feeds, from their connection and status events. The algo pauses while the feed of its product
+// isn't up (disconnected, or stale until it is reconnected and its missed matches backfilled), or while the product
+// doesn't accept its orders (post only, cancel only, delisted...)
+type FeedMonitor struct {
+	mutex    sync.Mutex
+	states   map[string]*ConnectionEvent // Last event by venue and product
+	statuses map[string]*StatusEvent     // Last event by venue and product
+}
+
+var instanceFeedMonitor *FeedMonitor
+var onceFeedMonitor sync.Once
+
+func GetFeedMonitorInstance() *FeedMonitor {
+	onceFeedMonitor.Do(func() {
+		instanceFeedMonitor = &FeedMonitor{states: map[string]*ConnectionEvent{}, statuses: map[string]*StatusEvent{}}
+	})
+	return instanceFeedMonitor
+}
+
+func (monitor *FeedMonitor) OnMarketEvent(event MarketEvent) {
+	switch event := event.(type) {
+	case *ConnectionEvent:
+		monitor.onConnection(event)
+	case *StatusEvent:
+		monitor.onStatus(event)
+	}
+}
+
+func (monitor *FeedMonitor) onConnection(connection *ConnectionEvent) {
+	key := connection.Venue + "/" + connection.ProductId
+	monitor.mutex.Lock()
+	previous := monitor.states[key]
+	monitor.states[key] = connection
+	monitor.mutex.Unlock()
+
+	switch {
+	case connection.State == CONNECTION_STALE:
+		GetLoggerInstance().Error("FeedMonitor - %s %s stale, trading paused until resync: %s", connection.Venue, connection.ProductId, connection.Err)
+	case connection.State == CONNECTION_UP && previous != nil && previous.State != CONNECTION_UP:
+		GetLoggerInstance().Info("FeedMonitor - %s %s resynced, trading resumed", connection.Venue, connection.ProductId)
+	}
+}
+
+func (monitor *FeedMonitor) onStatus(status *StatusEvent) {
+	key := status.Venue + "/" + status.ProductId
+	monitor.mutex.Lock()
+	previous := monitor.statuses[key]
+	monitor.statuses[key] = status
+	monitor.mutex.Unlock()
+
+	restriction := status.Restriction()
+	if previous == nil && restriction == "" || previous != nil && previous.Restriction() == restriction {
+		return
+	}
+	if restriction != "" {
+		GetLoggerInstance().Error("FeedMonitor - %s %s is %s, trading paused: %s", status.Venue, status.ProductId, restriction, status.Message)
+	} else {
+		GetLoggerInstance().Info("FeedMonitor - %s %s is online, trading resumed", status.Venue, status.ProductId)
+	}
+}
+
+// True with the reason while the feed of productId on venue is down or stale. Feeds never connected aren't stale
+func (monitor *FeedMonitor) Stale(venue string, productId string) (bool, string) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	state, ok := monitor.states[venue+"/"+productId]
+	if !ok || state.State == CONNECTION_UP {
+		return false, ""
+	}
+	reason := "feed " + state.State + " since " + state.Time.Format("15:04:05")
+	if state.Err != "" {
+		reason += ": " + state.Err
+	}
+	return true, reason
+}
+
+// True with the reason while the feed of productId is stale, or while the product doesn't accept market orders
+func (monitor *FeedMonitor) Paused(venue string, productId string) (bool, string) {
+	if stale, reason := monitor.Stale(venue, productId); stale {
+		return true, reason
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	if status, ok := monitor.statuses[venue+"/"+productId]; ok {
+		if restriction := status.Restriction(); restriction != "" {
+			return true, "product " + restriction + " since " + status.Time.Format("15:04:05")
+		}
+	}
+	return false, ""
+}
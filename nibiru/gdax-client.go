@@ -2,22 +2,43 @@ package nibiru
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	api "github.com/preichenberger/go-coinbase-exchange"
 	"os"
+	"sync"
 	"time"
+
+	api "github.com/preichenberger/go-coinbase-exchange"
 )
 
 const simulationActivated bool = true
 
 type GdaxClient struct {
-	client          api.Client //Gdax API
-	side            string
+	mutex           sync.Mutex // Orders are created from different goroutines (Algo, PositionGuard, RiskManager)
+	exchange        Exchange   //Gdax API, or another exchange with the same operations
 	productId       string
 	cashAvailable   float64 // Updated in refreshCashCryptoAvailable()
 	cryptoAvailable float64 // Updated in refreshCashCryptoAvailable()
+	cashHold        float64 // Held by the open orders, updated in refreshCashCryptoAvailable()
+	cryptoHold      float64 // Held by the open orders, updated in refreshCashCryptoAvailable()
+	cashBalance     float64 // Cash of the bot at start, holds included, plus the fills recorded since. Checked by the Reconciler
 	elasticClient   *ElasticClient
 	simu            *Simulation
+	sizer           Sizer
+	minSize         float64 // Product minimum order size
+	sizeIncrement   float64 // Product order size increment, 0 if unknown
+	position        *Position
+	tranches        int // Buys since the position was opened
+	journal         *Journal
+}
+
+// GET /products/<product-id>
+type Product struct {
+	Id             string  `json:"id"`
+	BaseMinSize    float64 `json:"base_min_size,string"`
+	BaseMaxSize    float64 `json:"base_max_size,string"`
+	BaseIncrement  float64 `json:"base_increment,string"`
+	QuoteIncrement float64 `json:"quote_increment,string"`
 }
 
 type Simulation struct { // Used for testing only
@@ -32,23 +53,16 @@ type Simulation struct { // Used for testing only
 }
 
 func NewGdaxClient() *GdaxClient {
-	client := initClient()
+	exchange := NewExchange()
 	simu := Simulation{0, 0, 0, 0, 0, 0, 0, 0.3}
 	elasticClient := NewElasticClient()
-	t := &GdaxClient{client, GetConfigInstance().Init.Side, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, 0, 0, elasticClient, &simu}
+	t := &GdaxClient{sync.Mutex{}, exchange, GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency, 0, 0, 0, 0, 0, elasticClient, &simu, NewSizer(), 0, 0, NewPosition(GetConfigInstance().Accounting.LotMethod), 0, OpenJournal(GetConfigInstance().JournalFile)}
 	t.initGdaxClient()
+	GetPositionGuardInstance().attach(t)
+	GetRiskManagerInstance().attach(t)
 	return t
 }
 
-func initClient() api.Client {
-	return api.Client{
-		BaseURL:    GetConfigInstance().BaseURL,
-		Secret:     GetConfigInstance().Account.Secret,
-		Key:        GetConfigInstance().Account.Key,
-		Passphrase: GetConfigInstance().Account.Passphrase,
-	}
-}
-
 func (t *GdaxClient) initGdaxClient() {
 	if GetConfigInstance().Init.Side != "buy" && GetConfigInstance().Init.Side != "sell" {
 		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Incorrect value of side: %s. Values accepted: buy, sell", GetConfigInstance().Init.Side)
@@ -58,12 +72,27 @@ func (t *GdaxClient) initGdaxClient() {
 		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Incorrect value of crypto: %s. Values accepted: BTC, ETH", GetConfigInstance().Init.Crypto)
 		os.Exit(1)
 	}
-	if GetConfigInstance().Init.Currency != "EUR" && GetConfigInstance().Init.Currency != "USD" {
+	if GetConfigInstance().Init.Currency != "EUR" && GetConfigInstance().Init.Currency != "USD" && GetConfigInstance().Exchange != EXCHANGE_BINANCE { // Binance quotes in USDT, BUSD...
 		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Incorrect value of currency: %s. Values accepted: EUR, USD", GetConfigInstance().Init.Currency)
 		os.Exit(1)
 	}
 
-	t.refreshCashCryptoAvailable() // Initialize cryptoAvailable and cashAvailable
+	product, err := t.exchange.GetProduct(t.productId)
+	if err != nil {
+		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Failed getting the product, no minimum size: %s", err.Error())
+	}
+	t.minSize = product.BaseMinSize
+	t.sizeIncrement = product.BaseIncrement
+
+	if err := t.refreshCashCryptoAvailable(); err != nil { // Initialize cryptoAvailable and cashAvailable
+		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. %s", err.Error())
+		os.Exit(1)
+	}
+	t.cashBalance = t.cashAvailable + t.cashHold
+	// Restarted after a stop or a crash, the position comes from the journal instead of Init.Side
+	if t.recover() {
+		return
+	}
 	if GetConfigInstance().Init.Side == "buy" && t.cashAvailable <= 0 {
 		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Side is buy but there is no cash available on the account")
 		os.Exit(1)
@@ -72,40 +101,166 @@ func (t *GdaxClient) initGdaxClient() {
 		GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Side is sell but there is no crypto currency available on the account")
 		os.Exit(1)
 	}
+	if GetConfigInstance().Init.Side == "sell" { // Position already opened, made of the lots of the fills history
+		fills, err := LoadFills(t.productId)
+		if err != nil {
+			GetLoggerInstance().Error("In gdaxClient/initGdaxClient. Failed loading the fills: %s", err.Error())
+			os.Exit(1)
+		}
+		ledger, _ := BuildLedger(fills, GetConfigInstance().Accounting.LotMethod)
+		lots, err := openingLots(ledger.lots, t.cryptoAvailable, t.sizeIncrement)
+		if err != nil {
+			GetLoggerInstance().Error("In gdaxClient/initGdaxClient. %s", err.Error())
+			os.Exit(1)
+		}
+		for _, lot := range lots {
+			t.position.Add(lot)
+		}
+		t.tranches = maxTranches()
+		t.arm()
+		GetLoggerInstance().Info("GdaxClient - Position of %f opened from %d lots, average entry: %f", t.position.Size(), len(lots), t.position.AverageEntry())
+	}
+}
+
+// The most recent lots of the ledger making up size, the oldest one cut. Returns an error if the fills
+// don't explain size: the entry price of the crypto bought before the history is unknown
+func openingLots(lots []Lot, size float64, increment float64) ([]Lot, error) {
+	tolerance := increment / 2
+	if tolerance <= 0 {
+		tolerance = 1e-9
+	}
+	var opening []Lot
+	remaining := size
+	for i := len(lots) - 1; i >= 0 && remaining > tolerance; i-- {
+		lot := lots[i]
+		if lot.Size > remaining {
+			lot.Fee = lot.Fee * remaining / lot.Size
+			lot.Size = remaining
+		}
+		opening = append([]Lot{lot}, opening...)
+		remaining -= lot.Size
+	}
+	if remaining > tolerance {
+		return nil, fmt.Errorf("entry price of %f of the %f crypto available not found in the fills", remaining, size)
+	}
+	return opening, nil
 }
 
-func (t *GdaxClient) getLastFill(side string) (lastPrice float64, lastSize float64, lastFee float64) {
+// Replay the journal: find out what happened to the orders pending when the process stopped,
+// then rebuild the position from the last snapshot and the fills since. Returns false if the journal has neither
+func (t *GdaxClient) recover() bool {
+	for _, entry := range t.journal.Pending() {
+		if t.resolve(&entry) == JOURNAL_FILLED { // Filled but never recorded
+			t.elasticClient.IndexFillOrder(entry.Time, t.productId, entry.Size, entry.Price, entry.Side, entry.Fee)
+			GetBrokerPublisherInstance().PublishFill(entry)
+		}
+	}
+	snapshot, fills := t.journal.Fills(t.productId)
+	if snapshot == nil && len(fills) == 0 {
+		return false
+	}
+	if snapshot != nil {
+		t.position.Restore(snapshot.Lots, snapshot.Realized)
+		t.tranches = snapshot.Tranches
+		if simulationActivated {
+			t.cashAvailable = snapshot.Cash
+		}
+	}
+	for _, entry := range fills {
+		t.apply(entry)
+		if simulationActivated { // The simulated balances are only updated by the orders
+			if entry.Side == "buy" {
+				t.cashAvailable -= entry.Price*entry.Size + entry.Fee
+			} else {
+				t.cashAvailable += entry.Price*entry.Size - entry.Fee
+			}
+		}
+	}
 	if simulationActivated {
-		return t.getLastFill_simulation(side)
+		t.cryptoAvailable = t.position.Size()
 	}
+	t.arm()
+	GetLoggerInstance().Info("Journal - %d fills replayed (snapshot: %t). Position: %f, average entry: %f, tranches: %d, pending orders: %d",
+		len(fills), snapshot != nil, t.position.Size(), t.position.AverageEntry(), t.tranches, len(t.journal.Pending()))
+	return true
+}
 
-	cursor := t.client.ListFills()
-	var fills []api.Fill
-	lastPrice = 0
-	lastSize = 0
-	lastFee = 0
-	lastestTime := time.Time{}
+// Compact the journal to the current position. Must be called locked
+func (t *GdaxClient) snapshot() {
+	t.journal.Snapshot(t.productId, JournalSnapshot{t.position.Lots(), t.tranches, t.position.Realized(), t.cashAvailable})
+}
 
-	params := api.ListFillsParams{
-		ProductId: t.productId,
+// Find out on the exchange what happened to a pending order, and write its new state in the journal.
+// The order is updated with the fill. Returns the new state
+func (t *GdaxClient) resolve(entry *JournalEntry) string {
+	if simulationActivated { // Simulated orders are filled at creation, an intent left means the process stopped in between
+		t.journal.Transition(*entry, JOURNAL_FAILED)
+		return JOURNAL_FAILED
 	}
-	cursor = t.client.ListFills(params)
-	for cursor.HasMore {
-		if err := cursor.NextPage(&fills); err != nil {
-			GetLoggerInstance().Error("In gdaxClient/getLastFill. %s\n", err.Error(), time.Now().Format("15:04:05"))
-			os.Exit(1)
+	order, err := t.exchange.GetOrderByClientOid(t.productId, entry.ClientOid, entry.Time)
+	if err != nil {
+		GetLoggerInstance().Error("In gdaxClient/resolve. Order %s: %s", entry.ClientOid, err.Error())
+		return entry.State
+	}
+	if order == nil { // The process stopped before the order was sent
+		GetLoggerInstance().Info("Journal - %s order %s not found on the exchange", entry.Side, entry.ClientOid)
+		t.journal.Transition(*entry, JOURNAL_FAILED)
+		return JOURNAL_FAILED
+	}
+	entry.OrderId = order.Id
+	switch order.Status {
+	case "done", "settled":
+		if order.FilledSize <= 0 {
+			t.journal.Transition(*entry, JOURNAL_FAILED)
+			return JOURNAL_FAILED
+		}
+		entry.Size = order.FilledSize
+		entry.Price = order.ExecutedValue / order.FilledSize
+		entry.Fee = order.FillFees
+		entry.Time = time.Now()
+		GetLoggerInstance().Info("Journal - %s order %s filled on the exchange, size: %f, price: %f", entry.Side, entry.ClientOid, entry.Size, entry.Price)
+		t.journal.Transition(*entry, JOURNAL_FILLED)
+		return JOURNAL_FILLED
+	case "rejected":
+		t.journal.Transition(*entry, JOURNAL_FAILED)
+		return JOURNAL_FAILED
+	default: // pending, open, active
+		if entry.State == JOURNAL_INTENT {
+			t.journal.Transition(*entry, JOURNAL_SENT)
 		}
+		return JOURNAL_SENT
+	}
+}
 
-		for _, f := range fills {
-			if f.Settled == true && f.Side == side && f.CreatedAt.Time().After(lastestTime) {
-				lastestTime = f.CreatedAt.Time()
-				lastPrice = f.Price
-				lastSize = f.Size
-				lastFee = f.Fee
-			}
+// Record the orders filled since they were sent. Must be called locked
+func (t *GdaxClient) resolvePending() {
+	for _, entry := range t.journal.Pending() {
+		if t.resolve(&entry) == JOURNAL_FILLED {
+			t.record(entry)
+		}
+	}
+}
+
+func (t *GdaxClient) getLastFill(side string) (lastPrice float64, lastSize float64, lastFee float64, err error) {
+	if simulationActivated {
+		lastPrice, lastSize, lastFee = t.getLastFill_simulation(side)
+		return lastPrice, lastSize, lastFee, nil
+	}
+
+	lastestTime := time.Time{}
+	fills, err := t.exchange.ListFills(t.productId)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, f := range fills {
+		if f.Side == side && f.Time.After(lastestTime) {
+			lastestTime = f.Time
+			lastPrice = f.Price
+			lastSize = f.Size
+			lastFee = f.Fee
 		}
 	}
-	return lastPrice, lastSize, lastFee
+	return lastPrice, lastSize, lastFee, nil
 }
 
 func (t *GdaxClient) getLastFill_simulation(side string) (lastPrice float64, lastSize float64, lastFee float64) {
@@ -113,40 +268,44 @@ func (t *GdaxClient) getLastFill_simulation(side string) (lastPrice float64, las
 	return t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee
 }
 
-// Check if there is a capital gains if we sell
+// Check if there is a capital gains if we sell sellSize, against the cost of the lots sold (entry price and buy fees)
 func (t *GdaxClient) canSell(sellPrice float64, sellSize float64) bool {
-	lastPrice, lastSize, lastFee := t.getLastFill("buy")
-	//GetLoggerInstance().Info("Gains estimation: %f", sellPrice*sellSize*(1-lastFee/100)-lastPrice*lastSize*(1-lastFee/100))
-	//GetLoggerInstance().Info("canSell. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
-	return lastPrice == 0 || sellPrice*sellSize*(1-lastFee/100)-lastPrice*lastSize*(1-lastFee/100) > GetConfigInstance().Init.MinGains
+	cost := t.position.Cost(sellSize)
+	//GetLoggerInstance().Info("Gains estimation: %f", sellPrice*sellSize*(1-t.simu.fee/100)-cost)
+	return sellPrice*sellSize*(1-t.simu.fee/100)-cost > GetConfigInstance().Init.MinGains
 }
 
-func (t *GdaxClient) refreshCashCryptoAvailable() { // TODO Get crypto from order not filled + stock
+// The available balances exclude the holds of the open orders, counted apart
+func (t *GdaxClient) refreshCashCryptoAvailable() error {
 	if simulationActivated {
 		t.refreshCashCryptoAvailable_simulation()
-		return
+		return nil
 	}
 
-	accounts, err := t.client.GetAccounts()
+	accounts, err := t.exchange.GetAccounts()
 	if err != nil {
-		GetLoggerInstance().Error("In gdaxClient/checkStatus %s", err.Error())
-		os.Exit(2)
+		return err
 	}
 
 	for _, a := range accounts {
 		if a.Currency == GetConfigInstance().Init.Crypto {
 			t.cryptoAvailable = a.Available
-		} else {
-			if a.Currency == GetConfigInstance().Init.Currency {
-				if a.Available > GetConfigInstance().Init.LimitCashAvailable {
-					t.cashAvailable = GetConfigInstance().Init.LimitCashAvailable
-				} else {
-					t.cashAvailable = a.Available
-				}
-			}
+			t.cryptoHold = a.Hold
+		} else if a.Currency == GetConfigInstance().Init.Currency {
+			t.cashAvailable = limitCash(a.Available)
+			t.cashHold = a.Hold
 		}
 	}
 	//GetLoggerInstance().Info("CashAvailable: %f, cryptoAvailable: %f", t.cashAvailable, t.cryptoAvailable)
+	return nil
+}
+
+// Cash of the account usable by the bot: capped by Init.LimitCashAvailable, if set
+func limitCash(available float64) float64 {
+	if limit := GetConfigInstance().Init.LimitCashAvailable; limit > 0 && available > limit {
+		return limit
+	}
+	return available
 }
 
 func (t *GdaxClient) refreshCashCryptoAvailable_simulation() {
@@ -155,25 +314,36 @@ func (t *GdaxClient) refreshCashCryptoAvailable_simulation() {
 	//GetLoggerInstance().Info("refreshCashCryptoAvailable_simulation. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
 }
 
-func (t *GdaxClient) checkStatus() string {
+// In simulation the balances are only updated by the orders
+func (t *GdaxClient) refresh() error {
 	if simulationActivated {
-		return t.checkStatus_simulation()
+		return nil
 	}
+	t.resolvePending()
+	return t.refreshCashCryptoAvailable()
+}
 
-	t.refreshCashCryptoAvailable()
-	if t.cryptoAvailable > 0 { // TODO CHANGE IT
-		//GetLoggerInstance().Info("checkStatus: sell")
-		t.side = "sell"
-	} else {
-		//GetLoggerInstance().Info("checkStatus: buy")
-		t.side = "buy"
+// true if the position is not full and there is cash to buy
+func (t *GdaxClient) CanScaleIn() (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.refresh(); err != nil {
+		return false, err
 	}
-	return t.side
+	return t.tranches < maxTranches() && t.cashAvailable-GetConfigInstance().Init.CashReserve > 0, nil
 }
 
-func (t *GdaxClient) checkStatus_simulation() string {
-	//GetLoggerInstance().Info("checkStatus_simulation: %s", t.side)
-	return t.side
+func (t *GdaxClient) HasPosition() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.position.Size() > 0
+}
+
+func maxTranches() int {
+	if GetConfigInstance().Scaling.Tranches <= 0 {
+		return 1
+	}
+	return GetConfigInstance().Scaling.Tranches
 }
 
 // DELETE /orders/<order-id>
@@ -216,39 +386,80 @@ func (t *GdaxClient) checkStatus_simulation() string {
 //}
 
 // POST /orders
-// Limit order
-func (t *GdaxClient) createOrder(price float64, size float64) {
+// Market order, journaled before being sent. The simulated orders are filled at once, the others stay sent
+// until the exchange reports them filled (resolvePending). Returns a *RiskRejection if the RiskManager rejected
+// the order, the *APIError of the exchange, or a temporary *APIError if an order is still pending
+func (t *GdaxClient) createOrder(side string, price float64, size float64) error {
+	if err := GetRiskManagerInstance().Check(side, price, size, t.position.Size()*price); err != nil {
+		return err
+	}
+	if pending := t.journal.Pending(); len(pending) > 0 { // Don't buy or sell twice
+		GetLoggerInstance().Error("In gdaxClient/createOrder. The %s order %s is still pending, no new order", pending[0].Side, pending[0].ClientOid)
+		return &APIError{"POST /orders", 0, "the " + pending[0].Side + " order " + pending[0].ClientOid + " is still pending", true}
+	}
+	entry := JournalEntry{time.Now(), newClientOid(), JOURNAL_INTENT, t.productId, side, price, size, 0, "", nil}
+	t.journal.Write(entry)
 	if simulationActivated {
-		t.createOrder_simulation(price, size)
-		return
+		t.createOrder_simulation(side, price, size)
+		t.fill(entry)
+		return nil
 	}
 
-	// Uncomment these lines in production
-	//	order := api.Order{
-	//		Type: "market",
-	//		//Price:     price,
-	//		Size:      size,
-	//		Side:      t.side,
-	//		ProductId: t.productId,
-	//	}
+	order := api.Order{
+		Type:      "market",
+		Size:      size,
+		Side:      side,
+		ProductId: t.productId,
+		ClientOID: entry.ClientOid,
+	}
+	savedOrder, err := t.sendOrder(&order, entry.Time)
+	if err != nil {
+		var apiError *APIError
+		if errors.As(err, &apiError) && apiError.Temporary() { // Maybe received: left pending, found later by its client_oid
+			GetLoggerInstance().Error("In gdaxClient/createOrder. The %s order %s may not be sent: %s", side, entry.ClientOid, err.Error())
+			return err
+		}
+		GetLoggerInstance().Error("In gdaxClient/createOrder. The %s order %s is rejected: %s", side, entry.ClientOid, err.Error())
+		t.journal.Transition(entry, JOURNAL_FAILED)
+		return err
+	}
+	entry.OrderId = savedOrder.Id
+	t.journal.Transition(entry, JOURNAL_SENT)
+	t.resolvePending() // A market order is usually done already
+	return nil
+}
 
-	// savedOrder, err := t.client.CreateOrder(&order)
-	//	t.elasticClient.IndexFillOrder(time.Now(), t.productId, size, price, t.side)
-	//	if err != nil {
-	//		GetLoggerInstance().Error("In gdaxClient/newLimitOrder, while creating new order %s", err.Error())
-	//		os.Exit(2)
-	//	}
-	//	if savedOrder.Id == "" {
-	//		GetLoggerInstance().Error("In gdaxClient/newLimitOrder, while creating new order, id is NULL")
-	//		os.Exit(2)
-	//	}
+// POST /orders. Sent again while the exchange doesn't answer, if it doesn't know the order by its client_oid
+func (t *GdaxClient) sendOrder(order *api.Order, since time.Time) (api.Order, error) {
+	var err error
+	for attempt := 0; attempt <= REST_MAX_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(time.Duration(REST_BACKOFF)*time.Millisecond, 0, attempt))
+			found, lookupErr := t.exchange.GetOrderByClientOid(t.productId, order.ClientOID, since)
+			if lookupErr != nil { // Unknown: not sent again
+				return api.Order{}, err
+			}
+			if found != nil {
+				return *found, nil
+			}
+			GetLoggerInstance().Info("GdaxClient - Order %s not received by the exchange, retry %d/%d", order.ClientOID, attempt, REST_MAX_RETRIES)
+		}
+		var savedOrder api.Order
+		if savedOrder, err = t.exchange.CreateOrder(order); err == nil {
+			return savedOrder, nil
+		}
+		var apiError *APIError
+		if !errors.As(err, &apiError) || !apiError.Temporary() {
+			return api.Order{}, err
+		}
+	}
+	return api.Order{}, err
 }
 
-func (t *GdaxClient) createOrder_simulation(price float64, size float64) {
-	//GetLoggerInstance().Info("createOrder_simulation 1. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
+func (t *GdaxClient) createOrder_simulation(side string, price float64, size float64) {
 	t.simu.cryptoAvailableSaved = t.cryptoAvailable
 	t.simu.cashAvailableSaved = t.cashAvailable
-	if t.side == "buy" {
+	if side == "buy" {
 		t.cashAvailable -= price * size
 		t.simu.buyPrice = price
 		t.simu.size = size
@@ -257,10 +468,9 @@ func (t *GdaxClient) createOrder_simulation(price float64, size float64) {
 		t.simu.sellPrice = price
 		t.simu.size = size
 	}
-	//GetLoggerInstance().Info("createOrder_simulation 2. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
 }
 
-func (t *GdaxClient) fillGdaxClient_simulation(currentPrice float64) {
+func (t *GdaxClient) fillGdaxClient_simulation(side string, currentPrice float64) {
 	if !simulationActivated {
 		return
 	}
@@ -269,130 +479,251 @@ func (t *GdaxClient) fillGdaxClient_simulation(currentPrice float64) {
 		return
 	}
 
-	t.elasticClient.IndexFillOrder(time.Now(), t.productId, t.simu.size, currentPrice, t.side)
-	switch t.side {
+	switch side {
 	case "buy":
-		{
-			GetLoggerInstance().Info("===> BUY %f crypto at %f", t.simu.size, currentPrice)
-			t.cryptoAvailable += t.simu.size
-			// t.cashAvailable was already decreased in createOrder
-			t.simu.lastFillPrice = currentPrice
-			t.simu.lastFillSize = t.simu.size
-			//t.simu.buyPrice = 0
-			t.simu.size = 0
-			t.simu.sellPrice = 0
-			t.simu.cashAvailableSaved = 0
-			t.simu.cryptoAvailableSaved = 0
-			t.side = "sell"
-			//GetLoggerInstance().Info("FillGdaxClient_simulation BUY. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
-		}
+		// t.cashAvailable was already decreased in createOrder
+		t.cryptoAvailable += t.simu.size
+		t.simu.sellPrice = 0
+	case "sell":
+		// t.cryptoAvailable was already decreased in createOrder
+		t.cashAvailable += t.simu.sellPrice * t.simu.size
+		t.simu.buyPrice = 0
+	}
+	t.simu.lastFillPrice = currentPrice
+	t.simu.lastFillSize = t.simu.size
+	t.simu.size = 0
+	t.simu.cashAvailableSaved = 0
+	t.simu.cryptoAvailableSaved = 0
+}
+
+// Simulated orders are considered filled at price when created
+func (t *GdaxClient) fill(entry JournalEntry) {
+	t.fillGdaxClient_simulation(entry.Side, entry.Price)
+	entry.Time = time.Now()
+	entry.Fee = entry.Price * entry.Size * t.simu.fee / 100
+	t.cashAvailable -= entry.Fee // Paid in cash, as replayed by recover
+	t.journal.Transition(entry, JOURNAL_FILLED)
+	t.record(entry)
+}
+
+// Update the position, the stop loss and take profit levels and the realized gains of the RiskManager
+func (t *GdaxClient) record(entry JournalEntry) {
+	t.elasticClient.IndexFillOrder(entry.Time, t.productId, entry.Size, entry.Price, entry.Side, entry.Fee)
+	GetBrokerPublisherInstance().PublishFill(entry)
+	disposals := t.apply(entry)
+	if recorder, ok := t.sizer.(disposalRecorder); ok {
+		recorder.RecordDisposals(disposals)
+	}
+	var gains float64
+	for _, disposal := range disposals {
+		gains += disposal.Gain
+	}
+	switch entry.Side {
+	case "buy":
+		t.cashBalance -= entry.Price*entry.Size + entry.Fee
+		GetLoggerInstance().Info("===> BUY %f crypto at %f. Position: %f, average entry: %f", entry.Size, entry.Price, t.position.Size(), t.position.AverageEntry())
 	case "sell":
-		{
-			//GetLoggerInstance().Info("FillGdaxClient_simulation SELL. currentPrice: %s, sellPrice: %f, buyPrice: %f, size: %f\n", currentPrice, t.simu.sellPrice, t.simu.buyPrice, t.simu.size)
-			GetLoggerInstance().Info("<=== SELL %f crypto at %f. Gains: %f", t.simu.size, currentPrice, (t.simu.sellPrice-t.simu.buyPrice)*t.simu.size)
-			// t.cryptoAvailable was already decreased in createOrder
-			t.cashAvailable += t.simu.sellPrice * t.simu.size
-			t.simu.lastFillPrice = currentPrice
-			t.simu.lastFillSize = t.simu.size
-			t.simu.buyPrice = 0
-			t.simu.size = 0
-			//t.simu.sellPrice = 0
-			t.simu.cashAvailableSaved = 0
-			t.simu.cryptoAvailableSaved = 0
-			t.side = "buy"
-			//GetLoggerInstance().Info("FillGdaxClient_simulation SELL. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
+		t.cashBalance += entry.Price*entry.Size - entry.Fee
+		GetLoggerInstance().Info("<=== SELL %f crypto at %f. Gains: %f, realized since start: %f", entry.Size, entry.Price, gains, t.position.Realized())
+		GetRiskManagerInstance().RecordRealized(gains)
+	}
+	t.arm()
+	if t.journal.Len() > JOURNAL_SNAPSHOT_ENTRIES {
+		t.snapshot()
+	}
+}
+
+// Add the fill to the position. Returns the parts of the lots sold by a sell
+func (t *GdaxClient) apply(entry JournalEntry) (disposals []Disposal) {
+	switch entry.Side {
+	case "buy":
+		t.position.Add(Lot{entry.Time, entry.Price, entry.Size, entry.Fee})
+		t.tranches++
+	case "sell":
+		disposals = t.position.Dispose(entry.Time, entry.Size, entry.Price, entry.Fee)
+		if t.position.Size() <= 0 {
+			t.position.Clear()
+			t.tranches = 0
 		}
 	}
+	return disposals
+}
+
+// Stop loss and take profit levels follow the average entry of the position
+func (t *GdaxClient) arm() {
+	if t.position.Size() > 0 {
+		GetPositionGuardInstance().Arm(t.position.AverageEntry())
+	} else {
+		GetPositionGuardInstance().Disarm()
+	}
 }
 
 // GET /products/<product-id>/ticker
-func (t *GdaxClient) GetTicker() (ask float64, bid float64) {
+func (t *GdaxClient) GetTicker() (ask float64, bid float64, err error) {
 	//	if simulationActivated {
 	//		return t.getTicker_simulation()
 	//	}
 
-	ticker, err := t.client.GetTicker(t.productId)
+	ask, bid, err = t.exchange.GetTicker(t.productId)
 	if err != nil {
-		GetLoggerInstance().Error("In gdaxClient/GetTicker: %s", err.Error())
-		os.Exit(2)
+		return 0, 0, err
 	}
 
-	//GetLoggerInstance().Info("Refresh ticker - ask: %f, bid: %f", ticker.Ask, ticker.Bid)
-	return ticker.Ask, ticker.Bid
+	//GetLoggerInstance().Info("Refresh ticker - ask: %f, bid: %f", ask, bid)
+	return ask, bid, nil
 }
 
 func (t *GdaxClient) getTicker_simulation() (ask float64, bid float64) {
 	return 2000, 2000
 }
 
-func (t *GdaxClient) UpdatePosition(side string, price float64) {
-	GetLoggerInstance().Info("UpdatePosition: %s", side)
-	//GetLoggerInstance().Info("UpdatePosition 1. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
-	switch side {
-	case "buy":
-		{
-			// check status of current order if still opened, else switch of side
-			if t.checkStatus() != "buy" {
-				return
-			}
-			// cancel open order
-			//GetLoggerInstance().Info("UpdatePosition: cancel buy order")
-			//t.cancelOrder()
-			// new ask order on price
-			size := (t.cashAvailable - GetConfigInstance().Init.CashReserve) / price
-			if size <= 0 {
-				GetLoggerInstance().Error("UpdatePosition: Not enough cash %f", t.cashAvailable)
-				os.Exit(3)
-			}
-			GetLoggerInstance().Info("=> UpdatePosition: create buy order price: %f, size: %f", price, size)
-			t.createOrder(price, size)
-			t.fillGdaxClient_simulation(price)
-		}
-	case "sell":
-		{
-			// check status of current order if still opened, else switch of side
-			if t.checkStatus() != "sell" {
-				return
-			}
-			cryptoAvailableTmp := t.cryptoAvailable // TODO Use refreshCashCryptoAvailable()
-			if cryptoAvailableTmp == 0 {
-				cryptoAvailableTmp = t.simu.cryptoAvailableSaved // t.cryptoAvailable is null after a createOrder
-			}
-			if !t.canSell(price, cryptoAvailableTmp) {
-				GetLoggerInstance().Info("No gain, ignore sell")
-				return // we won't make a gain, so we don't sell
-			}
-			// cancel open order
-			//GetLoggerInstance().Info("UpdatePosition: cancel sell order")
-			//t.cancelOrder()
-			// new bid order on price
-			GetLoggerInstance().Info("=> UpdatePosition: create sell order price: %f, size: %f", price, t.cryptoAvailable)
-			t.createOrder(price, t.cryptoAvailable)
-			t.fillGdaxClient_simulation(price)
+// Buy one more tranche of the position if the signal strength (ratio / threshold) is enough:
+// tranche n requires a strength of 1 + (n - 1) * Scaling.TrancheStep
+func (t *GdaxClient) ScaleIn(price float64, strength float64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	tranches := maxTranches()
+	if t.tranches >= tranches {
+		return nil
+	}
+	if required := 1 + float64(t.tranches)*GetConfigInstance().Scaling.TrancheStep; strength < required {
+		GetLoggerInstance().Info("ScaleIn: signal strength %f below %f for tranche %d", strength, required, t.tranches+1)
+		return nil
+	}
+	if t.cashAvailable-GetConfigInstance().Init.CashReserve <= 0 {
+		GetLoggerInstance().Error("ScaleIn: Not enough cash %f", t.cashAvailable)
+		return nil
+	}
+	size := buySize(t.sizer, price, t.cashAvailable, t.cashAvailable+t.cryptoAvailable*price, t.minSize, t.sizeIncrement, 1/float64(tranches))
+	if size <= 0 {
+		return nil
+	}
+	GetLoggerInstance().Info("=> ScaleIn: create buy order (tranche %d/%d) price: %f, size: %f", t.tranches+1, tranches, price, size)
+	return t.createOrder("buy", price, size)
+}
+
+// Sell Scaling.PartialExit of the position, if it makes a gain
+func (t *GdaxClient) ScaleOut(price float64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	positionSize := t.position.Size()
+	if positionSize <= 0 {
+		return nil
+	}
+	size := positionSize
+	if partialExit := GetConfigInstance().Scaling.PartialExit; partialExit > 0 && partialExit < 1 {
+		// Both the part sold and the part kept must be orders the exchange accepts
+		partial := roundSize(positionSize*partialExit, t.sizeIncrement)
+		if partial >= t.minSize && positionSize-partial >= t.minSize {
+			size = partial
 		}
-	default:
-		{
-			GetLoggerInstance().Error("In gdaxClient/UpdatePosition, incorrect side ", time.Now().Format("15:04:05"), side)
-			os.Exit(2)
+	}
+	if !t.canSell(price, size) {
+		GetLoggerInstance().Info("No gain, ignore sell")
+		return nil // we won't make a gain, so we don't sell
+	}
+	_, err := t.sell(price, size, "ScaleOut")
+	return err
+}
+
+// Realized gains since start and unrealized gains of the position at price, fees included
+func (t *GdaxClient) Pnl(price float64) (realized float64, unrealized float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.position.Realized(), t.position.Unrealized(price)
+}
+
+// Cash + crypto valued at price, the holds of the open orders included
+func (t *GdaxClient) Equity(price float64) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.cashAvailable + t.cashHold + (t.cryptoAvailable+t.cryptoHold)*price
+}
+
+// Sell the whole position at price, even at a loss. Used by the stop loss, the take profit and the kill switch
+func (t *GdaxClient) ExitPosition(price float64, reason string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	if t.position.Size() <= 0 { // No position
+		return nil
+	}
+	if t.position.Size() < t.minSize {
+		GetLoggerInstance().Info("ExitPosition (%s): position %f below the minimum size %f, not sold", reason, t.position.Size(), t.minSize)
+		return nil
+	}
+	sent, err := t.sell(price, t.position.Size(), "ExitPosition ("+reason+")")
+	if err != nil {
+		return fmt.Errorf("%s: %w", reason, err)
+	}
+	if !sent {
+		return fmt.Errorf("%s: sell order of %f not sent", reason, t.position.Size())
+	}
+	return nil
+}
+
+// Cancel the open orders of the product, at shutdown
+func (t *GdaxClient) CancelOpenOrders() error {
+	if simulationActivated { // Simulated orders are filled at once
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	orders, err := t.exchange.ListOrders(t.productId, "open")
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if err := t.exchange.CancelOrder(t.productId, order.Id); err != nil {
+			return err
 		}
+		GetLoggerInstance().Info("GdaxClient - Order %s cancelled", order.Id)
 	}
-	//GetLoggerInstance().Info("UpdatePosition 2. side: %s, cashAvailable: %f, cryptoAvailable: %f, cashAvailableSaved: %f, cryptoAvailableSaved: %f, buyPrice: %f, size: %f, sellPrice: %f, lastFillPrice: %f, lastFillSize: %f, fee: %f", t.side, t.cashAvailable, t.cryptoAvailable, t.simu.cashAvailableSaved, t.simu.cryptoAvailableSaved, t.simu.buyPrice, t.simu.size, t.simu.sellPrice, t.simu.lastFillPrice, t.simu.lastFillSize, t.simu.fee)
+	return nil
+}
+
+// Compact the journal to the position and close it, no order can be created after
+func (t *GdaxClient) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.snapshot()
+	t.journal.Close()
+}
+
+// Returns false without error if the size is below the minimum size. Must be called locked
+func (t *GdaxClient) sell(price float64, size float64, caller string) (bool, error) {
+	if size > t.cryptoAvailable {
+		size = t.cryptoAvailable
+	}
+	size = roundSize(size, t.sizeIncrement)
+	if size <= 0 || size < t.minSize {
+		GetLoggerInstance().Info("%s: size %f below the minimum size %f, no sell order", caller, size, t.minSize)
+		return false, nil
+	}
+	GetLoggerInstance().Info("=> %s: create sell order price: %f, size: %f", caller, price, size)
+	if err := t.createOrder("sell", price, size); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // GET /orders/<order-id>
 func (t *GdaxClient) PrintOrders() {
-	cursor := t.client.ListOrders()
-	var orders []api.Order
-
-	cursor = t.client.ListOrders(api.ListOrdersParams{Status: "done"})
-	for cursor.HasMore {
-		if err := cursor.NextPage(&orders); err != nil {
-			GetLoggerInstance().Error("In PrintOrders: %s", err.Error())
-		}
+	orders, err := t.exchange.ListOrders(t.productId, "done")
+	if err != nil {
+		GetLoggerInstance().Error("In PrintOrders: %s", err.Error())
+	}
 
-		for _, o := range orders {
-			js, _ := json.Marshal(o)
-			fmt.Println(string(js))
-		}
+	for _, o := range orders {
+		js, _ := json.Marshal(o)
+		fmt.Println(string(js))
 	}
 }
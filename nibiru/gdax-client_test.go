@@ -0,0 +1,67 @@
+package nibiru
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// The opening position of "side": "sell" is made of the most recent lots, the oldest one cut
+func TestOpeningLots(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lots := []Lot{{day, 18000, 0.2, 4}, {day.Add(time.Hour), 19000, 0.1, 2}, {day.Add(2 * time.Hour), 20000, 0.1, 2}}
+	tests := []struct {
+		size float64
+		want []Lot
+	}{
+		{0.1, []Lot{{day.Add(2 * time.Hour), 20000, 0.1, 2}}},
+		{0.25, []Lot{{day, 18000, 0.05, 1}, {day.Add(time.Hour), 19000, 0.1, 2}, {day.Add(2 * time.Hour), 20000, 0.1, 2}}},
+		{0.4, lots},
+	}
+	for _, test := range tests {
+		opening, err := openingLots(lots, test.size, 0.0001)
+		if err != nil {
+			t.Errorf("openingLots of %f: %s", test.size, err.Error())
+			continue
+		}
+		if len(opening) != len(test.want) {
+			t.Errorf("openingLots of %f = %+v, want %+v", test.size, opening, test.want)
+			continue
+		}
+		for i, lot := range opening {
+			want := test.want[i]
+			if !lot.Time.Equal(want.Time) || lot.Price != want.Price || math.Abs(lot.Size-want.Size) > 1e-9 || math.Abs(lot.Fee-want.Fee) > 1e-9 {
+				t.Errorf("openingLots of %f = %+v, want %+v", test.size, opening, test.want)
+				break
+			}
+		}
+	}
+	if _, err := openingLots(lots, 0.5, 0.0001); err == nil {
+		t.Error("openingLots of more than the fills without error")
+	}
+	if _, err := openingLots(nil, 0.1, 0); err == nil {
+		t.Error("openingLots without fill without error")
+	}
+}
+
+// The rejection of a buy is returned to the algo, which skips its tick without killing
+func TestScaleInRejected(t *testing.T) {
+	risk := GetRiskManagerInstance()
+	risk.mutex.Lock()
+	risk.killed, risk.killReason = true, "test"
+	risk.mutex.Unlock()
+	defer risk.Resume()
+	client := newJournalClient(t, "")
+	err := client.ScaleIn(20000, 2)
+	if _, ok := err.(*RiskRejection); !ok {
+		t.Fatalf("ScaleIn killed = %v, want a *RiskRejection", err)
+	}
+	if client.position.Size() != 0 || len(client.journal.Pending()) != 0 {
+		t.Errorf("Position %f, pending %+v after the rejection", client.position.Size(), client.journal.Pending())
+	}
+
+	risk.Resume()
+	if err := client.ScaleIn(20000, 2); err != nil || client.position.Size() != 0.4 {
+		t.Errorf("ScaleIn = %v, position %f, want 0.4 bought", err, client.position.Size())
+	}
+}
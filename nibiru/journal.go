@@ -0,0 +1,247 @@
+package nibiru
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// States of an order in the journal
+const (
+	JOURNAL_INTENT string = "intent" // Written before the order is sent to the exchange
+	JOURNAL_SENT   string = "sent"   // Accepted by the exchange, not filled yet
+	JOURNAL_FILLED string = "filled" // Fill recorded in the position
+	JOURNAL_FAILED string = "failed" // Rejected, cancelled or never received by the exchange
+	// State of the bot, the fills before it are not replayed. Not an order, its client_oid is empty
+	JOURNAL_SNAPSHOT string = "snapshot"
+)
+
+// The journal is compacted to a snapshot once it has more entries
+const JOURNAL_SNAPSHOT_ENTRIES int = 1000
+
+// One line of the journal. The last entry of a client_oid gives the state of the order
+type JournalEntry struct {
+	Time      time.Time        `json:"time"`
+	ClientOid string           `json:"client_oid"`
+	State     string           `json:"state"`
+	ProductId string           `json:"product_id"`
+	Side      string           `json:"side"`
+	Price     float64          `json:"price"`
+	Size      float64          `json:"size"`
+	Fee       float64          `json:"fee,omitempty"`
+	OrderId   string           `json:"order_id,omitempty"`
+	Snapshot  *JournalSnapshot `json:"snapshot,omitempty"`
+}
+
+// Position of the bot when the snapshot was written
+type JournalSnapshot struct {
+	Lots     []Lot   `json:"lots"`
+	Tranches int     `json:"tranches"`
+	Realized float64 `json:"realized"`
+	Cash     float64 `json:"cash"` // Cash available, used in simulation only
+}
+
+// Write-ahead log of the orders: an intent is synced to disk before the order is sent,
+// so that after a crash the orders can be found on the exchange by their client_oid
+type Journal struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File // nil if the journal is disabled
+	entries []JournalEntry
+}
+
+// Read the existing entries of path and open it for append. The journal is disabled if path is empty
+func OpenJournal(path string) *Journal {
+	journal := &Journal{path: path}
+	if path == "" {
+		return journal
+	}
+	truncated := false
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry JournalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil { // Line truncated by the crash
+				GetLoggerInstance().Error("In journal/OpenJournal. Ignore the line %s: %s", scanner.Text(), err.Error())
+				continue
+			}
+			journal.entries = append(journal.entries, entry)
+		}
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			last := make([]byte, 1)
+			_, err = f.ReadAt(last, info.Size()-1)
+			truncated = err == nil && last[0] != '\n'
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		GetLoggerInstance().Error("In journal/OpenJournal. Can't open the journal %s: %s", path, err.Error())
+		os.Exit(1)
+	}
+	if truncated { // The next entry starts on a new line
+		f.Write([]byte{'\n'})
+	}
+	journal.file = f
+	return journal
+}
+
+// Append the entry and sync it to disk
+func (journal *Journal) Write(entry JournalEntry) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	journal.entries = append(journal.entries, entry)
+	if journal.file == nil {
+		return
+	}
+	js, _ := json.Marshal(entry)
+	if _, err := journal.file.Write(append(js, '\n')); err != nil {
+		GetLoggerInstance().Error("In journal/Write. %s", err.Error())
+		os.Exit(1)
+	}
+	if err := journal.file.Sync(); err != nil {
+		GetLoggerInstance().Error("In journal/Write. %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Write a new state of the order of entry
+func (journal *Journal) Transition(entry JournalEntry, state string) {
+	entry.Time = time.Now()
+	entry.State = state
+	journal.Write(entry)
+}
+
+// Orders in state intent or sent, in the order they were created
+func (journal *Journal) Pending() []JournalEntry {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return journal.pending()
+}
+
+// Must be called locked
+func (journal *Journal) pending() []JournalEntry {
+	last := map[string]JournalEntry{}
+	var oids []string
+	for _, entry := range journal.entries {
+		if entry.State == JOURNAL_SNAPSHOT {
+			continue
+		}
+		if _, ok := last[entry.ClientOid]; !ok {
+			oids = append(oids, entry.ClientOid)
+		}
+		last[entry.ClientOid] = entry
+	}
+	var pending []JournalEntry
+	for _, oid := range oids {
+		if state := last[oid].State; state == JOURNAL_INTENT || state == JOURNAL_SENT {
+			pending = append(pending, last[oid])
+		}
+	}
+	return pending
+}
+
+// Last snapshot of productId, nil if none, and the filled orders since, in the order of the fills
+func (journal *Journal) Fills(productId string) (*JournalSnapshot, []JournalEntry) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	var snapshot *JournalSnapshot
+	var fills []JournalEntry
+	for _, entry := range journal.entries {
+		if entry.ProductId != productId {
+			continue
+		}
+		switch entry.State {
+		case JOURNAL_SNAPSHOT:
+			snapshot = entry.Snapshot
+			fills = nil
+		case JOURNAL_FILLED:
+			fills = append(fills, entry)
+		}
+	}
+	return snapshot, fills
+}
+
+func (journal *Journal) Len() int {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return len(journal.entries)
+}
+
+// Replace the journal by the snapshot followed by the pending orders. The new journal is written aside
+// then renamed, a crash leaves either the old or the new one
+func (journal *Journal) Snapshot(productId string, snapshot JournalSnapshot) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entries := append([]JournalEntry{{Time: time.Now(), State: JOURNAL_SNAPSHOT, ProductId: productId, Snapshot: &snapshot}}, journal.pending()...)
+	if journal.file == nil {
+		journal.entries = entries
+		return
+	}
+	tmp := journal.path + ".tmp"
+	if err := writeJournal(tmp, entries); err != nil {
+		GetLoggerInstance().Error("In journal/Snapshot. The journal is not compacted: %s", err.Error())
+		os.Remove(tmp)
+		return
+	}
+	journal.file.Close()
+	if err := os.Rename(tmp, journal.path); err != nil {
+		GetLoggerInstance().Error("In journal/Snapshot. The journal is not compacted: %s", err.Error())
+	} else {
+		journal.entries = entries
+	}
+	f, err := os.OpenFile(journal.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		GetLoggerInstance().Error("In journal/Snapshot. Can't open the journal %s: %s", journal.path, err.Error())
+		os.Exit(1)
+	}
+	journal.file = f
+	GetLoggerInstance().Info("Journal - Compacted to a snapshot and %d pending orders", len(entries)-1)
+}
+
+// Write the entries to a new file synced to disk
+func writeJournal(path string, entries []JournalEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		js, _ := json.Marshal(entry)
+		w.Write(append(js, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (journal *Journal) Close() {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file != nil {
+		journal.file.Close()
+		journal.file = nil
+	}
+}
+
+// Random UUID (version 4), the format required for client_oid
+func newClientOid() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		GetLoggerInstance().Error("In journal/newClientOid. %s", err.Error())
+		os.Exit(1)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,153 @@
+package nibiru
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Journal of path with an intent, a sent order, a buy then a sell filled, and a line truncated by a crash
+func writeTestJournal(t *testing.T, path string) {
+	t.Helper()
+	journal := OpenJournal(path)
+	intent := JournalEntry{time.Now(), "oid-intent", JOURNAL_INTENT, "BTC-EUR", "buy", 20000, 0.1, 0, "", nil}
+	sent := JournalEntry{time.Now(), "oid-sent", JOURNAL_INTENT, "BTC-EUR", "sell", 21000, 0.05, 0, "", nil}
+	buy := JournalEntry{time.Now(), "oid-buy", JOURNAL_INTENT, "BTC-EUR", "buy", 20000, 0.2, 0, "", nil}
+	sell := JournalEntry{time.Now(), "oid-sell", JOURNAL_INTENT, "BTC-EUR", "sell", 22000, 0.1, 0, "", nil}
+	journal.Write(buy)
+	buy.Fee = 12
+	journal.Transition(buy, JOURNAL_SENT)
+	journal.Transition(buy, JOURNAL_FILLED)
+	journal.Write(sell)
+	sell.Fee = 6.6
+	journal.Transition(sell, JOURNAL_FILLED)
+	journal.Write(sent)
+	journal.Transition(sent, JOURNAL_SENT)
+	journal.Write(intent)
+	journal.Close()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2026-01-01T00:00:00Z","client_oid":"oid-trunc`)
+	f.Close()
+}
+
+// Reopened, the journal gives the last state of each order
+func TestJournalRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nibiru.journal")
+	writeTestJournal(t, path)
+	journal := OpenJournal(path)
+	defer journal.Close()
+
+	pending := journal.Pending()
+	if len(pending) != 2 || pending[0].ClientOid != "oid-sent" || pending[0].State != JOURNAL_SENT || pending[1].ClientOid != "oid-intent" || pending[1].State != JOURNAL_INTENT {
+		t.Errorf("Pending = %+v, want oid-sent sent then oid-intent", pending)
+	}
+	snapshot, fills := journal.Fills("BTC-EUR")
+	if snapshot != nil || len(fills) != 2 || fills[0].ClientOid != "oid-buy" || fills[0].Fee != 12 || fills[1].ClientOid != "oid-sell" || fills[1].Fee != 6.6 {
+		t.Errorf("Fills = %+v, %+v, want the buy then the sell", snapshot, fills)
+	}
+	if _, fills := journal.Fills("ETH-EUR"); len(fills) != 0 {
+		t.Errorf("Fills of ETH-EUR = %+v", fills)
+	}
+}
+
+// Client in simulation on the journal of path, with 8000 of cash. Its fills are indexed on a stub accepting every document
+func newJournalClient(t *testing.T, path string) *GdaxClient {
+	t.Helper()
+	elastic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"result":"created"}`))
+	}))
+	t.Cleanup(elastic.Close)
+	return &GdaxClient{productId: "BTC-EUR", cashAvailable: 8000, elasticClient: &ElasticClient{elasticURL: elastic.URL, httpClient: elastic.Client()},
+		simu: &Simulation{fee: 0.3}, sizer: allInSizer{}, position: NewPosition(LOTS_FIFO), journal: OpenJournal(path)}
+}
+
+// The pending simulated orders fail, the position and the cash (fees included) are rebuilt from the fills
+func TestGdaxClientRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nibiru.journal")
+	writeTestJournal(t, path)
+	client := newJournalClient(t, path)
+	if !client.recover() {
+		t.Fatal("recover = false, want the journal replayed")
+	}
+	if pending := client.journal.Pending(); len(pending) != 0 {
+		t.Errorf("Pending after recover = %+v, want the simulated orders failed", pending)
+	}
+	if size := client.position.Size(); math.Abs(size-0.1) > 1e-9 || client.position.AverageEntry() != 20000 || client.tranches != 1 {
+		t.Errorf("Position %f at %f, %d tranches, want 0.1 at 20000, 1 tranche", size, client.position.AverageEntry(), client.tranches)
+	}
+	if cash := 8000 - 4000 - 12 + 2200 - 6.6; math.Abs(client.cashAvailable-cash) > 1e-9 {
+		t.Errorf("Cash %f, want %f", client.cashAvailable, cash)
+	}
+	if realized := 2200 - 6.6 - 2006; math.Abs(client.position.Realized()-realized) > 1e-9 {
+		t.Errorf("Realized %f, want %f", client.position.Realized(), realized)
+	}
+	client.journal.Close()
+	reopened := OpenJournal(path) // The failures are written after the truncated line
+	if pending := reopened.Pending(); len(pending) != 0 {
+		t.Errorf("Pending reopened after recover = %+v, want none", pending)
+	}
+	reopened.Close()
+
+	if empty := newJournalClient(t, ""); empty.recover() {
+		t.Error("recover of an empty journal = true, want Init.Side used")
+	}
+}
+
+// After a snapshot, the journal holds the snapshot and the pending orders, only the fills since are replayed
+func TestJournalSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nibiru.journal")
+	writeTestJournal(t, path)
+	journal := OpenJournal(path)
+	journal.Snapshot("BTC-EUR", JournalSnapshot{})
+	if pending := journal.Pending(); journal.Len() != 3 || len(pending) != 2 || pending[0].ClientOid != "oid-sent" || pending[1].ClientOid != "oid-intent" {
+		t.Errorf("Pending after the snapshot = %+v, want oid-sent then oid-intent kept", pending)
+	}
+	journal.Close()
+	if journal = OpenJournal(path); journal.Len() != 3 {
+		t.Errorf("%d entries reopened after the snapshot, want 3", journal.Len())
+	}
+	journal.Close()
+
+	writeTestJournal(t, path)
+	client := newJournalClient(t, path)
+	client.recover()
+	cash := client.cashAvailable
+	client.Close() // Snapshot
+	if data, _ := os.ReadFile(path + ".tmp"); data != nil {
+		t.Error("Temporary journal left")
+	}
+
+	journal = OpenJournal(path)
+	if journal.Len() != 1 {
+		t.Errorf("%d entries after the snapshot, want the snapshot only", journal.Len())
+	}
+	journal.Write(JournalEntry{time.Now(), "oid-after", JOURNAL_FILLED, "BTC-EUR", "buy", 21000, 0.1, 6.3, "", nil})
+	journal.Close()
+
+	client = newJournalClient(t, path)
+	snapshot, fills := client.journal.Fills("BTC-EUR")
+	if snapshot == nil || len(snapshot.Lots) != 1 || len(fills) != 1 || fills[0].ClientOid != "oid-after" {
+		t.Fatalf("Fills = %+v, %+v, want the snapshot and the buy after", snapshot, fills)
+	}
+	if !client.recover() {
+		t.Fatal("recover = false, want the snapshot restored")
+	}
+	if size := client.position.Size(); math.Abs(size-0.2) > 1e-9 || client.tranches != 2 {
+		t.Errorf("Position %f, %d tranches, want 0.2, 2 tranches", size, client.tranches)
+	}
+	if want := cash - 2100 - 6.3; math.Abs(client.cashAvailable-want) > 1e-9 {
+		t.Errorf("Cash %f, want %f", client.cashAvailable, want)
+	}
+	if realized := 2200 - 6.6 - 2006; math.Abs(client.position.Realized()-realized) > 1e-9 {
+		t.Errorf("Realized %f, want %f", client.position.Realized(), realized)
+	}
+	client.journal.Close()
+}
@@ -0,0 +1,17 @@
+package nibiru
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The tests don't read config.json: the logger writes in the temp dir, the feeds are stale after 2 seconds
+func TestMain(m *testing.M) {
+	onceConfig.Do(func() {
+		instance = &Config{}
+		instance.ConsoleLog = filepath.Join(os.TempDir(), "nibiru-test.log")
+		instance.Websocket.StaleSeconds = 2
+	})
+	os.Exit(m.Run())
+}
@@ -0,0 +1,288 @@
+package nibiru
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the market events
+const (
+	EVENT_TRADE      string = "trade"
+	EVENT_BOOK       string = "book"
+	EVENT_TICKER     string = "ticker"
+	EVENT_HEARTBEAT  string = "heartbeat"
+	EVENT_STATUS     string = "status"
+	EVENT_CONNECTION string = "connection"
+)
+
+// What Publish does when the queue of a subscriber is full
+const (
+	POLICY_BLOCK string = "block" // Wait for the subscriber, for the consumers which must see every event
+	POLICY_DROP  string = "drop"  // Drop the event for this subscriber only
+)
+
+// Size of the queues of the subscribers
+const (
+	BUS_QUEUE_SIZE       int = 10000
+	BUS_SMALL_QUEUE_SIZE int = 100 // For the consumers only interested in the last events
+)
+
+// Connection states of the websocket clients
+const (
+	CONNECTION_UP      string = "up" // Connected, and the missed matches backfilled
+	CONNECTION_DOWN    string = "down"
+	CONNECTION_STALE   string = "stale" // Connected, but the feed stopped delivering, it is reconnected
+	CONNECTION_STOPPED string = "stopped"
+)
+
+// Market data published by the websocket clients. The concrete type is given by Type()
+type MarketEvent interface {
+	Type() string
+}
+
+// Match. Venue is mainVenue() for the main exchange
+type TradeEvent struct {
+	Venue     string    `json:"venue"`
+	ProductId string    `json:"product_id"`
+	TradeId   int       `json:"trade_id"`
+	Time      time.Time `json:"time"`
+	Price     float64   `json:"price"`
+	Size      float64   `json:"size"`
+	Side      string    `json:"side"`               // Side of the maker
+	Backfill  bool      `json:"backfill,omitempty"` // Missed during a reconnection, fetched through the REST API
+}
+
+type BookChange struct {
+	Side  string  `json:"side"`
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"` // 0 when the level is removed
+}
+
+// Snapshot or update of the order book
+type BookEvent struct {
+	Venue     string       `json:"venue"`
+	ProductId string       `json:"product_id"`
+	Time      time.Time    `json:"time"`
+	Snapshot  bool         `json:"snapshot"` // The changes replace the whole book
+	Changes   []BookChange `json:"changes"`
+}
+
+type TickerEvent struct {
+	Venue     string    `json:"venue"`
+	ProductId string    `json:"product_id"`
+	Time      time.Time `json:"time"`
+	Price     float64   `json:"price"`
+	BestBid   float64   `json:"best_bid"`
+	BestAsk   float64   `json:"best_ask"`
+}
+
+type HeartbeatEvent struct {
+	Venue       string    `json:"venue"`
+	ProductId   string    `json:"product_id"`
+	Time        time.Time `json:"time"`
+	LastTradeId int       `json:"last_trade_id"`
+	Sequence    int64     `json:"sequence"`
+}
+
+// Trading status of a product
+type StatusEvent struct {
+	Venue           string    `json:"venue"`
+	ProductId       string    `json:"product_id"`
+	Time            time.Time `json:"time"`
+	Status          string    `json:"status"` // online, offline, delisted...
+	Message         string    `json:"message,omitempty"`
+	TradingDisabled bool      `json:"trading_disabled"`
+	CancelOnly      bool      `json:"cancel_only"`
+	PostOnly        bool      `json:"post_only"`
+	LimitOnly       bool      `json:"limit_only"`
+}
+
+// Why the market orders of the bot can't be sent, empty if they can
+func (event *StatusEvent) Restriction() string {
+	switch {
+	case event.Status != "" && event.Status != "online":
+		return event.Status
+	case event.TradingDisabled:
+		return "trading disabled"
+	case event.CancelOnly:
+		return "cancel only"
+	case event.PostOnly:
+		return "post only"
+	case event.LimitOnly:
+		return "limit only"
+	}
+	return ""
+}
+
+type ConnectionEvent struct {
+	Venue     string    `json:"venue"`
+	ProductId string    `json:"product_id"`
+	URL       string    `json:"url"`
+	Time      time.Time `json:"time"`
+	State     string    `json:"state"`         // CONNECTION_UP, CONNECTION_DOWN, CONNECTION_STALE or CONNECTION_STOPPED
+	Err       string    `json:"err,omitempty"` // Cause of CONNECTION_DOWN or CONNECTION_STALE
+}
+
+func (event *TradeEvent) Type() string      { return EVENT_TRADE }
+func (event *BookEvent) Type() string       { return EVENT_BOOK }
+func (event *TickerEvent) Type() string     { return EVENT_TICKER }
+func (event *HeartbeatEvent) Type() string  { return EVENT_HEARTBEAT }
+func (event *StatusEvent) Type() string     { return EVENT_STATUS }
+func (event *ConnectionEvent) Type() string { return EVENT_CONNECTION }
+
+// In-process publish/subscribe of the market events. Each subscriber has its own bounded queue, consumed by its
+// own goroutine, so that a slow consumer doesn't block the websocket read loop unless its policy is POLICY_BLOCK
+type MarketBus struct {
+	mutex         sync.RWMutex // Write locked to add or close subscriptions, read locked to publish
+	subscriptions []*BusSubscription
+	closed        bool
+}
+
+type BusSubscription struct {
+	name    string
+	types   map[string]bool // Empty for every type
+	policy  string
+	queue   chan MarketEvent
+	dropped int64
+	done    chan struct{}
+}
+
+var instanceMarketBus *MarketBus
+var onceMarketBus sync.Once
+
+func GetMarketBusInstance() *MarketBus {
+	onceMarketBus.Do(func() {
+		instanceMarketBus = NewMarketBus()
+	})
+	return instanceMarketBus
+}
+
+func NewMarketBus() *MarketBus {
+	return &MarketBus{}
+}
+
+// handler is called with the events of the given types (all if none), in the order they were published
+func (bus *MarketBus) Subscribe(name string, queueSize int, policy string, handler func(event MarketEvent), types ...string) *BusSubscription {
+	subscription := &BusSubscription{name, map[string]bool{}, policy, make(chan MarketEvent, queueSize), 0, make(chan struct{})}
+	for _, t := range types {
+		subscription.types[t] = true
+	}
+	go func() {
+		defer close(subscription.done)
+		for event := range subscription.queue {
+			handler(event)
+		}
+	}()
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.closed {
+		close(subscription.queue)
+		return subscription
+	}
+	bus.subscriptions = append(bus.subscriptions, subscription)
+	return subscription
+}
+
+func (bus *MarketBus) Publish(event MarketEvent) {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	if bus.closed {
+		return
+	}
+	for _, subscription := range bus.subscriptions {
+		if len(subscription.types) > 0 && !subscription.types[event.Type()] {
+			continue
+		}
+		if subscription.policy == POLICY_BLOCK {
+			subscription.queue <- event
+			continue
+		}
+		select {
+		case subscription.queue <- event:
+		default:
+			if dropped := atomic.AddInt64(&subscription.dropped, 1); dropped%1000 == 1 {
+				GetLoggerInstance().Error("MarketBus - Queue of %s full, %d events dropped", subscription.name, dropped)
+			}
+		}
+	}
+}
+
+// Stop publishing, and wait for the subscribers to consume the events queued
+func (bus *MarketBus) Close() {
+	bus.mutex.Lock()
+	if bus.closed {
+		bus.mutex.Unlock()
+		return
+	}
+	bus.closed = true
+	subscriptions := bus.subscriptions
+	for _, subscription := range subscriptions {
+		close(subscription.queue)
+	}
+	bus.mutex.Unlock()
+	for _, subscription := range subscriptions {
+		<-subscription.done
+		if dropped := subscription.Dropped(); dropped > 0 {
+			GetLoggerInstance().Info("MarketBus - %s closed, %d events dropped", subscription.name, dropped)
+		}
+	}
+}
+
+// Events dropped because the queue was full
+func (subscription *BusSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&subscription.dropped)
+}
+
+// Events waiting in the queue
+func (subscription *BusSubscription) Pending() int {
+	return len(subscription.queue)
+}
+
+// Subscribe the consumers of the ingester: the match indexers, the divergence monitor, the broker publisher and the
+// market socket if configured
+func SubscribeIngestConsumers(bus *MarketBus) {
+	bus.Subscribe("orders-store", BUS_QUEUE_SIZE, POLICY_BLOCK, NewOrdersStore().OnMarketEvent, EVENT_TRADE)
+	for _, venue := range GetConfigInstance().Divergence.Venues {
+		bus.Subscribe("orders-store-"+venue.name(), BUS_QUEUE_SIZE, POLICY_BLOCK, NewVenueOrdersStore(venue.name()).OnMarketEvent, EVENT_TRADE)
+	}
+	bus.Subscribe("divergence", BUS_QUEUE_SIZE, POLICY_DROP, GetDivergenceMonitorInstance().OnMarketEvent, EVENT_TRADE)
+	if publisher := GetBrokerPublisherInstance(); publisher != nil {
+		bus.Subscribe("broker", BUS_QUEUE_SIZE, POLICY_DROP, publisher.OnMarketEvent, EVENT_TRADE, EVENT_TICKER, EVENT_CONNECTION, EVENT_STATUS)
+	}
+	if server := GetMarketSocketServerInstance(); server != nil {
+		bus.Subscribe("market-socket", BUS_QUEUE_SIZE, POLICY_BLOCK, server.OnMarketEvent, EVENT_TRADE, EVENT_TICKER, EVENT_CONNECTION, EVENT_STATUS)
+	}
+}
+
+// Subscribe the consumers of the trader: the candles, the volumes, the quotes, the position guard and the feed monitor
+func SubscribeTradeConsumers(bus *MarketBus) {
+	bus.Subscribe("candles", BUS_QUEUE_SIZE, POLICY_BLOCK, GetCandleBuilderInstance().OnMarketEvent, EVENT_TRADE)
+	bus.Subscribe("volumes", BUS_QUEUE_SIZE, POLICY_BLOCK, GetVolumeWindowsInstance().OnMarketEvent, EVENT_TRADE)
+	bus.Subscribe("quotes", BUS_SMALL_QUEUE_SIZE, POLICY_BLOCK, GetMarketQuotesInstance().OnMarketEvent, EVENT_TRADE, EVENT_TICKER)
+	bus.Subscribe("position-guard", BUS_SMALL_QUEUE_SIZE, POLICY_DROP, GetPositionGuardInstance().OnMarketEvent, EVENT_TRADE)
+	bus.Subscribe("feed-monitor", BUS_SMALL_QUEUE_SIZE, POLICY_BLOCK, GetFeedMonitorInstance().OnMarketEvent, EVENT_CONNECTION, EVENT_STATUS)
+}
+
+// Decode an event encoded in JSON by the ingester. Only the trade, ticker, connection and status events are transmitted
+func decodeMarketEvent(eventType string, data []byte) (MarketEvent, error) {
+	var event MarketEvent
+	switch eventType {
+	case EVENT_TRADE:
+		event = &TradeEvent{}
+	case EVENT_TICKER:
+		event = &TickerEvent{}
+	case EVENT_CONNECTION:
+		event = &ConnectionEvent{}
+	case EVENT_STATUS:
+		event = &StatusEvent{}
+	default:
+		return nil, fmt.Errorf("unknown market event type %s", eventType)
+	}
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
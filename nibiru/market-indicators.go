@@ -0,0 +1,133 @@
+package nibiru
+
+import (
+	"algo-trading/indicators"
+	"sync"
+	"time"
+)
+
+const defaultIndicatorsPeriod int = 14
+
+// Values of the indicators on the last closed candle
+type IndicatorsSnapshot struct {
+	Time          time.Time // Start of the last candle
+	Close         float64
+	Ready         bool // false until all the indicators are ready
+	SMA           float64
+	EMA           float64
+	RSI           float64
+	MACD          float64
+	MACDSignal    float64
+	MACDHistogram float64
+	BollingerUp   float64
+	BollingerLow  float64
+	ATR           float64
+	VWAP          float64 // Since 00:00 UTC
+	OBV           float64
+	DonchianUp    float64
+	DonchianLow   float64
+}
+
+// Standard indicators computed on the candles of the traded product, at Indicators.Interval
+type MarketIndicators struct {
+	mutex     sync.Mutex
+	productId string
+	interval  string
+	sma       *indicators.SMA
+	ema       *indicators.EMA
+	rsi       *indicators.RSI
+	macd      *indicators.MACD
+	bollinger *indicators.Bollinger
+	atr       *indicators.ATR
+	vwap      *indicators.VWAP
+	obv       *indicators.OBV
+	donchian  *indicators.Donchian
+	snapshot  IndicatorsSnapshot
+}
+
+var instanceMarketIndicators *MarketIndicators
+var onceMarketIndicators sync.Once
+
+func GetMarketIndicatorsInstance() *MarketIndicators {
+	onceMarketIndicators.Do(func() {
+		productId := GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency
+		period := GetConfigInstance().Indicators.Period
+		if period == 0 {
+			period = defaultIndicatorsPeriod
+		}
+		market, err := NewMarketIndicators(productId, GetConfigInstance().Indicators.Interval, period)
+		if err != nil {
+			GetLoggerInstance().Error("In market-indicators/GetMarketIndicatorsInstance. Period %d: %s, %d used", period, err.Error(), defaultIndicatorsPeriod)
+			market, _ = NewMarketIndicators(productId, GetConfigInstance().Indicators.Interval, defaultIndicatorsPeriod)
+		}
+		instanceMarketIndicators = market
+		GetCandleBuilderInstance().Subscribe(instanceMarketIndicators.onCandle)
+	})
+	return instanceMarketIndicators
+}
+
+// Indicators of the candles of productId at interval. An error if period is 0 or less
+func NewMarketIndicators(productId string, interval string, period int) (*MarketIndicators, error) {
+	market := &MarketIndicators{productId: productId, interval: interval, vwap: indicators.NewVWAP(), obv: indicators.NewOBV()}
+	var err error
+	if market.sma, err = indicators.NewSMA(period); err != nil {
+		return nil, err
+	}
+	if market.ema, err = indicators.NewEMA(period); err != nil {
+		return nil, err
+	}
+	if market.rsi, err = indicators.NewRSI(period); err != nil {
+		return nil, err
+	}
+	if market.macd, err = indicators.NewMACD(12, 26, 9); err != nil {
+		return nil, err
+	}
+	if market.bollinger, err = indicators.NewBollinger(period, 2); err != nil {
+		return nil, err
+	}
+	if market.atr, err = indicators.NewATR(period); err != nil {
+		return nil, err
+	}
+	if market.donchian, err = indicators.NewDonchian(period); err != nil {
+		return nil, err
+	}
+	return market, nil
+}
+
+func (market *MarketIndicators) onCandle(candle Candle) {
+	if candle.ProductId != market.productId || candle.Interval != market.interval {
+		return
+	}
+	bar := indicators.Bar{Open: candle.Open, High: candle.High, Low: candle.Low, Close: candle.Close, Volume: candle.Volume}
+
+	market.mutex.Lock()
+	defer market.mutex.Unlock()
+	if !market.snapshot.Time.IsZero() && candle.Time.UTC().Day() != market.snapshot.Time.UTC().Day() {
+		market.vwap.Reset()
+	}
+	market.snapshot = IndicatorsSnapshot{
+		Time:          candle.Time,
+		Close:         candle.Close,
+		SMA:           market.sma.Update(candle.Close),
+		EMA:           market.ema.Update(candle.Close),
+		RSI:           market.rsi.Update(candle.Close),
+		MACD:          market.macd.Update(candle.Close),
+		MACDSignal:    market.macd.Signal(),
+		MACDHistogram: market.macd.Histogram(),
+		ATR:           market.atr.UpdateBar(bar),
+		VWAP:          market.vwap.UpdateBar(bar),
+		OBV:           market.obv.UpdateBar(bar),
+	}
+	market.bollinger.Update(candle.Close)
+	market.snapshot.BollingerUp, market.snapshot.BollingerLow = market.bollinger.Upper(), market.bollinger.Lower()
+	market.donchian.UpdateBar(bar)
+	market.snapshot.DonchianUp, market.snapshot.DonchianLow = market.donchian.Upper(), market.donchian.Lower()
+	market.snapshot.Ready = market.sma.Ready() && market.ema.Ready() && market.rsi.Ready() && market.macd.Ready() &&
+		market.bollinger.Ready() && market.atr.Ready() && market.donchian.Ready()
+}
+
+func (market *MarketIndicators) Snapshot() IndicatorsSnapshot {
+	market.mutex.Lock()
+	defer market.mutex.Unlock()
+	return market.snapshot
+}
@@ -0,0 +1,109 @@
+package nibiru
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Last trade and best bid and ask of a product
+type Quote struct {
+	Price      float64
+	PriceTime  time.Time // Of the last trade, zero if none was received
+	BestBid    float64
+	BestAsk    float64
+	TickerTime time.Time // Of the last ticker, zero if none was received
+}
+
+// Quotes of the products of the main exchange, from the trades and tickers of the market bus.
+// Used for the prices of the orders of the algo, of the position guard and of the kill switch
+type MarketQuotes struct {
+	mutex  sync.Mutex
+	quotes map[string]*Quote // By product
+}
+
+var instanceMarketQuotes *MarketQuotes
+var onceMarketQuotes sync.Once
+
+func GetMarketQuotesInstance() *MarketQuotes {
+	onceMarketQuotes.Do(func() {
+		instanceMarketQuotes = NewMarketQuotes()
+	})
+	return instanceMarketQuotes
+}
+
+func NewMarketQuotes() *MarketQuotes {
+	return &MarketQuotes{quotes: map[string]*Quote{}}
+}
+
+func (quotes *MarketQuotes) OnMarketEvent(event MarketEvent) {
+	switch event := event.(type) {
+	case *TradeEvent:
+		if event.Venue != mainVenue() {
+			return
+		}
+		quotes.mutex.Lock()
+		defer quotes.mutex.Unlock()
+		quote := quotes.quote(event.ProductId)
+		if !event.Time.Before(quote.PriceTime) { // The backfilled trades can be older
+			quote.Price = event.Price
+			quote.PriceTime = event.Time
+		}
+	case *TickerEvent:
+		if event.Venue != mainVenue() || event.BestBid <= 0 || event.BestAsk <= 0 {
+			return
+		}
+		quotes.mutex.Lock()
+		defer quotes.mutex.Unlock()
+		quote := quotes.quote(event.ProductId)
+		quote.BestBid = event.BestBid
+		quote.BestAsk = event.BestAsk
+		quote.TickerTime = event.Time
+	}
+}
+
+// Called locked
+func (quotes *MarketQuotes) quote(productId string) *Quote {
+	quote, ok := quotes.quotes[productId]
+	if !ok {
+		quote = &Quote{}
+		quotes.quotes[productId] = quote
+	}
+	return quote
+}
+
+// false if neither a trade nor a ticker of productId was received
+func (quotes *MarketQuotes) Get(productId string) (Quote, bool) {
+	quotes.mutex.Lock()
+	defer quotes.mutex.Unlock()
+	quote, ok := quotes.quotes[productId]
+	if !ok {
+		return Quote{}, false
+	}
+	return *quote, true
+}
+
+// Price of the last trade of productId
+func (quotes *MarketQuotes) LastPrice(productId string) (float64, error) {
+	quote, ok := quotes.Get(productId)
+	if !ok || quote.PriceTime.IsZero() {
+		return 0, fmt.Errorf("no trade of %s received", productId)
+	}
+	return quote.Price, nil
+}
+
+// Price a market order of side would get: the best ask to buy, the best bid to sell.
+// The last trade price if the last ticker is older than the last trade
+func (quotes *MarketQuotes) OrderPrice(productId string, side string) (float64, error) {
+	quote, ok := quotes.Get(productId)
+	if !ok {
+		return 0, fmt.Errorf("no trade nor ticker of %s received", productId)
+	}
+	if quote.TickerTime.IsZero() || quote.TickerTime.Before(quote.PriceTime) {
+		return quotes.LastPrice(productId)
+	}
+	if side == "buy" {
+		return quote.BestAsk, nil
+	}
+	return quote.BestBid, nil
+}
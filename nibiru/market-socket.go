@@ -0,0 +1,155 @@
+package nibiru
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines waiting to be sent to a trader, a trader further behind is disconnected
+const SOCKET_CLIENT_QUEUE_SIZE int = 10000
+
+// Line of the market socket: the type of the event and the event in JSON
+type socketLine struct {
+	Type  string          `json:"type"`
+	Event json.RawMessage `json:"event"`
+}
+
+// Streams the trade, ticker, connection and status events of the ingester to the traders reading it ("trade": {"source": "socket"}),
+// one JSON line per event. A trader connecting first receives the last connection and status events of each feed
+type MarketSocketServer struct {
+	mutex   sync.Mutex
+	addr    string
+	clients map[*socketClient]bool
+	states  map[string][]byte // Last connection and status lines by type, venue and product
+}
+
+type socketClient struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+var instanceMarketSocketServer *MarketSocketServer
+var onceMarketSocketServer sync.Once
+
+// nil if Ingest.SocketAddr isn't set
+func GetMarketSocketServerInstance() *MarketSocketServer {
+	onceMarketSocketServer.Do(func() {
+		if addr := GetConfigInstance().Ingest.SocketAddr; addr != "" {
+			instanceMarketSocketServer = NewMarketSocketServer(addr)
+		}
+	})
+	return instanceMarketSocketServer
+}
+
+// addr: host:port, or unix:<path> for a unix socket
+func NewMarketSocketServer(addr string) *MarketSocketServer {
+	return &MarketSocketServer{addr: addr, clients: map[*socketClient]bool{}, states: map[string][]byte{}}
+}
+
+// unix:<path> is a unix socket, anything else a TCP address
+func socketAddress(addr string) (network string, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+func (server *MarketSocketServer) OnMarketEvent(event MarketEvent) {
+	data, err := json.Marshal(event)
+	if err == nil {
+		data, err = json.Marshal(socketLine{event.Type(), data})
+	}
+	if err != nil {
+		GetLoggerInstance().Error("In market-socket/OnMarketEvent. Encoding %s: %s", event.Type(), err.Error())
+		return
+	}
+	line := append(data, '\n')
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch event := event.(type) {
+	case *ConnectionEvent:
+		server.states[EVENT_CONNECTION+"/"+event.Venue+"/"+event.ProductId] = line
+	case *StatusEvent:
+		server.states[EVENT_STATUS+"/"+event.Venue+"/"+event.ProductId] = line
+	}
+	for client := range server.clients {
+		select {
+		case client.queue <- line:
+		default:
+			GetLoggerInstance().Error("MarketSocketServer - %s too slow, disconnected", client.conn.RemoteAddr().String())
+			server.remove(client)
+		}
+	}
+}
+
+// Accept the traders until ctx is cancelled, then disconnect them. An error if addr can't be listened on
+func (server *MarketSocketServer) Run(ctx context.Context) error {
+	network, address := socketAddress(server.addr)
+	if network == "unix" {
+		os.Remove(address) // Left by a process killed
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	defer closeOnDone(ctx, func() { listener.Close() })()
+	GetLoggerInstance().Info("MarketSocketServer - Listen on %s", server.addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			for client := range server.clients {
+				server.remove(client)
+			}
+			server.mutex.Unlock()
+			if ctx.Err() != nil {
+				GetLoggerInstance().Info("MarketSocketServer - Stopped")
+				return nil
+			}
+			return err
+		}
+		server.add(conn)
+	}
+}
+
+func (server *MarketSocketServer) add(conn net.Conn) {
+	GetLoggerInstance().Info("MarketSocketServer - %s connected", conn.RemoteAddr().String())
+	client := &socketClient{conn, make(chan []byte, SOCKET_CLIENT_QUEUE_SIZE)}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, line := range server.states {
+		client.queue <- line
+	}
+	server.clients[client] = true
+	go server.write(client)
+}
+
+// Called with the mutex locked
+func (server *MarketSocketServer) remove(client *socketClient) {
+	if !server.clients[client] {
+		return
+	}
+	delete(server.clients, client)
+	close(client.queue)
+	client.conn.Close()
+}
+
+func (server *MarketSocketServer) write(client *socketClient) {
+	for line := range client.queue {
+		client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := client.conn.Write(line); err != nil {
+			GetLoggerInstance().Info("MarketSocketServer - %s disconnected: %s", client.conn.RemoteAddr().String(), err.Error())
+			server.mutex.Lock()
+			server.remove(client)
+			server.mutex.Unlock()
+			return
+		}
+	}
+}
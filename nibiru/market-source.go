@@ -0,0 +1,284 @@
+package nibiru
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of Trade.Source
+const (
+	SOURCE_ELASTIC string = "elastic"
+	SOURCE_BROKER  string = "broker"
+	SOURCE_SOCKET  string = "socket"
+)
+
+const (
+	// Matches read by request from Elasticsearch
+	ELASTIC_SOURCE_PAGE int = 1000
+
+	// A match is searchable after the refresh of its index, possibly after more recent ones: each poll reads again
+	// the matches of this period, the ones already published are skipped
+	ELASTIC_SOURCE_LOOKBACK = time.Duration(10) * time.Second
+)
+
+// Market events of the trader, read from an ingester (nibiru ingest). Run publishes them on the bus until ctx is
+// cancelled. A lost ingester is reconnected with the backoff of the websockets, a connection event CONNECTION_DOWN
+// pausing the algo meanwhile, and an error is returned after Websocket.MaxRetries failures in a row
+type MarketSource interface {
+	Run(ctx context.Context) error
+}
+
+// Source of Trade.Source, for the product of the algo
+func NewMarketSource(bus *MarketBus) (MarketSource, error) {
+	config := GetConfigInstance()
+	productId := config.Init.Crypto + "-" + config.Init.Currency
+	switch config.Trade.Source {
+	case "", SOURCE_ELASTIC:
+		return &elasticSource{NewElasticClient(), bus, productId, time.Now()}, nil
+	case SOURCE_BROKER:
+		if config.Broker.URL == "" {
+			return nil, errors.New("broker.url is required by the broker source")
+		}
+		return &brokerSource{config.Broker.URL, brokerSubject(), bus, productId, nil}, nil
+	case SOURCE_SOCKET:
+		if config.Trade.SocketAddr == "" {
+			return nil, errors.New("trade.socketAddr is required by the socket source")
+		}
+		return &socketSource{config.Trade.SocketAddr, bus, productId}, nil
+	}
+	return nil, fmt.Errorf("incorrect value of trade.source: %s. Values accepted: %s, %s, %s", config.Trade.Source, SOURCE_ELASTIC, SOURCE_BROKER, SOURCE_SOCKET)
+}
+
+// true if source polls the matches indexed in Elasticsearch
+func isElasticSource(source MarketSource) bool {
+	_, ok := source.(*elasticSource)
+	return ok
+}
+
+// Run session until ctx is cancelled. session calls connected once connected to url, and returns why it stopped
+func runSource(ctx context.Context, bus *MarketBus, productId string, url string, session func(ctx context.Context, connected func()) error) error {
+	GetLoggerInstance().Info("Read the market events of %s on: %s", productId, url)
+	maxRetries, base, max := retryConfig()
+	failures := 0
+	for {
+		err := session(ctx, func() { failures = 0 })
+		if ctx.Err() == nil {
+			GetLoggerInstance().Error("In market-source/runSource: %s", err.Error())
+			publishSourceConnection(bus, productId, url, CONNECTION_DOWN, err)
+			failures++
+			if failures > maxRetries {
+				return fmt.Errorf("%d failures in a row on %s, giving up", failures, url)
+			}
+			wait := backoff(base, max, failures)
+			GetLoggerInstance().Info("Reconnection %d/%d to %s in %s", failures, maxRetries, url, wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			GetLoggerInstance().Info("Stop reading %s", url)
+			publishSourceConnection(bus, productId, url, CONNECTION_STOPPED, nil)
+			return nil
+		}
+	}
+}
+
+// State of the connection to the ingester, published as the one of the feed of the main exchange
+func publishSourceConnection(bus *MarketBus, productId string, url string, state string, err error) {
+	event := &ConnectionEvent{mainVenue(), productId, url, time.Now(), state, ""}
+	if err != nil {
+		event.Err = "ingester: " + err.Error()
+	}
+	bus.Publish(event)
+}
+
+// Call closeConn when ctx is cancelled, until the function returned is called
+func closeOnDone(ctx context.Context, closeConn func()) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConn()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Polls the matches indexed by the ingester. The connection events only tell whether Elasticsearch answers,
+// the state of the feed of the ingester isn't known
+type elasticSource struct {
+	elasticClient *ElasticClient
+	bus           *MarketBus
+	productId     string
+	last          time.Time // Most recent match published
+}
+
+func (source *elasticSource) Run(ctx context.Context) error {
+	period := time.Duration(GetConfigInstance().Trade.PollSeconds) * time.Second
+	if period <= 0 {
+		period = time.Second
+	}
+	seen := newTradeSet(SEEN_TRADES_MAX)
+	return runSource(ctx, source.bus, source.productId, source.elasticClient.elasticURL, func(ctx context.Context, connected func()) error {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		up := false
+		for {
+			if err := source.poll(seen); err != nil {
+				return err
+			}
+			if !up {
+				connected()
+				publishSourceConnection(source.bus, source.productId, source.elasticClient.elasticURL, CONNECTION_UP, nil)
+				up = true
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// Publish the matches since the last one published, minus ELASTIC_SOURCE_LOOKBACK, not seen yet
+func (source *elasticSource) poll(seen *tradeSet) error {
+	from := source.last.Add(-ELASTIC_SOURCE_LOOKBACK)
+	for {
+		matches, err := source.elasticClient.ListMatches(source.productId, from, ELASTIC_SOURCE_PAGE)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if !seen.add(sourceMatchKey(match)) {
+				continue
+			}
+			if match.MatchTime.After(source.last) {
+				source.last = match.MatchTime
+			}
+			source.bus.Publish(&TradeEvent{mainVenue(), match.ProductId, match.TradeId, match.MatchTime, match.Price, match.Size, match.Side, false})
+		}
+		// A full page continues after its last match, unless all its matches have the same time
+		if len(matches) < ELASTIC_SOURCE_PAGE || !matches[len(matches)-1].MatchTime.After(from) {
+			return nil
+		}
+		from = matches[len(matches)-1].MatchTime
+	}
+}
+
+// Id of the match document, or its content when the trade id is unknown
+func sourceMatchKey(match MatchDocument) string {
+	if id := matchId(match.ProductId, match.TradeId); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s-%d-%g-%g-%s", match.ProductId, match.MatchTime.UnixNano(), match.Price, match.Size, match.Side)
+}
+
+// Subscribes to the trade, ticker, connection and status events published on the broker by the ingester
+type brokerSource struct {
+	url       string
+	subject   string
+	bus       *MarketBus
+	productId string
+	last      *ConnectionEvent // Last connection event of the ingester
+}
+
+// Subject kinds of the broker publisher, by type of event
+var brokerEventTypes = map[string]string{"trades": EVENT_TRADE, "ticker": EVENT_TICKER, "connection": EVENT_CONNECTION, "status": EVENT_STATUS}
+
+func (source *brokerSource) Run(ctx context.Context) error {
+	return runSource(ctx, source.bus, source.productId, redactNatsURL(source.url), source.session)
+}
+
+func (source *brokerSource) session(ctx context.Context, connected func()) error {
+	conn, err := dialNats(source.url, "nibiru-trader")
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	defer closeOnDone(ctx, conn.close)()
+	sid := 0
+	for kind := range brokerEventTypes {
+		sid++
+		if err := conn.subscribe(source.subject+"."+kind+"."+mainVenue()+"."+source.productId, strconv.Itoa(sid)); err != nil {
+			return err
+		}
+	}
+	connected()
+	// The broker doesn't keep the messages: the feed is in the state last received, or up
+	if source.last != nil {
+		state := *source.last
+		state.Time = time.Now()
+		source.bus.Publish(&state)
+	} else {
+		publishSourceConnection(source.bus, source.productId, redactNatsURL(source.url), CONNECTION_UP, nil)
+	}
+	for {
+		subject, payload, err := conn.next()
+		if err != nil {
+			return err
+		}
+		kind := strings.SplitN(strings.TrimPrefix(subject, source.subject+"."), ".", 2)[0]
+		event, err := decodeMarketEvent(brokerEventTypes[kind], payload)
+		if err != nil {
+			GetLoggerInstance().Error("In market-source/session. Message on %s: %s", subject, err.Error())
+			continue
+		}
+		if connection, ok := event.(*ConnectionEvent); ok {
+			source.last = connection
+		}
+		source.bus.Publish(event)
+	}
+}
+
+// Reads the market socket of the ingester, which first sends the last connection and status events of its feeds
+type socketSource struct {
+	addr      string
+	bus       *MarketBus
+	productId string
+}
+
+func (source *socketSource) Run(ctx context.Context) error {
+	return runSource(ctx, source.bus, source.productId, source.addr, source.session)
+}
+
+func (source *socketSource) session(ctx context.Context, connected func()) error {
+	network, address := socketAddress(source.addr)
+	dialer := net.Dialer{Timeout: writeWait}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, func() { conn.Close() })()
+	connected()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := socketLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("invalid line from %s: %s", source.addr, err.Error())
+		}
+		event, err := decodeMarketEvent(line.Type, line.Event)
+		if err != nil {
+			GetLoggerInstance().Error("In market-source/session. Line from %s: %s", source.addr, err.Error())
+			continue
+		}
+		source.bus.Publish(event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed by the ingester")
+}
@@ -0,0 +1,245 @@
+package nibiru
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = time.Duration(5) * time.Second
+
+// Period of the client PINGs while the server sends nothing, by default. Without answer to a PING
+// for as long, the connection is considered lost
+const NATS_PING_SECONDS int = 30
+
+// Connection to a NATS server, text protocol. Writes are buffered until flush, reads must be done by one goroutine
+type natsConn struct {
+	mutex        sync.Mutex // Writes
+	conn         net.Conn
+	writer       *bufio.Writer
+	reader       *bufio.Reader
+	pingInterval time.Duration
+	pingSent     bool   // Without answer yet
+	partial      string // Line interrupted by the read deadline
+}
+
+// Fields of the INFO of the server used by the client
+type natsInfo struct {
+	AuthRequired bool `json:"auth_required"`
+	TLSRequired  bool `json:"tls_required"`
+}
+
+// Credentials of the CONNECT
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Protocol    int    `json:"protocol"`
+	TLSRequired bool   `json:"tls_required"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// rawURL: nats://[user:pass@|token@]host:port, tls://... to require TLS, or host:port. Port 4222 by default.
+// TLS is used if the scheme is tls or if the server requires it, with the CA of Broker.CAFile if set.
+// The connection is checked with a PING
+func dialNats(rawURL string, name string) (*natsConn, error) {
+	u, err := parseNatsURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL: %s", err.Error())
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", addr, natsDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	pingSeconds := GetConfigInstance().Broker.PingSeconds
+	if pingSeconds <= 0 {
+		pingSeconds = NATS_PING_SECONDS
+	}
+	nats := &natsConn{conn: conn, writer: bufio.NewWriter(conn), reader: bufio.NewReader(conn), pingInterval: time.Duration(pingSeconds) * time.Second}
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	if err := nats.handshake(u, name); err != nil {
+		nats.conn.Close()
+		return nil, fmt.Errorf("NATS handshake with %s: %s", addr, err.Error())
+	}
+	nats.conn.SetDeadline(time.Time{})
+	return nats, nil
+}
+
+func (nats *natsConn) handshake(u *url.URL, name string) error {
+	line, err := nats.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, received %s", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return fmt.Errorf("invalid INFO: %s", err.Error())
+	}
+	options := natsConnect{Name: name, Lang: "go", Protocol: 1}
+	if info.TLSRequired || u.Scheme == "tls" {
+		config, err := natsTLSConfig(u.Hostname())
+		if err != nil {
+			return err
+		}
+		tlsConn := tls.Client(nats.conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		nats.conn, nats.writer, nats.reader = tlsConn, bufio.NewWriter(tlsConn), bufio.NewReader(tlsConn)
+		options.TLSRequired = true
+	}
+	if password, ok := u.User.Password(); ok {
+		options.User, options.Pass = u.User.Username(), password
+	} else if u.User != nil {
+		options.AuthToken = u.User.Username()
+	}
+	if info.AuthRequired && options.User == "" && options.AuthToken == "" {
+		return errors.New("the server requires an authentication, no user nor token in the URL")
+	}
+	js, _ := json.Marshal(options)
+	nats.writer.WriteString("CONNECT " + string(js) + "\r\nPING\r\n")
+	if err := nats.writer.Flush(); err != nil {
+		return err
+	}
+	line, err = nats.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "PONG" {
+		return errors.New(line)
+	}
+	return nil
+}
+
+// Server certificate checked against the system roots, or the CA of Broker.CAFile
+func natsTLSConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if file := GetConfigInstance().Broker.CAFile; file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", file)
+		}
+	}
+	return config, nil
+}
+
+// nats:// if without scheme
+func parseNatsURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "nats://" + rawURL
+	}
+	return url.Parse(rawURL)
+}
+
+// URL without the user and password or the token, for the logs and the connection events
+func redactNatsURL(rawURL string) string {
+	if u, err := parseNatsURL(rawURL); err == nil && u.User != nil {
+		u.User = url.User("xxxxx")
+		return u.String()
+	}
+	return rawURL
+}
+
+func (nats *natsConn) publish(subject string, payload []byte) error {
+	nats.mutex.Lock()
+	defer nats.mutex.Unlock()
+	nats.conn.SetWriteDeadline(time.Now().Add(natsDialTimeout)) // The buffer is flushed when full
+	nats.writer.WriteString("PUB " + subject + " " + strconv.Itoa(len(payload)) + "\r\n")
+	nats.writer.Write(payload)
+	_, err := nats.writer.WriteString("\r\n")
+	return err
+}
+
+func (nats *natsConn) subscribe(subject string, sid string) error {
+	return nats.send("SUB " + subject + " " + sid + "\r\n")
+}
+
+func (nats *natsConn) flush() error {
+	return nats.send("")
+}
+
+// Write command and flush, a stalled server fails the write after natsDialTimeout
+func (nats *natsConn) send(command string) error {
+	nats.mutex.Lock()
+	defer nats.mutex.Unlock()
+	nats.conn.SetWriteDeadline(time.Now().Add(natsDialTimeout))
+	nats.writer.WriteString(command)
+	return nats.writer.Flush()
+}
+
+// Next message of the subscriptions. The PINGs of the server are answered, its errors returned.
+// The server is PINGed after pingInterval of silence, the connection is lost without answer after as long again
+func (nats *natsConn) next() (subject string, payload []byte, err error) {
+	for {
+		nats.conn.SetReadDeadline(time.Now().Add(nats.pingInterval))
+		line, err := nats.reader.ReadString('\n')
+		if err != nil {
+			var netError net.Error
+			if !errors.As(err, &netError) || !netError.Timeout() {
+				return "", nil, err
+			}
+			nats.partial += line
+			if nats.pingSent {
+				return "", nil, fmt.Errorf("no answer of the NATS server for %s", 2*nats.pingInterval)
+			}
+			nats.pingSent = true
+			if err := nats.send("PING\r\n"); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		line, nats.partial = nats.partial+line, ""
+		nats.pingSent = false // The server is alive
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			if err := nats.send("PONG\r\n"); err != nil {
+				return "", nil, err
+			}
+		case "MSG": // MSG <subject> <sid> [reply-to] <#bytes>\r\n<payload>\r\n
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if len(fields) < 4 || err != nil {
+				return "", nil, fmt.Errorf("invalid NATS message %s", strings.TrimSpace(line))
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(nats.reader, payload); err != nil {
+				return "", nil, err
+			}
+			return fields[1], payload[:size], nil
+		case "-ERR":
+			return "", nil, errors.New(strings.TrimSpace(line))
+		}
+	}
+}
+
+// Close the connection, next returns an error
+func (nats *natsConn) close() {
+	nats.conn.Close()
+}
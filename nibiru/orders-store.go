@@ -1,32 +1,27 @@
 package nibiru
 
-import (
-	api "github.com/preichenberger/go-coinbase-exchange"
-	//"time"
-	//"fmt"
-)
-
+// Indexes the matches of one venue
 type OrdersStore struct {
 	elasticClient *ElasticClient
+	venue         string
 }
 
 func NewOrdersStore() *OrdersStore {
 	elasticClient := NewElasticClient()
-	return &OrdersStore{elasticClient}
+	return &OrdersStore{elasticClient, mainVenue()}
+}
+
+// Matches of another exchange are indexed in <esMatchIndex>_<venue>
+func NewVenueOrdersStore(venue string) *OrdersStore {
+	return &OrdersStore{NewElasticClient().ForVenue(venue), venue}
 }
 
-func (store *OrdersStore) NewOrder(msg *api.Message) {
-	switch msg.Type {
-	case "match":
-		{
-			//GetLoggerInstance().ordersBooks.Println("[INFO] " + time.Now().Format("15:04:05") + " - OrdersStore - Adding match order")
-			//GetLoggerInstance().Info("OrdersStore - Adding match order")
-			store.elasticClient.IndexOrder(msg.Time.Time(), msg.ProductId, msg.Size, msg.Price, "")
-			store.elasticClient.IndexOrder(msg.Time.Time(), msg.ProductId, msg.Size, msg.Price, msg.Side)
-		}
-	default:
-		{
-			// ignore other types
-		}
+func (store *OrdersStore) OnMarketEvent(event MarketEvent) {
+	trade, ok := event.(*TradeEvent)
+	if !ok || trade.Venue != store.venue {
+		return
 	}
-}
\ No newline at end of file
+	//GetLoggerInstance().ordersBooks.Println("[INFO] " + time.Now().Format("15:04:05") + " - OrdersStore - Adding match order")
+	//GetLoggerInstance().Info("OrdersStore - Adding match order")
+	store.elasticClient.IndexMatch(trade.Time, trade.ProductId, trade.TradeId, trade.Size, trade.Price, trade.Side)
+}
@@ -0,0 +1,152 @@
+package nibiru
+
+import (
+	"sync"
+)
+
+// Types of exit levels, the value is a distance from the entry price
+const (
+	EXIT_ABSOLUTE string = "absolute" // value in currency
+	EXIT_PERCENT  string = "percent"  // value in % of the entry price
+	EXIT_ATR      string = "atr"      // value in multiples of the ATR at entry
+)
+
+type ExitLevelConfig struct {
+	Type  string  `json:"type"` // One of the EXIT_* constants, no level if empty
+	Value float64 `json:"value"`
+}
+
+// Stop loss and take profit of the open position, checked on every match.
+// When a level is hit, the whole position is sold even at a loss
+type PositionGuard struct {
+	mutex           sync.Mutex
+	gdaxClient      *GdaxClient
+	productId       string
+	armed           bool
+	exiting         bool // An exit order is being sent
+	entryPrice      float64
+	stopDistance    float64 // 0 if there is no stop loss
+	stopPrice       float64
+	takeProfitPrice float64 // 0 if there is no take profit
+	highestPrice    float64 // Since entry, for the trailing stop
+}
+
+var instancePositionGuard *PositionGuard
+var oncePositionGuard sync.Once
+
+func GetPositionGuardInstance() *PositionGuard {
+	oncePositionGuard.Do(func() {
+		instancePositionGuard = &PositionGuard{productId: GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency}
+	})
+	return instancePositionGuard
+}
+
+// The client used to exit the position
+func (guard *PositionGuard) attach(gdaxClient *GdaxClient) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.gdaxClient = gdaxClient
+}
+
+// Compute the levels of a position entered at entryPrice
+func (guard *PositionGuard) Arm(entryPrice float64) {
+	stopDistance := exitDistance(GetConfigInstance().Exits.StopLoss, entryPrice)
+	takeProfitDistance := exitDistance(GetConfigInstance().Exits.TakeProfit, entryPrice)
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.armed = true
+	guard.entryPrice = entryPrice
+	guard.highestPrice = entryPrice
+	guard.stopDistance = stopDistance
+	guard.stopPrice = 0
+	if stopDistance > 0 {
+		guard.stopPrice = entryPrice - stopDistance
+	}
+	guard.takeProfitPrice = 0
+	if takeProfitDistance > 0 {
+		guard.takeProfitPrice = entryPrice + takeProfitDistance
+	}
+	GetLoggerInstance().Info("PositionGuard - Armed, entry: %f, stop loss: %f, take profit: %f", entryPrice, guard.stopPrice, guard.takeProfitPrice)
+}
+
+func (guard *PositionGuard) Disarm() {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.armed = false
+}
+
+// Live trades of the main exchange. The backfilled ones are too old to trigger an exit
+func (guard *PositionGuard) OnMarketEvent(event MarketEvent) {
+	if trade, ok := event.(*TradeEvent); ok && trade.Venue == mainVenue() && !trade.Backfill {
+		guard.OnMatch(trade.ProductId, trade.Price)
+	}
+}
+
+func (guard *PositionGuard) OnMatch(productId string, price float64) {
+	guard.mutex.Lock()
+	if !guard.armed || guard.exiting || productId != guard.productId || guard.gdaxClient == nil {
+		guard.mutex.Unlock()
+		return
+	}
+	if GetConfigInstance().Exits.Trailing && price > guard.highestPrice {
+		guard.highestPrice = price
+		if guard.stopDistance > 0 {
+			guard.stopPrice = price - guard.stopDistance
+		}
+	}
+	var reason string
+	if guard.stopPrice > 0 && price <= guard.stopPrice {
+		reason = "stop loss"
+	} else if guard.takeProfitPrice > 0 && price >= guard.takeProfitPrice {
+		reason = "take profit"
+	}
+	if reason == "" {
+		guard.mutex.Unlock()
+		return
+	}
+	guard.armed = false // Exit once
+	guard.exiting = true
+	GetLoggerInstance().Info("PositionGuard - %s hit at %f, entry: %f, stop loss: %f, take profit: %f", reason, price, guard.entryPrice, guard.stopPrice, guard.takeProfitPrice)
+	gdaxClient := guard.gdaxClient
+	guard.mutex.Unlock()
+	// The REST calls of the exit don't block the consumer of the market bus
+	go guard.exit(gdaxClient, price, reason)
+}
+
+// Sell at the best bid if known, else at the price of the match. The exit disarms the guard.
+// If the order isn't sent the guard is armed again, the exit is retried on the next match
+func (guard *PositionGuard) exit(gdaxClient *GdaxClient, price float64, reason string) {
+	if bid, err := GetMarketQuotesInstance().OrderPrice(guard.productId, "sell"); err == nil {
+		price = bid
+	}
+	err := gdaxClient.ExitPosition(price, reason)
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.exiting = false
+	if err != nil {
+		GetLoggerInstance().Error("In position-guard/exit. %s failed, retried on the next match: %s", reason, err.Error())
+		guard.armed = true
+	}
+}
+
+func exitDistance(level ExitLevelConfig, entryPrice float64) float64 {
+	switch level.Type {
+	case "":
+		return 0
+	case EXIT_ABSOLUTE:
+		return level.Value
+	case EXIT_PERCENT:
+		return entryPrice * level.Value / 100
+	case EXIT_ATR:
+		snapshot := GetMarketIndicatorsInstance().Snapshot()
+		if snapshot.ATR <= 0 {
+			GetLoggerInstance().Error("In position-guard/exitDistance. ATR not available yet, no %s level", level.Type)
+			return 0
+		}
+		return snapshot.ATR * level.Value
+	default:
+		GetLoggerInstance().Error("In position-guard/exitDistance. Incorrect type of exit level: %s. Values accepted: %s, %s, %s", level.Type, EXIT_ABSOLUTE, EXIT_PERCENT, EXIT_ATR)
+		return 0
+	}
+}
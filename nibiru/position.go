@@ -0,0 +1,163 @@
+package nibiru
+
+import (
+	"sort"
+	"time"
+)
+
+// Order in which the sells consume the lots
+const (
+	LOTS_FIFO string = "fifo" // Oldest lots first (default)
+	LOTS_LIFO string = "lifo" // Newest lots first
+	LOTS_HIFO string = "hifo" // Highest price lots first
+)
+
+// Crypto bought by one buy fill
+type Lot struct {
+	Time  time.Time `json:"time"`
+	Price float64   `json:"price"`
+	Size  float64   `json:"size"` // Remaining size
+	Fee   float64   `json:"fee"`  // Remaining fee paid on the buy, in currency
+}
+
+// Part of a lot sold by a sell fill
+type Disposal struct {
+	Acquired  time.Time
+	Disposed  time.Time
+	Size      float64
+	CostBasis float64 // Buy price and fee
+	Proceeds  float64 // Sell price minus fee
+	Gain      float64
+}
+
+// Open position, made of the lots not sold yet
+type Position struct {
+	lots     []Lot
+	method   string
+	realized float64 // Gains of all the disposals, fees included
+}
+
+func NewPosition(method string) *Position {
+	if method != LOTS_LIFO && method != LOTS_HIFO {
+		method = LOTS_FIFO
+	}
+	return &Position{method: method}
+}
+
+func (position *Position) Size() float64 {
+	var size float64
+	for _, lot := range position.lots {
+		size += lot.Size
+	}
+	return size
+}
+
+// Average entry price of the lots, weighted by size
+func (position *Position) AverageEntry() float64 {
+	var size, cost float64
+	for _, lot := range position.lots {
+		size += lot.Size
+		cost += lot.Price * lot.Size
+	}
+	if size == 0 {
+		return 0
+	}
+	return cost / size
+}
+
+// Indices of the lots, in the order they are sold
+func (position *Position) order() []int {
+	indices := make([]int, len(position.lots))
+	for i := range indices {
+		indices[i] = i
+	}
+	switch position.method {
+	case LOTS_LIFO:
+		sort.SliceStable(indices, func(a, b int) bool { return position.lots[indices[a]].Time.After(position.lots[indices[b]].Time) })
+	case LOTS_HIFO:
+		sort.SliceStable(indices, func(a, b int) bool { return position.lots[indices[a]].Price > position.lots[indices[b]].Price })
+	}
+	return indices
+}
+
+// Cost (price and buy fees) of the next size sold
+func (position *Position) Cost(size float64) float64 {
+	var cost float64
+	for _, i := range position.order() {
+		if size <= 0 {
+			break
+		}
+		lot := position.lots[i]
+		part := size
+		if part > lot.Size {
+			part = lot.Size
+		}
+		cost += part*lot.Price + lot.Fee*part/lot.Size
+		size -= part
+	}
+	return cost
+}
+
+// Cost of all the lots
+func (position *Position) CostBasis() float64 {
+	return position.Cost(position.Size())
+}
+
+func (position *Position) Add(lot Lot) {
+	position.lots = append(position.lots, lot)
+}
+
+// Sell size at price, fee (in currency) paid on the whole sell. Returns the parts of the lots sold
+func (position *Position) Dispose(t time.Time, size float64, price float64, fee float64) []Disposal {
+	var disposals []Disposal
+	remaining := size
+	for _, i := range position.order() {
+		if remaining <= 0 {
+			break
+		}
+		lot := &position.lots[i]
+		part := remaining
+		if part > lot.Size {
+			part = lot.Size
+		}
+		costBasis := part*lot.Price + lot.Fee*part/lot.Size
+		proceeds := part*price - fee*part/size
+		disposals = append(disposals, Disposal{lot.Time, t, part, costBasis, proceeds, proceeds - costBasis})
+		lot.Fee -= lot.Fee * part / lot.Size
+		lot.Size -= part
+		remaining -= part
+		position.realized += proceeds - costBasis
+	}
+	var lots []Lot
+	for _, lot := range position.lots {
+		if lot.Size > 0 {
+			lots = append(lots, lot)
+		}
+	}
+	position.lots = lots
+	return disposals
+}
+
+func (position *Position) Realized() float64 {
+	return position.realized
+}
+
+// Gains if the position was sold at price, without the sell fee
+func (position *Position) Unrealized(price float64) float64 {
+	return position.Size()*price - position.CostBasis()
+}
+
+// Copy of the lots, for the snapshot of the journal
+func (position *Position) Lots() []Lot {
+	return append([]Lot(nil), position.lots...)
+}
+
+// Position of a snapshot
+func (position *Position) Restore(lots []Lot, realized float64) {
+	position.lots = append([]Lot(nil), lots...)
+	position.realized = realized
+}
+
+func (position *Position) Clear() {
+	position.lots = nil
+}
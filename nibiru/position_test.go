@@ -0,0 +1,107 @@
+package nibiru
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Three buys: 0.1 at 20000 (fee 2), 0.1 at 22000 (fee 4) then 0.1 at 21000 (fee 3)
+func newTestPosition(method string) (*Position, time.Time) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	position := NewPosition(method)
+	position.Add(Lot{day, 20000, 0.1, 2})
+	position.Add(Lot{day.Add(time.Hour), 22000, 0.1, 4})
+	position.Add(Lot{day.Add(2 * time.Hour), 21000, 0.1, 3})
+	return position, day
+}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// A sell of 0.15 at 23000, fee 6, consumes one lot and half of the next one in the order of the method
+func TestPositionDispose(t *testing.T) {
+	tests := []struct {
+		method   string
+		acquired []time.Duration // Of the lots sold, after the first buy
+		cost     []float64       // Price and buy fee of each part sold
+		left     []float64       // Prices of the lots left
+	}{
+		{LOTS_FIFO, []time.Duration{0, time.Hour}, []float64{2002, 1102}, []float64{22000, 21000}},
+		{LOTS_LIFO, []time.Duration{2 * time.Hour, time.Hour}, []float64{2103, 1102}, []float64{20000, 22000}},
+		{LOTS_HIFO, []time.Duration{time.Hour, 2 * time.Hour}, []float64{2204, 1051.5}, []float64{20000, 21000}},
+		{"", []time.Duration{0, time.Hour}, []float64{2002, 1102}, []float64{22000, 21000}}, // fifo by default
+	}
+	for _, test := range tests {
+		position, day := newTestPosition(test.method)
+		disposed := day.Add(3 * time.Hour)
+		disposals := position.Dispose(disposed, 0.15, 23000, 6)
+		if len(disposals) != 2 {
+			t.Fatalf("%s: %d disposals, want 2", test.method, len(disposals))
+		}
+		var gains float64
+		for i, disposal := range disposals {
+			proceeds := disposal.Size*23000 - 6*disposal.Size/0.15 // Sell fee pro-rated on the size
+			if !disposal.Acquired.Equal(day.Add(test.acquired[i])) || !disposal.Disposed.Equal(disposed) {
+				t.Errorf("%s: disposal %d acquired %s, want %s", test.method, i, disposal.Acquired, day.Add(test.acquired[i]))
+			}
+			if !near(disposal.CostBasis, test.cost[i]) || !near(disposal.Proceeds, proceeds) || !near(disposal.Gain, proceeds-test.cost[i]) {
+				t.Errorf("%s: disposal %d = %+v, want a cost basis of %f and proceeds of %f", test.method, i, disposal, test.cost[i], proceeds)
+			}
+			gains += disposal.Gain
+		}
+		if !near(disposals[0].Size, 0.1) || !near(disposals[1].Size, 0.05) {
+			t.Errorf("%s: sizes disposed %f and %f, want 0.1 and 0.05", test.method, disposals[0].Size, disposals[1].Size)
+		}
+		if !near(position.Realized(), gains) || !near(gains, 0.15*23000-6-test.cost[0]-test.cost[1]) {
+			t.Errorf("%s: realized %f, gains %f, want %f", test.method, position.Realized(), gains, 0.15*23000-6-test.cost[0]-test.cost[1])
+		}
+		if len(position.lots) != len(test.left) || !near(position.Size(), 0.15) {
+			t.Fatalf("%s: lots left %+v, want 0.15 at %v", test.method, position.lots, test.left)
+		}
+		for i, lot := range position.lots {
+			if lot.Price != test.left[i] {
+				t.Errorf("%s: lots left %+v, want the prices %v", test.method, position.lots, test.left)
+			}
+		}
+	}
+}
+
+// The fee of a lot is pro-rated on the part sold, the rest stays with the part left
+func TestPositionFees(t *testing.T) {
+	position := NewPosition(LOTS_FIFO)
+	position.Add(Lot{time.Now(), 20000, 0.4, 8})
+	if cost := position.Cost(0.1); !near(cost, 2002) {
+		t.Errorf("Cost(0.1) = %f, want 2002", cost)
+	}
+	if basis := position.CostBasis(); !near(basis, 8008) {
+		t.Errorf("CostBasis = %f, want 8008", basis)
+	}
+	disposals := position.Dispose(time.Now(), 0.1, 21000, 2.1)
+	if len(disposals) != 1 || !near(disposals[0].CostBasis, 2002) || !near(disposals[0].Proceeds, 2097.9) || !near(disposals[0].Gain, 95.9) {
+		t.Errorf("Dispose(0.1) = %+v, want a cost basis of 2002, proceeds of 2097.9", disposals)
+	}
+	if lot := position.lots[0]; !near(lot.Size, 0.3) || !near(lot.Fee, 6) {
+		t.Errorf("Lot left %+v, want 0.3 with a fee of 6", lot)
+	}
+	if unrealized := position.Unrealized(21000); !near(unrealized, 0.3*21000-6006) {
+		t.Errorf("Unrealized(21000) = %f, want %f", unrealized, 0.3*21000-6006)
+	}
+	if entry := position.AverageEntry(); entry != 20000 {
+		t.Errorf("AverageEntry = %f, want 20000", entry)
+	}
+}
+
+// Realized gains add up across the sells, the position is empty once all is sold
+func TestPositionRealized(t *testing.T) {
+	position, day := newTestPosition(LOTS_FIFO)
+	position.Dispose(day.Add(3*time.Hour), 0.1, 19000, 1.9) // -100 - 2 - 1.9
+	position.Dispose(day.Add(4*time.Hour), 0.2, 23000, 4.6) // +100 - 4 + 200 - 3 - 4.6
+	if !near(position.Realized(), -103.9+288.4) {
+		t.Errorf("Realized = %f, want %f", position.Realized(), -103.9+288.4)
+	}
+	if position.Size() != 0 || len(position.lots) != 0 || position.AverageEntry() != 0 || position.CostBasis() != 0 {
+		t.Errorf("Position %+v after selling all, want empty", position.lots)
+	}
+}
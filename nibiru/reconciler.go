@@ -0,0 +1,173 @@
+package nibiru
+
+import (
+	"math"
+	"time"
+
+	api "github.com/preichenberger/go-coinbase-exchange"
+)
+
+// Actions on a reconciliation mismatch
+const (
+	RECONCILE_ALERT string = "alert" // Log and index the mismatch only (default)
+	RECONCILE_HALT  string = "halt"  // Trigger the kill switch of the RiskManager
+	RECONCILE_ADOPT string = "adopt" // Replace the bot state by the exchange state
+)
+
+type Mismatch struct {
+	Item     string
+	Believed float64
+	Actual   float64
+}
+
+// Compare periodically the balances, holds and open orders the bot believes in with the exchange accounts and orders
+type Reconciler struct {
+	gdaxClient    *GdaxClient
+	elasticClient *ElasticClient
+	loop          *tickerLoop
+}
+
+func NewReconciler(gdaxClient *GdaxClient) *Reconciler {
+	return &Reconciler{gdaxClient, NewElasticClient(), nil}
+}
+
+func (reconciler *Reconciler) Run() {
+	period := GetConfigInstance().Reconciliation.PeriodMinutes
+	if period <= 0 {
+		return
+	}
+	GetLoggerInstance().Info("Run Reconciler ticker")
+	reconciler.loop = startTickerLoop(time.Duration(period)*time.Minute, func(time.Time) {
+		reconciler.Reconcile()
+	})
+}
+
+func (reconciler *Reconciler) Stop() {
+	reconciler.loop.Stop()
+}
+
+func (reconciler *Reconciler) Reconcile() []Mismatch {
+	if simulationActivated { // Balances are simulated
+		return nil
+	}
+	config := GetConfigInstance().Reconciliation
+	t := reconciler.gdaxClient
+
+	accounts, err := t.exchange.GetAccounts()
+	if err != nil {
+		GetLoggerInstance().Error("In reconciler/Reconcile. Failed getting accounts: %s", err.Error())
+		return nil
+	}
+	openOrders, err := t.exchange.ListOrders(t.productId, "open")
+	if err != nil {
+		GetLoggerInstance().Error("In reconciler/Reconcile. Failed listing open orders: %s", err.Error())
+		return nil
+	}
+
+	var crypto, cash api.Account
+	for _, a := range accounts {
+		if a.Currency == GetConfigInstance().Init.Crypto {
+			crypto = a
+		} else if a.Currency == GetConfigInstance().Init.Currency {
+			cash = a
+		}
+	}
+	t.mutex.Lock()
+	believedCrypto := t.position.Size()
+	believedCash := t.cashBalance
+	pending := t.journal.Pending()
+	t.mutex.Unlock()
+	// Only the orders of the bot not filled yet hold crypto or cash
+	var pendingCrypto, pendingCash float64
+	for _, entry := range pending {
+		if entry.Side == "sell" {
+			pendingCrypto += entry.Size
+		} else {
+			pendingCash += entry.Price * entry.Size
+		}
+	}
+
+	var mismatches []Mismatch
+	if math.Abs(crypto.Balance-believedCrypto) > config.CryptoTolerance {
+		mismatches = append(mismatches, Mismatch{"crypto balance", believedCrypto, crypto.Balance})
+	}
+	// The cash of the bot is capped by Init.LimitCashAvailable, only missing cash is a mismatch
+	if cash.Balance < believedCash-config.CashTolerance {
+		mismatches = append(mismatches, Mismatch{"cash balance", believedCash, cash.Balance})
+	}
+	if crypto.Hold > pendingCrypto+config.CryptoTolerance {
+		mismatches = append(mismatches, Mismatch{"crypto hold", pendingCrypto, crypto.Hold})
+	}
+	if cash.Hold > pendingCash+config.CashTolerance {
+		mismatches = append(mismatches, Mismatch{"cash hold", pendingCash, cash.Hold})
+	}
+	if len(openOrders) > len(pending) {
+		mismatches = append(mismatches, Mismatch{"open orders", float64(len(pending)), float64(len(openOrders))})
+	}
+
+	if len(mismatches) == 0 {
+		GetLoggerInstance().Info("Reconciler - OK, crypto: %f, cash: %f", believedCrypto, believedCash)
+		return nil
+	}
+	for _, mismatch := range mismatches {
+		GetLoggerInstance().Error("Reconciler - MISMATCH %s, bot: %f, exchange: %f", mismatch.Item, mismatch.Believed, mismatch.Actual)
+		reconciler.elasticClient.IndexAlert(time.Now(), t.productId, "reconciler", mismatch.Item, mismatch.Believed, mismatch.Actual)
+	}
+	switch config.OnMismatch {
+	case RECONCILE_HALT:
+		GetRiskManagerInstance().Kill("reconciliation mismatch")
+	case RECONCILE_ADOPT:
+		reconciler.adopt(crypto, cash)
+	}
+	return mismatches
+}
+
+// Rebuild the position from the exchange fills and take the exchange balances
+func (reconciler *Reconciler) adopt(crypto api.Account, cash api.Account) {
+	t := reconciler.gdaxClient
+	fills, err := t.exchange.ListFills(t.productId)
+	if err != nil {
+		GetLoggerInstance().Error("In reconciler/adopt. Failed listing fills: %s", err.Error())
+		return
+	}
+	sortFills(fills)
+	position, _ := BuildLedger(fills, GetConfigInstance().Accounting.LotMethod)
+	if math.Abs(position.Size()-crypto.Balance) > GetConfigInstance().Reconciliation.CryptoTolerance {
+		// Fills don't explain the balance (deposit, withdrawal, other product), the difference is a lot at the average entry
+		GetLoggerInstance().Error("Reconciler - Fills position %f differs from the balance %f", position.Size(), crypto.Balance)
+		position = NewPosition(GetConfigInstance().Accounting.LotMethod)
+		position.Add(Lot{time.Now(), reconciler.averageEntry(fills), crypto.Balance, 0})
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.position = position
+	t.cryptoAvailable = crypto.Available
+	t.cryptoHold = crypto.Hold
+	t.cashAvailable = limitCash(cash.Available)
+	t.cashHold = cash.Hold
+	t.cashBalance = t.cashAvailable + t.cashHold
+	if position.Size() > 0 {
+		t.tranches = maxTranches()
+		GetPositionGuardInstance().Arm(position.AverageEntry())
+	} else {
+		t.tranches = 0
+		GetPositionGuardInstance().Disarm()
+	}
+	GetLoggerInstance().Info("Reconciler - Exchange state adopted, position: %f, average entry: %f, cash: %f", position.Size(), position.AverageEntry(), t.cashAvailable)
+}
+
+// Average price of the buy fills
+func (reconciler *Reconciler) averageEntry(fills []Fill) float64 {
+	var size, cost float64
+	for _, fill := range fills {
+		if fill.Side == "buy" {
+			size += fill.Size
+			cost += fill.Size * fill.Price
+		}
+	}
+	if size == 0 {
+		return 0
+	}
+	return cost / size
+}
@@ -0,0 +1,248 @@
+package nibiru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GDAX rate limits, in requests per second by IP (public) and by profile (private)
+const (
+	REST_PUBLIC_RATE  float64 = 3
+	REST_PRIVATE_RATE float64 = 5
+	REST_MAX_RETRIES  int     = 3
+	REST_TIMEOUT      int     = 10  // In seconds, for one attempt
+	REST_BACKOFF      int     = 250 // In milliseconds, doubled on each retry
+)
+
+// Ceiling of the backoff without maximum
+const BACKOFF_MAX time.Duration = 5 * time.Minute
+
+// Error of a REST request to the exchange, once the retries are exhausted
+type APIError struct {
+	Operation  string // GET /accounts
+	StatusCode int    // 0 when no response was received
+	Message    string
+	temporary  bool
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Operation, e.Message)
+	}
+	return fmt.Sprintf("%s: status code %d: %s", e.Operation, e.StatusCode, e.Message)
+}
+
+// true for timeouts, network errors, 429 and 5xx: the request may succeed later
+func (e *APIError) Temporary() bool {
+	return e.temporary
+}
+
+// Convert an error of the exchange client to an APIError. Errors not raised by restTransport
+// are answers of the exchange (bad request, unauthorized...) and won't succeed later
+func restError(operation string, err error) *APIError {
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError
+	}
+	return &APIError{operation, 0, err.Error(), false}
+}
+
+func isTemporary(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// Token bucket: rate tokens per second, up to burst
+type TokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{sync.Mutex{}, rate, burst, burst, time.Now()}
+}
+
+// Take a token, waiting until one is available or ctx is done
+func (bucket *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		bucket.mutex.Lock()
+		now := time.Now()
+		bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+		bucket.last = now
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			bucket.mutex.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+		bucket.mutex.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Rate limits of the REST API of an exchange, in requests per second
+type restLimits struct {
+	publicRate  float64
+	privateRate float64
+	isPublic    func(path string) bool // Endpoints limited by IP, the others by account
+}
+
+func restLimitsOf(exchange string) restLimits {
+	switch exchange {
+	case EXCHANGE_COINBASE:
+		return restLimits{COINBASE_PUBLIC_RATE, COINBASE_PRIVATE_RATE, isCoinbasePublic}
+	case EXCHANGE_BINANCE:
+		return restLimits{BINANCE_PUBLIC_RATE, BINANCE_PRIVATE_RATE, isBinancePublic}
+	}
+	return restLimits{REST_PUBLIC_RATE, REST_PRIVATE_RATE, isGdaxPublic}
+}
+
+// http.RoundTripper of the exchange client: rate limit by endpoint class, deadline on each attempt,
+// retries with jitter on 429, 5xx and network errors. A POST or a DELETE may have been executed when
+// no answer is received: they are only retried on 429, the caller finds out what happened (see sendOrder)
+type restTransport struct {
+	base       http.RoundTripper
+	isPublic   func(path string) bool
+	public     *TokenBucket
+	private    *TokenBucket
+	maxRetries int
+	timeout    time.Duration
+}
+
+func newRestTransport(limits restLimits) *restTransport {
+	return &restTransport{http.DefaultTransport, limits.isPublic, NewTokenBucket(limits.publicRate, 2*limits.publicRate),
+		NewTokenBucket(limits.privateRate, 2*limits.privateRate), REST_MAX_RETRIES, time.Duration(REST_TIMEOUT) * time.Second}
+}
+
+func (transport *restTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := req.Method + " " + req.URL.Path
+	bucket := transport.private
+	if transport.isPublic(req.URL.Path) {
+		bucket = transport.public
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, &APIError{operation, 0, err.Error(), false}
+		}
+		req.Body.Close()
+	}
+
+	retried := isIdempotent(req.Method)
+	var lastError *APIError
+	var retryAfter time.Duration // Asked by the exchange on 429
+	for attempt := 0; attempt <= transport.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := transport.backoff(attempt)
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+			GetLoggerInstance().Info("REST - %s, retry %d/%d in %s", lastError.Error(), attempt, transport.maxRetries, wait)
+			select {
+			case <-req.Context().Done():
+				return nil, &APIError{operation, 0, req.Context().Err().Error(), true}
+			case <-time.After(wait):
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), transport.timeout)
+		if err := bucket.Wait(ctx); err != nil {
+			cancel()
+			lastError = &APIError{operation, 0, "rate limited: " + err.Error(), true}
+			continue
+		}
+		attemptReq := req.WithContext(ctx)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		res, err := transport.base.RoundTrip(attemptReq)
+		if err != nil {
+			cancel()
+			lastError = &APIError{operation, 0, err.Error(), true}
+			if !retried {
+				return nil, lastError
+			}
+			continue
+		}
+		if isTemporary(res.StatusCode) {
+			message, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			cancel()
+			lastError = &APIError{operation, res.StatusCode, string(message), true}
+			if !retried && res.StatusCode != http.StatusTooManyRequests { // Not executed on 429
+				return nil, lastError
+			}
+			if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+			continue
+		}
+		res.Body = &cancelBody{res.Body, cancel} // The deadline covers the reading of the body
+		return res, nil
+	}
+	return nil, lastError
+}
+
+// Requests without side effect, which can be sent again
+func isIdempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Market data endpoints of GDAX, limited by IP
+func isGdaxPublic(path string) bool {
+	return strings.HasPrefix(path, "/products") || strings.HasPrefix(path, "/currencies") || path == "/time"
+}
+
+func (transport *restTransport) backoff(attempt int) time.Duration {
+	return backoff(time.Duration(REST_BACKOFF)*time.Millisecond, 0, attempt)
+}
+
+// Exponential backoff with full jitter: random in ]0, base * 2^(attempt-1)], capped at max, BACKOFF_MAX if 0
+func backoff(base time.Duration, max time.Duration, attempt int) time.Duration {
+	if max <= 0 {
+		max = BACKOFF_MAX
+	}
+	ceiling := base
+	for i := 1; i < attempt && ceiling < max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > max || ceiling <= 0 {
+		ceiling = max
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + time.Millisecond
+}
+
+// Cancel the context of the request when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
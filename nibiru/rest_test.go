@@ -0,0 +1,61 @@
+package nibiru
+
+import (
+	"testing"
+	"time"
+)
+
+// The ceiling doubles on each attempt up to max, BACKOFF_MAX without max, even when the shift would overflow
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		max     time.Duration
+		attempt int
+		ceiling time.Duration
+	}{
+		{time.Second, 0, 1, time.Second},
+		{time.Second, 0, 3, 4 * time.Second},
+		{time.Second, 10 * time.Second, 5, 10 * time.Second},
+		{time.Second, 0, 100, BACKOFF_MAX},
+		{time.Second, time.Minute, 100, time.Minute},
+		{250 * time.Millisecond, 0, 0, 250 * time.Millisecond},
+		{0, 0, 1, BACKOFF_MAX},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if wait := backoff(test.base, test.max, test.attempt); wait <= 0 || wait > test.ceiling+time.Millisecond {
+				t.Fatalf("backoff(%s, %s, %d) = %s, want in ]0, %s]", test.base, test.max, test.attempt, wait, test.ceiling)
+			}
+		}
+	}
+}
+
+// Each exchange classifies its own market data endpoints as public
+func TestRestLimits(t *testing.T) {
+	tests := []struct {
+		exchange string
+		path     string
+		public   bool
+	}{
+		{EXCHANGE_GDAX, "/products/BTC-EUR/ticker", true},
+		{EXCHANGE_GDAX, "/orders", false},
+		{"", "/time", true},
+		{EXCHANGE_COINBASE, "/api/v3/brokerage/market/products/BTC-EUR/ticker", true},
+		{EXCHANGE_COINBASE, "/api/v3/brokerage/time", true},
+		{EXCHANGE_COINBASE, "/api/v3/brokerage/products/BTC-EUR", false},
+		{EXCHANGE_COINBASE, "/api/v3/brokerage/orders", false},
+		{EXCHANGE_BINANCE, "/api/v3/exchangeInfo", true},
+		{EXCHANGE_BINANCE, "/api/v3/ticker/bookTicker", true},
+		{EXCHANGE_BINANCE, "/api/v3/historicalTrades", true},
+		{EXCHANGE_BINANCE, "/api/v3/order", false},
+		{EXCHANGE_BINANCE, "/api/v3/myTrades", false},
+	}
+	for _, test := range tests {
+		if public := getRestTransport(test.exchange).isPublic(test.path); public != test.public {
+			t.Errorf("%s %s public = %t, want %t", test.exchange, test.path, public, test.public)
+		}
+	}
+	if getRestTransport(EXCHANGE_BINANCE) != getRestTransport(EXCHANGE_BINANCE) || getRestTransport("") != getRestTransport(EXCHANGE_GDAX) {
+		t.Error("Transports not shared by the clients of an exchange")
+	}
+}
@@ -0,0 +1,274 @@
+package nibiru
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Order rejected by the RiskManager
+type RiskRejection struct {
+	Reason string
+}
+
+func (e *RiskRejection) Error() string {
+	return "Order rejected: " + e.Reason
+}
+
+// Every order passes the RiskManager before being sent.
+// Orders reducing the position (sell) are never rejected, so that a position can always be exited
+type RiskManager struct {
+	mutex         sync.Mutex
+	elasticClient *ElasticClient
+	gdaxClient    *GdaxClient // Used to flatten the position on kill
+	productId     string
+	orders        []time.Time // Orders accepted in the last 24 hours
+	day           time.Time   // Day of realizedToday, in UTC
+	realizedToday float64
+	equityPeak    float64
+	equity        float64
+	killed        bool
+	killReason    string
+	fileLoop      *tickerLoop
+	signals       chan os.Signal
+	server        *http.Server
+}
+
+var instanceRiskManager *RiskManager
+var onceRiskManager sync.Once
+
+func GetRiskManagerInstance() *RiskManager {
+	onceRiskManager.Do(func() {
+		instanceRiskManager = &RiskManager{elasticClient: NewElasticClient(), productId: GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency}
+	})
+	return instanceRiskManager
+}
+
+func (risk *RiskManager) attach(gdaxClient *GdaxClient) {
+	risk.mutex.Lock()
+	defer risk.mutex.Unlock()
+	risk.gdaxClient = gdaxClient
+}
+
+const killSwitchFilePeriod = time.Duration(5) * time.Second
+
+// Watch the kill switch file, listen to the kill switch signal (SIGUSR1 kills, SIGUSR2 resumes) and, if configured, to its HTTP API
+func (risk *RiskManager) Run() {
+	if file := GetConfigInstance().Risk.KillSwitchFile; file != "" {
+		risk.fileLoop = startTickerLoop(killSwitchFilePeriod, func(time.Time) {
+			if _, err := os.Stat(file); err == nil && !risk.Killed() {
+				risk.Kill("file " + file)
+			}
+		})
+	}
+
+	risk.signals = make(chan os.Signal, 1)
+	signal.Notify(risk.signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func(signals chan os.Signal) {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				risk.Kill("signal " + sig.String())
+			} else {
+				risk.Resume()
+			}
+		}
+	}(risk.signals)
+
+	if addr := GetConfigInstance().Risk.KillSwitchAddr; addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/kill", func(w http.ResponseWriter, r *http.Request) {
+			if risk.authorize(w, r) {
+				risk.Kill("API from " + r.RemoteAddr)
+				fmt.Fprintln(w, "killed")
+			}
+		})
+		mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+			if risk.authorize(w, r) {
+				risk.Resume()
+				fmt.Fprintln(w, "resumed")
+			}
+		})
+		risk.server = &http.Server{Addr: addr, Handler: mux}
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				GetLoggerInstance().Error("In risk-manager/Run. Kill switch API stopped: %s", err.Error())
+			}
+		}(risk.server)
+	}
+}
+
+// Writes the error if the call is refused: not a POST, wrong Risk.KillSwitchToken, or without token from another host than loopback
+func (risk *RiskManager) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	if token := GetConfigInstance().Risk.KillSwitchToken; token != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Kill-Switch-Token")), []byte(token)) != 1 {
+			GetLoggerInstance().Error("In risk-manager/authorize. Kill switch API called from %s without the token", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		GetLoggerInstance().Error("In risk-manager/authorize. Kill switch API called from %s, not loopback", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Stop watching the kill switch file and the signals, and close the HTTP API
+func (risk *RiskManager) Stop() {
+	risk.fileLoop.Stop()
+	if risk.signals != nil {
+		signal.Stop(risk.signals)
+		close(risk.signals)
+		risk.signals = nil
+	}
+	if risk.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), killSwitchFilePeriod)
+		defer cancel()
+		if err := risk.server.Shutdown(ctx); err != nil {
+			GetLoggerInstance().Error("In risk-manager/Stop. Failed closing the kill switch API: %s", err.Error())
+		}
+		risk.server = nil
+	}
+}
+
+// Halt trading, and flatten the position if Risk.FlattenOnKill
+func (risk *RiskManager) Kill(reason string) {
+	risk.mutex.Lock()
+	risk.killed = true
+	risk.killReason = reason
+	gdaxClient := risk.gdaxClient
+	risk.mutex.Unlock()
+	GetLoggerInstance().Error("RiskManager - KILL SWITCH: %s, trading halted", reason)
+	if GetConfigInstance().Risk.FlattenOnKill && gdaxClient != nil {
+		price, err := GetMarketQuotesInstance().OrderPrice(gdaxClient.productId, "sell")
+		if err == nil {
+			err = gdaxClient.ExitPosition(price, "kill switch")
+		}
+		if err != nil {
+			GetLoggerInstance().Error("In risk-manager/Kill. Failed flattening the position: %s", err.Error())
+		}
+	}
+}
+
+func (risk *RiskManager) Resume() {
+	risk.mutex.Lock()
+	defer risk.mutex.Unlock()
+	if _, err := os.Stat(GetConfigInstance().Risk.KillSwitchFile); GetConfigInstance().Risk.KillSwitchFile != "" && err == nil {
+		GetLoggerInstance().Error("RiskManager - Can't resume, kill switch file %s exists", GetConfigInstance().Risk.KillSwitchFile)
+		return
+	}
+	risk.killed = false
+	GetLoggerInstance().Info("RiskManager - Trading resumed")
+}
+
+func (risk *RiskManager) Killed() bool {
+	risk.mutex.Lock()
+	defer risk.mutex.Unlock()
+	return risk.killed
+}
+
+// Returns a *RiskRejection if the order must not be sent. Accepted orders are counted
+func (risk *RiskManager) Check(side string, price float64, size float64, positionNotional float64) error {
+	risk.mutex.Lock()
+	reason := risk.rejectionReason(side, price, size, positionNotional)
+	if reason == "" {
+		risk.orders = append(risk.orders, time.Now())
+	}
+	risk.mutex.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+	GetLoggerInstance().Error("RiskManager - %s order of %f at %f rejected: %s", side, size, price, reason)
+	risk.elasticClient.IndexRiskRejection(time.Now(), risk.productId, side, price, size, reason)
+	return &RiskRejection{reason}
+}
+
+// Must be called locked
+func (risk *RiskManager) rejectionReason(side string, price float64, size float64, positionNotional float64) string {
+	config := GetConfigInstance().Risk
+	if side != "buy" {
+		return ""
+	}
+	if config.KillSwitchFile != "" { // Not yet seen by Run
+		if _, err := os.Stat(config.KillSwitchFile); err == nil {
+			return "kill switch (file " + config.KillSwitchFile + ")"
+		}
+	}
+	if risk.killed {
+		return "kill switch (" + risk.killReason + ")"
+	}
+	if config.MaxPositionNotional > 0 && positionNotional+price*size > config.MaxPositionNotional {
+		return fmt.Sprintf("position notional %f above %f", positionNotional+price*size, config.MaxPositionNotional)
+	}
+	risk.rollDay()
+	if config.MaxDailyLoss > 0 && -risk.realizedToday >= config.MaxDailyLoss {
+		return fmt.Sprintf("daily realized loss %f reached the limit %f", -risk.realizedToday, config.MaxDailyLoss)
+	}
+	if config.MaxDrawdown > 0 && risk.equityPeak > 0 {
+		if drawdown := (risk.equityPeak - risk.equity) / risk.equityPeak * 100; drawdown >= config.MaxDrawdown {
+			return fmt.Sprintf("drawdown %f%% from equity peak %f reached the limit %f%%", drawdown, risk.equityPeak, config.MaxDrawdown)
+		}
+	}
+	now := time.Now()
+	var lastDay []time.Time
+	var nbLastHour int
+	for _, t := range risk.orders {
+		if now.Sub(t) < 24*time.Hour {
+			lastDay = append(lastDay, t)
+			if now.Sub(t) < time.Hour {
+				nbLastHour++
+			}
+		}
+	}
+	risk.orders = lastDay
+	if config.MaxTradesPerDay > 0 && len(lastDay) >= config.MaxTradesPerDay {
+		return fmt.Sprintf("%d trades in the last 24 hours", len(lastDay))
+	}
+	if config.MaxTradesPerHour > 0 && nbLastHour >= config.MaxTradesPerHour {
+		return fmt.Sprintf("%d trades in the last hour", nbLastHour)
+	}
+	return ""
+}
+
+// Must be called locked
+func (risk *RiskManager) rollDay() {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !today.Equal(risk.day) {
+		risk.day = today
+		risk.realizedToday = 0
+	}
+}
+
+// Realized profit (or loss if negative) of a sell, fees included
+func (risk *RiskManager) RecordRealized(pnl float64) {
+	risk.mutex.Lock()
+	defer risk.mutex.Unlock()
+	risk.rollDay()
+	risk.realizedToday += pnl
+}
+
+// Equity (cash + crypto at the current price), for the drawdown
+func (risk *RiskManager) UpdateEquity(equity float64) {
+	risk.mutex.Lock()
+	defer risk.mutex.Unlock()
+	risk.equity = equity
+	if equity > risk.equityPeak {
+		risk.equityPeak = equity
+	}
+}
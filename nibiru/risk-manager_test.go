@@ -0,0 +1,144 @@
+package nibiru
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each limit of the config rejects the buy above it, the sells always pass
+func TestRiskManagerCheck(t *testing.T) {
+	killFile := filepath.Join(t.TempDir(), "kill")
+	tests := []struct {
+		name     string
+		setup    func(risk *RiskManager)
+		side     string
+		notional float64 // Position before the order
+		reason   string  // Prefix of the rejection, empty if accepted
+	}{
+		{"no limit", nil, "buy", 0, ""},
+		{"position notional", func(risk *RiskManager) { GetConfigInstance().Risk.MaxPositionNotional = 1500 }, "buy", 600, "position notional"},
+		{"position notional below", func(risk *RiskManager) { GetConfigInstance().Risk.MaxPositionNotional = 1500 }, "buy", 400, ""},
+		{"daily loss", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxDailyLoss = 100
+			risk.RecordRealized(-60)
+			risk.RecordRealized(-40)
+		}, "buy", 0, "daily realized loss"},
+		{"daily loss below", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxDailyLoss = 100
+			risk.RecordRealized(-60)
+			risk.RecordRealized(20)
+		}, "buy", 0, ""},
+		{"daily loss of yesterday", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxDailyLoss = 100
+			risk.RecordRealized(-200)
+			risk.day = risk.day.Add(-24 * time.Hour)
+		}, "buy", 0, ""},
+		{"drawdown", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxDrawdown = 10
+			risk.UpdateEquity(10000)
+			risk.UpdateEquity(8900)
+		}, "buy", 0, "drawdown"},
+		{"drawdown below", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxDrawdown = 10
+			risk.UpdateEquity(10000)
+			risk.UpdateEquity(9500)
+		}, "buy", 0, ""},
+		{"trades per day", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxTradesPerDay = 2
+			risk.orders = []time.Time{time.Now().Add(-23 * time.Hour), time.Now().Add(-2 * time.Hour)}
+		}, "buy", 0, "2 trades in the last 24 hours"},
+		{"trades per day expired", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxTradesPerDay = 2
+			risk.orders = []time.Time{time.Now().Add(-25 * time.Hour), time.Now().Add(-2 * time.Hour)}
+		}, "buy", 0, ""},
+		{"trades per hour", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxTradesPerHour = 1
+			risk.orders = []time.Time{time.Now().Add(-30 * time.Minute)}
+		}, "buy", 0, "1 trades in the last hour"},
+		{"trades per hour expired", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxTradesPerHour = 1
+			risk.orders = []time.Time{time.Now().Add(-90 * time.Minute)}
+		}, "buy", 0, ""},
+		{"killed", func(risk *RiskManager) { risk.killed, risk.killReason = true, "test" }, "buy", 0, "kill switch (test)"},
+		{"kill switch file", func(risk *RiskManager) {
+			GetConfigInstance().Risk.KillSwitchFile = killFile
+			os.WriteFile(killFile, nil, 0600)
+		}, "buy", 0, "kill switch (file "},
+		{"sell killed", func(risk *RiskManager) { risk.killed = true }, "sell", 0, ""},
+		{"sell above the limits", func(risk *RiskManager) {
+			GetConfigInstance().Risk.MaxPositionNotional = 100
+			GetConfigInstance().Risk.MaxTradesPerHour = 1
+			risk.orders = []time.Time{time.Now()}
+		}, "sell", 1000, ""},
+	}
+	config := GetConfigInstance().Risk
+	defer func() { GetConfigInstance().Risk = config }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			GetConfigInstance().Risk = config
+			os.Remove(killFile)
+			risk := &RiskManager{elasticClient: &ElasticClient{}, productId: "BTC-EUR"}
+			if test.setup != nil {
+				test.setup(risk)
+			}
+			nbOrders := len(risk.orders)
+			err := risk.Check(test.side, 20000, 0.05, test.notional) // 1000 of notional
+			if test.reason == "" {
+				if err != nil {
+					t.Fatalf("Check = %v, want the order accepted", err)
+				}
+				if len(risk.orders) == 0 || risk.orders[len(risk.orders)-1].Before(time.Now().Add(-time.Second)) {
+					t.Errorf("Order accepted not counted: %v", risk.orders)
+				}
+				return
+			}
+			rejection, ok := err.(*RiskRejection)
+			if !ok || !strings.HasPrefix(rejection.Reason, test.reason) {
+				t.Fatalf("Check = %v, want a rejection for %s", err, test.reason)
+			}
+			if len(risk.orders) > nbOrders {
+				t.Errorf("Order rejected counted: %v", risk.orders)
+			}
+		})
+	}
+}
+
+// Without token, the kill switch API only accepts the POSTs from loopback
+func TestRiskManagerAuthorize(t *testing.T) {
+	config := GetConfigInstance().Risk
+	defer func() { GetConfigInstance().Risk = config }()
+	tests := []struct {
+		token      string // Of the config
+		method     string
+		remoteAddr string
+		header     string
+		status     int
+	}{
+		{"", "POST", "127.0.0.1:5000", "", http.StatusOK},
+		{"", "POST", "[::1]:5000", "", http.StatusOK},
+		{"", "POST", "192.168.1.10:5000", "", http.StatusForbidden},
+		{"", "GET", "127.0.0.1:5000", "", http.StatusMethodNotAllowed},
+		{"secret", "POST", "192.168.1.10:5000", "secret", http.StatusOK},
+		{"secret", "POST", "127.0.0.1:5000", "", http.StatusUnauthorized},
+		{"secret", "POST", "127.0.0.1:5000", "other", http.StatusUnauthorized},
+	}
+	risk := &RiskManager{}
+	for _, test := range tests {
+		GetConfigInstance().Risk.KillSwitchToken = test.token
+		request := httptest.NewRequest(test.method, "/kill", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			request.Header.Set("X-Kill-Switch-Token", test.header)
+		}
+		recorder := httptest.NewRecorder()
+		risk.authorize(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s from %s with token %q (config %q) = %d, want %d", test.method, test.remoteAddr, test.header, test.token, recorder.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package nibiru
+
+import (
+	"time"
+)
+
+// Exit codes of the bot
+const (
+	EXIT_OK              int = 0
+	EXIT_SHUTDOWN_FAILED int = 1 // Open orders not cancelled, position not flattened, or shutdown too long
+	EXIT_CONNECTION_LOST int = 2 // The websocket, or the market source of the trader, couldn't be restored
+)
+
+// Values of Shutdown.OnExit
+const (
+	SHUTDOWN_NONE    string = "none"
+	SHUTDOWN_CANCEL  string = "cancel"
+	SHUTDOWN_FLATTEN string = "flatten"
+)
+
+// Stop the bot, in this order: the websocket listeners and the market source (stopListeners cancels them and waits
+// for them), so that no exit is triggered by a match, the market bus once its queued events are consumed, the algo after
+// its tick in progress, the candles and the divergence monitor.
+// Then cancel the open orders or flatten the position as configured, close the journal and flush the broker publisher.
+// algo is nil for the ingester, which has no order to cancel.
+// Returns exitCode, or EXIT_SHUTDOWN_FAILED on failure or after Shutdown.TimeoutSeconds
+func Shutdown(algo *Algo, stopListeners func(), exitCode int) int {
+	timeout := time.Duration(GetConfigInstance().Shutdown.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	done := make(chan bool, 1)
+	go func() {
+		done <- shutdown(algo, stopListeners)
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			return EXIT_SHUTDOWN_FAILED
+		}
+		GetLoggerInstance().Info("Shutdown - Done")
+		return exitCode
+	case <-time.After(timeout):
+		GetLoggerInstance().Error("In shutdown/Shutdown. Not done after %s", timeout)
+		return EXIT_SHUTDOWN_FAILED
+	}
+}
+
+func shutdown(algo *Algo, stopListeners func()) bool {
+	GetLoggerInstance().Info("Shutdown - Stop listening")
+	stopListeners()
+	GetMarketBusInstance().Close()
+	GetDivergenceMonitorInstance().Stop()
+	if algo == nil {
+		GetBrokerPublisherInstance().Close()
+		return true
+	}
+	algo.Stop()
+	GetCandleBuilderInstance().Stop()
+	GetRiskManagerInstance().Stop()
+
+	ok := true
+	switch onExit := GetConfigInstance().Shutdown.OnExit; onExit {
+	case "", SHUTDOWN_NONE:
+	case SHUTDOWN_CANCEL, SHUTDOWN_FLATTEN:
+		GetLoggerInstance().Info("Shutdown - Cancel the open orders")
+		if err := algo.gdaxClient.CancelOpenOrders(); err != nil {
+			GetLoggerInstance().Error("In shutdown/shutdown. Failed cancelling the open orders: %s", err.Error())
+			ok = false
+		}
+		if onExit == SHUTDOWN_FLATTEN {
+			GetLoggerInstance().Info("Shutdown - Flatten the position")
+			// The quotes of the market bus, all its events consumed. No price fails the shutdown
+			price, err := GetMarketQuotesInstance().OrderPrice(algo.gdaxClient.productId, "sell")
+			if err == nil {
+				err = algo.gdaxClient.ExitPosition(price, "shutdown")
+			}
+			if err != nil {
+				GetLoggerInstance().Error("In shutdown/shutdown. Failed flattening the position: %s", err.Error())
+				ok = false
+			}
+		}
+	default:
+		GetLoggerInstance().Error("In shutdown/shutdown. Incorrect value of onExit: %s. Values accepted: %s, %s, %s", onExit, SHUTDOWN_NONE, SHUTDOWN_CANCEL, SHUTDOWN_FLATTEN)
+		ok = false
+	}
+	algo.gdaxClient.Close()
+	GetBrokerPublisherInstance().Close()
+	return ok
+}
@@ -0,0 +1,201 @@
+package nibiru
+
+import (
+	"math"
+)
+
+// Closed trades of the ledger required to size with their Kelly stats, by default
+const KELLY_MIN_TRADES int = 20
+
+// Sizing policies of the buy orders
+const (
+	SIZING_ALL_IN         string = "allIn"            // All the equity, capped by the cash available minus the reserve (default)
+	SIZING_FIXED_NOTIONAL string = "fixedNotional"    // Sizing.Notional in currency
+	SIZING_FIXED_FRACTION string = "fixedFraction"    // Sizing.Fraction of the equity
+	SIZING_VOLATILITY     string = "volatilityTarget" // A move of one ATR changes the equity by Sizing.TargetVolatility %
+	SIZING_KELLY          string = "kelly"            // Sizing.KellyFraction of the Kelly criterion, from the stats of the ledger
+)
+
+// Notional of a full position, before the caps
+type Sizer interface {
+	Notional(price float64, cashAvailable float64, equity float64) float64
+}
+
+type allInSizer struct{}
+
+func (sizer allInSizer) Notional(price float64, cashAvailable float64, equity float64) float64 {
+	return equity
+}
+
+type fixedNotionalSizer struct {
+	notional float64
+}
+
+func (sizer fixedNotionalSizer) Notional(price float64, cashAvailable float64, equity float64) float64 {
+	return sizer.notional
+}
+
+type fixedFractionSizer struct {
+	fraction float64
+}
+
+func (sizer fixedFractionSizer) Notional(price float64, cashAvailable float64, equity float64) float64 {
+	return equity * sizer.fraction
+}
+
+type volatilitySizer struct {
+	targetVolatility float64 // in %
+}
+
+func (sizer volatilitySizer) Notional(price float64, cashAvailable float64, equity float64) float64 {
+	atr := GetMarketIndicatorsInstance().Snapshot().ATR
+	if atr <= 0 {
+		GetLoggerInstance().Error("In sizing/volatilitySizer. ATR not available yet, no order")
+		return 0
+	}
+	return equity * sizer.targetVolatility / 100 / atr * price
+}
+
+// Used under the lock of the GdaxClient
+type kellySizer struct {
+	productId string
+	winRate   float64 // Probability of a winning trade, from backtest stats until the ledger has minTrades trades
+	payoff    float64 // Average win / average loss, idem
+	fraction  float64 // Of the Kelly criterion, ex: 0.5 for half Kelly
+	minTrades int
+	disposals []Disposal // Of the ledger, loaded once, then of the sells recorded since
+	loaded    bool
+}
+
+// Sizers using the stats of the trades are told the disposals of each sell
+type disposalRecorder interface {
+	RecordDisposals(disposals []Disposal)
+}
+
+func (sizer *kellySizer) Notional(price float64, cashAvailable float64, equity float64) float64 {
+	winRate, payoff := sizer.stats()
+	if payoff <= 0 {
+		return 0
+	}
+	kelly := winRate - (1-winRate)/payoff
+	return equity * math.Max(kelly, 0) * sizer.fraction
+}
+
+// The ledger of the fills is loaded on the first call, and again on the next calls while it fails
+func (sizer *kellySizer) load() {
+	if sizer.loaded {
+		return
+	}
+	fills, err := LoadFills(sizer.productId)
+	if err != nil {
+		GetLoggerInstance().Error("In sizing/kellySizer. Failed loading the fills, backtest stats used: %s", err.Error())
+		return
+	}
+	_, disposals := BuildLedger(fills, GetConfigInstance().Accounting.LotMethod)
+	sizer.disposals = append(disposals, sizer.disposals...)
+	sizer.loaded = true
+}
+
+func (sizer *kellySizer) RecordDisposals(disposals []Disposal) {
+	sizer.disposals = append(sizer.disposals, disposals...)
+}
+
+// Win rate and payoff of the ledger of the fills, or the backtest stats while it has less than minTrades trades
+func (sizer *kellySizer) stats() (winRate float64, payoff float64) {
+	sizer.load()
+	if !sizer.loaded {
+		return sizer.winRate, sizer.payoff
+	}
+	trades, winRate, payoff := kellyStats(sizer.disposals)
+	if trades < sizer.minTrades {
+		return sizer.winRate, sizer.payoff
+	}
+	GetLoggerInstance().Info("Sizing - Kelly stats of %d trades, win rate: %f, payoff: %f", trades, winRate, payoff)
+	return winRate, payoff
+}
+
+// Each sell is a trade, its gain the sum of the gains of the lots it disposed of. The payoff is infinite without loss
+func kellyStats(disposals []Disposal) (trades int, winRate float64, payoff float64) {
+	gains := map[int64]float64{}
+	var sells []int64
+	for _, disposal := range disposals {
+		sell := disposal.Disposed.UnixNano()
+		if _, ok := gains[sell]; !ok {
+			sells = append(sells, sell)
+		}
+		gains[sell] += disposal.Gain
+	}
+	var wins, losses int
+	var won, lost float64
+	for _, sell := range sells {
+		if gain := gains[sell]; gain > 0 {
+			wins++
+			won += gain
+		} else {
+			losses++
+			lost -= gain
+		}
+	}
+	trades = wins + losses
+	if wins == 0 {
+		return trades, 0, 0
+	}
+	winRate = float64(wins) / float64(trades)
+	if lost <= 0 {
+		return trades, winRate, math.Inf(1)
+	}
+	return trades, winRate, (won / float64(wins)) / (lost / float64(losses))
+}
+
+func NewSizer() Sizer {
+	config := GetConfigInstance().Sizing
+	switch config.Policy {
+	case "", SIZING_ALL_IN:
+		return allInSizer{}
+	case SIZING_FIXED_NOTIONAL:
+		return fixedNotionalSizer{config.Notional}
+	case SIZING_FIXED_FRACTION:
+		return fixedFractionSizer{config.Fraction}
+	case SIZING_VOLATILITY:
+		return volatilitySizer{config.TargetVolatility}
+	case SIZING_KELLY:
+		minTrades := config.KellyMinTrades
+		if minTrades <= 0 {
+			minTrades = KELLY_MIN_TRADES
+		}
+		productId := GetConfigInstance().Init.Crypto + "-" + GetConfigInstance().Init.Currency
+		sizer := &kellySizer{productId, config.KellyWinRate, config.KellyPayoff, config.KellyFraction, minTrades, nil, false}
+		sizer.load() // At start, not under the lock of the orders
+		return sizer
+	default:
+		GetLoggerInstance().Error("In sizing/NewSizer. Incorrect sizing policy: %s. Values accepted: %s, %s, %s, %s, %s", config.Policy,
+			SIZING_ALL_IN, SIZING_FIXED_NOTIONAL, SIZING_FIXED_FRACTION, SIZING_VOLATILITY, SIZING_KELLY)
+		return allInSizer{}
+	}
+}
+
+// Size of the buy order: fraction of the policy notional (one tranche), capped by the cash available minus the reserve
+// and by Init.LimitCashAvailable, rounded down to the size increment. 0 if it is below the product minimum size
+func buySize(sizer Sizer, price float64, cashAvailable float64, equity float64, minSize float64, increment float64, fraction float64) float64 {
+	maxNotional := cashAvailable - GetConfigInstance().Init.CashReserve
+	if limit := GetConfigInstance().Init.LimitCashAvailable; limit > 0 && maxNotional > limit {
+		maxNotional = limit
+	}
+	notional := math.Min(sizer.Notional(price, cashAvailable, equity)*fraction, maxNotional)
+	size := roundSize(notional/price, increment)
+	if size <= 0 || size < minSize {
+		GetLoggerInstance().Info("Sizing - Size %f below the minimum size %f", size, minSize)
+		return 0
+	}
+	return size
+}
+
+// Round size down to a multiple of increment, unchanged if the increment is unknown
+func roundSize(size float64, increment float64) float64 {
+	if increment <= 0 {
+		return size
+	}
+	steps := math.Floor(size/increment + 1e-9) // A multiple of increment off by a rounding error stays unchanged
+	decimals := math.Pow(10, math.Max(0, math.Ceil(-math.Log10(increment)-1e-9)))
+	return math.Round(steps*increment*decimals) / decimals
+}
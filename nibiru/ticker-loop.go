@@ -0,0 +1,55 @@
+package nibiru
+
+import (
+	"sync"
+	"time"
+)
+
+// Calls tick every period from one goroutine, until Stop. Stop waits for the tick in progress,
+// so that an order or an Elasticsearch write is not interrupted by a shutdown
+type tickerLoop struct {
+	ticker   *time.Ticker
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func startTickerLoop(period time.Duration, tick func(t time.Time)) *tickerLoop {
+	return newTickerLoop(period, false, tick)
+}
+
+// Same, with a first tick at once
+func startTickerLoopNow(period time.Duration, tick func(t time.Time)) *tickerLoop {
+	return newTickerLoop(period, true, tick)
+}
+
+func newTickerLoop(period time.Duration, now bool, tick func(t time.Time)) *tickerLoop {
+	loop := &tickerLoop{ticker: time.NewTicker(period), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(loop.done)
+		if now {
+			tick(time.Now())
+		}
+		for {
+			select {
+			case <-loop.stop:
+				return
+			case t := <-loop.ticker.C:
+				tick(t)
+			}
+		}
+	}()
+	return loop
+}
+
+// Can be called on a loop not started (nil), or several times
+func (loop *tickerLoop) Stop() {
+	if loop == nil {
+		return
+	}
+	loop.stopOnce.Do(func() {
+		loop.ticker.Stop()
+		close(loop.stop)
+	})
+	<-loop.done
+}
@@ -0,0 +1,84 @@
+package nibiru
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buy and sell volumes of the trades of the main exchange for the product of the algo, by second, over the last
+// Algo.PeriodLong minutes. The algo sums them instead of aggregating the matches in Elasticsearch when the trader
+// is fed by the broker or the socket of an ingester
+type VolumeWindows struct {
+	mutex     sync.Mutex
+	productId string
+	window    time.Duration // Older volumes are forgotten
+	seconds   []volumeSecond
+}
+
+type volumeSecond struct {
+	second int64 // Unix time
+	buy    float64
+	sell   float64
+}
+
+var instanceVolumeWindows *VolumeWindows
+var onceVolumeWindows sync.Once
+
+func GetVolumeWindowsInstance() *VolumeWindows {
+	onceVolumeWindows.Do(func() {
+		instanceVolumeWindows = NewVolumeWindows(GetConfigInstance().Init.Crypto+"-"+GetConfigInstance().Init.Currency,
+			time.Duration(GetConfigInstance().Algo.PeriodLong)*time.Minute)
+	})
+	return instanceVolumeWindows
+}
+
+func NewVolumeWindows(productId string, window time.Duration) *VolumeWindows {
+	return &VolumeWindows{productId: productId, window: window}
+}
+
+func (windows *VolumeWindows) OnMarketEvent(event MarketEvent) {
+	if trade, ok := event.(*TradeEvent); ok && trade.Venue == mainVenue() && trade.ProductId == windows.productId {
+		windows.add(trade.Time, trade.Size, trade.Side, time.Now())
+	}
+}
+
+func (windows *VolumeWindows) add(tradeTime time.Time, size float64, side string, now time.Time) {
+	windows.mutex.Lock()
+	defer windows.mutex.Unlock()
+	oldest := now.Add(-windows.window).Unix()
+	second := tradeTime.Unix()
+	if second < oldest {
+		return
+	}
+	// The backfilled trades are older than the last ones received
+	i := sort.Search(len(windows.seconds), func(i int) bool { return windows.seconds[i].second >= second })
+	if i == len(windows.seconds) || windows.seconds[i].second != second {
+		windows.seconds = append(windows.seconds, volumeSecond{})
+		copy(windows.seconds[i+1:], windows.seconds[i:])
+		windows.seconds[i] = volumeSecond{second: second}
+	}
+	if side == "buy" {
+		windows.seconds[i].buy += size
+	} else if side == "sell" {
+		windows.seconds[i].sell += size
+	}
+	expired := sort.Search(len(windows.seconds), func(i int) bool { return windows.seconds[i].second >= oldest })
+	windows.seconds = windows.seconds[expired:]
+}
+
+// Volume of the trades of side (the side of the maker) in the last minutes before now
+func (windows *VolumeWindows) Sum(minutes int, side string, now time.Time) float64 {
+	windows.mutex.Lock()
+	defer windows.mutex.Unlock()
+	from := now.Add(-time.Duration(minutes) * time.Minute).Unix()
+	var volume float64
+	for i := len(windows.seconds) - 1; i >= 0 && windows.seconds[i].second >= from; i-- {
+		if side == "buy" {
+			volume += windows.seconds[i].buy
+		} else {
+			volume += windows.seconds[i].sell
+		}
+	}
+	return volume
+}
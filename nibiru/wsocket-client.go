@@ -1,10 +1,13 @@
 package nibiru
 
 import (
-	ws "github.com/gorilla/websocket"
-	api "github.com/preichenberger/go-coinbase-exchange"
-	"os"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
 	"time"
+
+	ws "github.com/gorilla/websocket"
 )
 
 const (
@@ -18,137 +21,450 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait
 	pingPeriod = (pongWait * 9) / 10 // Send pings period
 
-	//connIsLostLimit = time.Duration(8) * time.Second // If no msg received after this period, connection is considered as lost
+	// Period of the checks of the stale feeds
+	staleCheckPeriod = time.Duration(1) * time.Second
 )
 
+// Trades remembered to drop the duplicates of the reconnections and backfills
+const SEEN_TRADES_MAX int = 100000
+
+// Publishes the messages of a feed on a MarketBus.
+// Each connection has one reader, the goroutine of Run, and one writer goroutine which subscribes, pings and
+// closes the connection. Both stop when the connection fails or the context of Run is cancelled
 type WSocketClient struct {
-	wsConn      *ws.Conn
-	ordersStore *OrdersStore
-	//lastMsgReadTS time.Time
-	listen     bool
-	pingTicker *time.Ticker
+	feed        Feed
+	venue       string
+	bus         *MarketBus
+	seen        *tradeSet
+	lastTradeId int  // Highest trade id received, the gap since is backfilled after a reconnection
+	failures    int  // Connections lost or failed in a row
+	heartbeats  bool // The feed sends heartbeats, a connection without them is stale
+}
+
+// Error message of the feed, or subscription refused. Reconnecting won't help
+type FeedError struct {
+	Message string
+}
+
+func (e *FeedError) Error() string {
+	return "feed error: " + e.Message
 }
 
-type WsHeartbeatMessage struct {
-	Type string `json:"type"`
-	On   bool   `json:"on"`
+// The feed stopped delivering while the connection is alive (pongs received)
+type StaleFeedError struct {
+	Reason string
+}
+
+func (e *StaleFeedError) Error() string {
+	return "feed stale: " + e.Reason
+}
+
+type WsChannel struct {
+	Name       string   `json:"name"`
+	ProductIds []string `json:"product_ids,omitempty"`
 }
 
 type WsSubscribeMessage struct {
-	Type       string   `json:"type"`
-	ProductIds []string `json:"product_ids"`
+	Type     string      `json:"type"`
+	Channels []WsChannel `json:"channels"`
 }
 
 func NewWSocketClient() *WSocketClient {
-	return &WSocketClient{getConnection(), NewOrdersStore() /*time.Now(), */, true, nil}
+	return NewFeedWSocketClient(NewExchange().Feed(), mainVenue(), GetMarketBusInstance())
 }
 
-func getConnection() *ws.Conn {
+// Listen to the matches of another exchange
+func NewVenueWSocketClient(venue VenueConfig) *WSocketClient {
+	return NewFeedWSocketClient(newFeed(venue.Exchange, venue.WssURL, venue.BaseURL), venue.name(), GetMarketBusInstance())
+}
+
+// The events are published with venue
+func NewFeedWSocketClient(feed Feed, venue string, bus *MarketBus) *WSocketClient {
+	return &WSocketClient{feed, venue, bus, newTradeSet(SEEN_TRADES_MAX), 0, 0, false}
+}
+
+// Receive the messages of productId until ctx is cancelled. A lost connection is restored with a jittered
+// exponential backoff, an error is returned after Websocket.MaxRetries failures in a row or on a *FeedError
+func (l *WSocketClient) Run(ctx context.Context, productId string) error {
+	GetLoggerInstance().Info("Listen %s, on: %s", productId, l.feed.URL())
+	for {
+		wsConn, err := l.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				l.publishConnection(productId, CONNECTION_STOPPED, nil)
+				return nil
+			}
+			return err
+		}
+		err = l.session(ctx, wsConn, productId)
+		if ctx.Err() != nil {
+			GetLoggerInstance().Info("Stop listening %s", productId)
+			l.publishConnection(productId, CONNECTION_STOPPED, nil)
+			return nil
+		}
+		GetLoggerInstance().Error("In wsocket-client/Run: %s", err.Error())
+		if _, ok := err.(*FeedError); ok {
+			l.publishConnection(productId, CONNECTION_DOWN, err)
+			return err
+		}
+		if _, ok := err.(*StaleFeedError); ok {
+			l.publishConnection(productId, CONNECTION_STALE, err)
+		} else {
+			l.publishConnection(productId, CONNECTION_DOWN, err)
+		}
+		l.failures++
+		GetLoggerInstance().Info("Restart listen")
+	}
+}
+
+// Dial the feed. After a failure, wait with a jittered exponential backoff
+func (l *WSocketClient) connect(ctx context.Context) (*ws.Conn, error) {
+	maxRetries, base, max := retryConfig()
 	var wsDialer ws.Dialer
-	GetLoggerInstance().Info("getConnection")
-	wsConn, _, err := wsDialer.Dial(GetConfigInstance().WssURL, nil)
+	for {
+		if l.failures > 0 {
+			if l.failures > maxRetries {
+				return nil, fmt.Errorf("%d failures in a row on %s, giving up", l.failures, l.feed.URL())
+			}
+			wait := backoff(base, max, l.failures)
+			GetLoggerInstance().Info("Reconnection %d/%d to %s in %s", l.failures, maxRetries, l.feed.URL(), wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+		GetLoggerInstance().Info("Connect to %s", l.feed.URL())
+		wsConn, _, err := wsDialer.DialContext(ctx, l.feed.URL(), nil)
+		if err == nil {
+			return wsConn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		GetLoggerInstance().Error("In wsocket-client/connect: %s", err.Error())
+		l.failures++
+	}
+}
+
+// Websocket.MaxRetries, BackoffSeconds and MaxBackoffSeconds, defaults applied
+func retryConfig() (maxRetries int, base time.Duration, max time.Duration) {
+	config := GetConfigInstance().Websocket
+	maxRetries = config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 10
+	}
+	base = time.Duration(config.BackoffSeconds) * time.Second
+	if base <= 0 {
+		base = time.Second
+	}
+	max = time.Duration(config.MaxBackoffSeconds) * time.Second
+	if max <= 0 {
+		max = time.Minute
+	}
+	return maxRetries, base, max
+}
+
+// Read wsConn until it fails or ctx is cancelled. The connection is closed when it returns
+func (l *WSocketClient) session(ctx context.Context, wsConn *ws.Conn, productId string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subscribed := make(chan error, 1)
+	writerDone := make(chan error, 1)
+	activity := newFeedActivity(time.Now(), l.heartbeats)
+	go func() {
+		writerDone <- l.write(ctx, wsConn, productId, subscribed, activity)
+	}()
+
+	readErr := l.read(ctx, wsConn, productId, subscribed, activity)
+	cancel() // Stops the writer if the read failed
+	if err := <-writerDone; err != nil {
+		return err // The read failed because the writer closed the connection
+	}
+	return readErr
+}
+
+// Writer goroutine: subscribe, then ping and check that the feed isn't stale until ctx is cancelled, a write fails
+// or the feed is stale, and close the connection
+func (l *WSocketClient) write(ctx context.Context, wsConn *ws.Conn, productId string, subscribed chan<- error, activity *feedActivity) error {
+	defer wsConn.Close()
+	wsConn.SetWriteDeadline(time.Now().Add(writeWait))
+	err := l.feed.Subscribe(wsConn, productId)
+	subscribed <- err
 	if err != nil {
-		GetLoggerInstance().Error("In wsocket-client/getConnection: %s", err.Error())
-		os.Exit(2)
+		return fmt.Errorf("during Subscribe: %s", err.Error())
+	}
+
+	staleWait := time.Duration(GetConfigInstance().Websocket.StaleSeconds) * time.Second
+	if staleWait <= 0 {
+		staleWait = 30 * time.Second
+	}
+	pingTicker := time.NewTicker(pingPeriod) // Send pings on a regular interval
+	defer pingTicker.Stop()
+	staleTicker := time.NewTicker(staleCheckPeriod)
+	defer staleTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wsConn.WriteControl(ws.CloseMessage, ws.FormatCloseMessage(ws.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			return nil
+		case <-pingTicker.C:
+			wsConn.SetWriteDeadline(time.Now().Add(writeWait))
+			// If a pong goes missing, the read methods will return with the read past deadline error
+			if err := wsConn.WriteMessage(ws.PingMessage, []byte{}); err != nil {
+				return fmt.Errorf("connection seems lost, ping: %s", err.Error())
+			}
+		case now := <-staleTicker.C:
+			if reason := activity.stale(now, staleWait); reason != "" {
+				return &StaleFeedError{reason}
+			}
+		}
 	}
-	return wsConn
 }
 
-func (l *WSocketClient) Listen(productid string) {
-	GetLoggerInstance().Info("Listen %s, on: %s", productid, GetConfigInstance().WssURL)
+// Reader: wait for the subscription and its acknowledgement, backfill the gap since the previous connection,
+// then read the messages
+func (l *WSocketClient) read(ctx context.Context, wsConn *ws.Conn, productId string, subscribed <-chan error, activity *feedActivity) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-subscribed:
+		if err != nil {
+			return err
+		}
+	}
+	wsConn.SetReadDeadline(time.Now().Add(writeWait))
+	pending, err := l.awaitSubscriptions(wsConn)
+	if err != nil {
+		return err
+	}
+	l.backfill(productId)
+	l.publishConnection(productId, CONNECTION_UP, nil)
+	for i := range pending {
+		if err := l.receive(&pending[i], activity); err != nil {
+			return err
+		}
+	}
 
-	message := api.Message{}
-	//go wsclient.checkConnection()
+	// Set read deadline to a time less than next expected pong
+	wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	// Reset the read deadline when a pong is received
+	wsConn.SetPongHandler(func(string) error {
+		return wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	GetLoggerInstance().Info("Listening")
+	for {
+		_, data, err := wsConn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		l.failures = 0
+		messages, err := l.feed.Decode(data)
+		if err != nil {
+			GetLoggerInstance().Error("In wsocket-client/read, decoding %s: %s", string(data), err.Error())
+			continue
+		}
+		for i := range messages {
+			if err := l.receive(&messages[i], activity); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-	defer l.wsConn.Close()
-	for true {
-		l.heartbeat(true)
-		l.ping()
+// Read until the feed acknowledges the subscriptions. The messages received before are returned, to be received
+// after the backfill
+func (l *WSocketClient) awaitSubscriptions(wsConn *ws.Conn) ([]FeedMessage, error) {
+	var pending []FeedMessage
+	for {
+		_, data, err := wsConn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("waiting for the subscriptions acknowledgement: %s", err.Error())
+		}
+		messages, err := l.feed.Decode(data)
+		if err != nil {
+			GetLoggerInstance().Error("In wsocket-client/awaitSubscriptions, decoding %s: %s", string(data), err.Error())
+			continue
+		}
+		for i := range messages {
+			switch messages[i].Type {
+			case "error":
+				return nil, &FeedError{messages[i].Message.Message}
+			case "subscriptions":
+				GetLoggerInstance().Info("Subscriptions acknowledged by %s", l.feed.URL())
+				return append(pending, messages[i+1:]...), nil
+			}
+			pending = append(pending, messages[i])
+		}
+	}
+}
 
-		subscribe := WsSubscribeMessage{Type: "subscribe", ProductIds: []string{productid}}
-		if err := l.wsConn.WriteJSON(subscribe); err != nil {
-			GetLoggerInstance().Error("In wsocket-client/Listen, during Subscribe: %s", err.Error())
-			os.Exit(2)
+func (l *WSocketClient) receive(msg *FeedMessage, activity *feedActivity) error {
+	switch msg.Type {
+	case "error":
+		return &FeedError{msg.Message.Message}
+	case "match": // The duplicates of the backfill are dropped by publish
+		if msg.TradeId > l.lastTradeId {
+			l.lastTradeId = msg.TradeId
+		}
+	case "heartbeat", "last_match":
+		l.heartbeats = l.heartbeats || msg.Type == "heartbeat"
+		if l.lastTradeId == 0 { // No match received yet, the gap is counted from the last trade before the connection
+			l.lastTradeId = msg.TradeId
 		}
+	}
+	activity.received(msg, l.lastTradeId, time.Now())
+	l.publish(msg, false)
+	return nil
+}
 
-		l.listen = true
-		GetLoggerInstance().Info("Listening")
-		for l.listen {
-			err := l.wsConn.ReadJSON(&message)
-			if err != nil {
-				GetLoggerInstance().Error("In wsocket-client/Listen: %s", err.Error())
-				l.listen = false
-				break
-			} else {
-				//GetLoggerInstance().Info("OrderId: %s", message.Type)
-				l.ordersStore.NewOrder(&message)
-				//l.lastMsgReadTS = time.Now()
+// Publish the messages of the GDAX feed as market events. Other types are ignored
+func (l *WSocketClient) publish(msg *FeedMessage, backfill bool) {
+	switch msg.Type {
+	case "match":
+		if !l.seen.add(matchId(msg.ProductId, msg.TradeId)) {
+			return
+		}
+		l.bus.Publish(&TradeEvent{l.venue, msg.ProductId, msg.TradeId, msg.Time.Time(), msg.Price, msg.Size, msg.Side, backfill})
+	case "snapshot", "l2update":
+		event := &BookEvent{l.venue, msg.ProductId, msg.Time.Time(), msg.Type == "snapshot", nil}
+		event.Changes = appendBookChanges(event.Changes, "buy", msg.Bids)
+		event.Changes = appendBookChanges(event.Changes, "sell", msg.Asks)
+		for _, change := range msg.Changes { // [side, price, size]
+			if len(change) == 3 {
+				event.Changes = appendBookChanges(event.Changes, change[0], [][]string{change[1:]})
 			}
 		}
-		GetLoggerInstance().Info("Close connection")
-		l.pingTicker.Stop()
-		// If here, it is because the connection is on error, so the connection might be already closed
-		//l.wsConn.Close()
-		// Restart the connection
-		l.wsConn = getConnection()
-		GetLoggerInstance().Info("Restart listen")
+		l.bus.Publish(event)
+	case "ticker":
+		l.bus.Publish(&TickerEvent{l.venue, msg.ProductId, msg.Time.Time(), msg.Price, msg.BestBid, msg.BestAsk})
+	case "status":
+		for _, product := range msg.Products {
+			l.bus.Publish(&StatusEvent{l.venue, product.Id, time.Now(), product.Status, product.StatusMessage,
+				product.TradingDisabled, product.CancelOnly, product.PostOnly, product.LimitOnly})
+		}
+	case "heartbeat":
+		l.bus.Publish(&HeartbeatEvent{l.venue, msg.ProductId, msg.Time.Time(), msg.TradeId, msg.Sequence})
 	}
 }
 
-// Turns heartbeat on/off on the Connection
-// message received have type=heartbeat
-func (l *WSocketClient) heartbeat(on bool) {
-	msg := WsHeartbeatMessage{Type: "heartbeat", On: on}
+func (l *WSocketClient) publishConnection(productId string, state string, err error) {
+	event := &ConnectionEvent{l.venue, productId, l.feed.URL(), time.Now(), state, ""}
+	if err != nil {
+		event.Err = err.Error()
+	}
+	l.bus.Publish(event)
+}
+
+// Levels [price, size] of side
+func appendBookChanges(changes []BookChange, side string, levels [][]string) []BookChange {
+	for _, level := range levels {
+		if len(level) < 2 {
+			continue
+		}
+		price, err1 := strconv.ParseFloat(level[0], 64)
+		size, err2 := strconv.ParseFloat(level[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		changes = append(changes, BookChange{side, price, size})
+	}
+	return changes
+}
 
-	if err := l.wsConn.WriteJSON(msg); err != nil {
-		GetLoggerInstance().Error("In wsocket-client/heartbeat: %s", err.Error())
-		os.Exit(2)
+// Index the matches missed since the last one received, through the REST API of the feed
+func (l *WSocketClient) backfill(productId string) {
+	if l.lastTradeId == 0 { // First connection
+		return
+	}
+	messages, err := l.feed.Backfill(productId, l.lastTradeId)
+	if err != nil {
+		GetLoggerInstance().Error("In wsocket-client/backfill, since trade %d: %s", l.lastTradeId, err.Error())
+		return
+	}
+	for i := range messages {
+		l.publish(&FeedMessage{Message: messages[i]}, true)
+		l.lastTradeId = messages[i].TradeId
 	}
-	GetLoggerInstance().Info("Websocket heartbeat activated")
+	GetLoggerInstance().Info("Backfilled %d matches of %s", len(messages), productId)
 }
 
-func (l *WSocketClient) ping() {
-	l.pingTicker = time.NewTicker(pingPeriod) // Send pings on a regular interval
+// Messages received on a connection, recorded by the reader and checked by the writer
+type feedActivity struct {
+	mutex            sync.Mutex
+	heartbeats       bool      // False until a heartbeat is received: the feeds without heartbeats are never stale
+	lastMessage      time.Time // Or connection
+	heartbeatTradeId int       // Last trade announced by the heartbeats
+	behindSince      time.Time // Since the heartbeats announce a trade not received yet, zero if none
+}
 
-	// Set read deadline to a time less than next expected pong
-	l.wsConn.SetReadDeadline(time.Now().Add(pongWait))
-	// Reset the read deadline when a pong is received
-	l.wsConn.SetPongHandler(func(string) error {
-		//GetLoggerInstance().Info("PONG")
-		l.wsConn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
+// heartbeats if the feed sent some on a previous connection
+func newFeedActivity(connected time.Time, heartbeats bool) *feedActivity {
+	return &feedActivity{heartbeats: heartbeats, lastMessage: connected}
+}
 
-	go func() {
-		for {
-			select {
-			case <-l.pingTicker.C:
-				l.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-				//GetLoggerInstance().Info("PING")
-				// If a pong goes missing, the read methods will return with the read past deadline error
-				if err := l.wsConn.WriteMessage(ws.PingMessage, []byte{}); err != nil {
-					GetLoggerInstance().Error("In wsocket-client/ping, connection seems lost")
-					// Connection seems lost
-					l.listen = false
-					return
-				}
-			}
+// lastTradeId is the last match received
+func (activity *feedActivity) received(msg *FeedMessage, lastTradeId int, now time.Time) {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	activity.lastMessage = now
+	if msg.Type == "heartbeat" {
+		activity.heartbeats = true
+		if msg.TradeId > activity.heartbeatTradeId {
+			activity.heartbeatTradeId = msg.TradeId
 		}
-	}()
+	}
+	if activity.heartbeatTradeId <= lastTradeId {
+		activity.behindSince = time.Time{}
+	} else if activity.behindSince.IsZero() {
+		activity.behindSince = now
+	}
+}
+
+// Why the feed is stale, empty if it isn't
+func (activity *feedActivity) stale(now time.Time, wait time.Duration) string {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	if !activity.heartbeats {
+		return ""
+	}
+	if silence := now.Sub(activity.lastMessage); silence > wait {
+		return fmt.Sprintf("no message for %s", silence.Round(time.Second))
+	}
+	if !activity.behindSince.IsZero() && now.Sub(activity.behindSince) > wait {
+		return fmt.Sprintf("trade %d announced by the heartbeats not received for %s", activity.heartbeatTradeId, now.Sub(activity.behindSince).Round(time.Second))
+	}
+	return ""
+}
+
+// Last keys added, the oldest ones are forgotten beyond max
+type tradeSet struct {
+	keys map[string]bool
+	ring []string
+	next int
+}
+
+func newTradeSet(max int) *tradeSet {
+	return &tradeSet{map[string]bool{}, make([]string, 0, max), 0}
 }
 
-//func (l *WSocketClient) checkConnection() {
-//	ticker := time.NewTicker(connIsLostLimit)
-//	defer ticker.Stop()
-//	for {
-//		select {
-//		case <-ticker.C:
-//			//GetLoggerInstance().Info("checkConnection: %f", l.lastMsgReadTS.Add(connIsLostLimit).Sub(time.Now()).Seconds())
-//			if l.lastMsgReadTS.Add(connIsLostLimit).Sub(time.Now()) < time.Duration(0) { // No msg received since connIsLostLimit seconds
-//				GetLoggerInstance().Error("checkConnection, connection seems lost: %f", l.lastMsgReadTS.Add(connIsLostLimit).Sub(time.Now()).Seconds())
-//				// Connection seems lost
-//				l.listen = false
-//			}
-//		}
-//	}
-//}
+// false if key is already in the set. Empty keys (trade id unknown) are never in it
+func (set *tradeSet) add(key string) bool {
+	if key == "" {
+		return true
+	}
+	if set.keys[key] {
+		return false
+	}
+	set.keys[key] = true
+	if len(set.ring) < cap(set.ring) {
+		set.ring = append(set.ring, key)
+		return true
+	}
+	delete(set.keys, set.ring[set.next])
+	set.ring[set.next] = key
+	set.next = (set.next + 1) % len(set.ring)
+	return true
+}
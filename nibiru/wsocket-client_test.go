@@ -0,0 +1,198 @@
+package nibiru
+
+import (
+	"algo-trading/fakes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Client of the fake Advanced Trade feed of BTC-EUR, publishing on a bus read through the channel returned.
+// The websocket connections are refused while refuse is 1
+func newFakeFeedClient(t *testing.T) (*WSocketClient, *fakes.CoinbaseServer, *int32, chan MarketEvent, func()) {
+	t.Helper()
+	server := fakes.NewCoinbaseServer("", nil)
+	server.AddProduct("BTC-EUR", 0.0001, 20000)
+	var refuse int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" && atomic.LoadInt32(&refuse) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	bus := NewMarketBus()
+	events := make(chan MarketEvent, 1000)
+	bus.Subscribe("test", 1000, POLICY_BLOCK, func(event MarketEvent) { events <- event }, EVENT_TRADE, EVENT_CONNECTION, EVENT_STATUS, EVENT_HEARTBEAT)
+	feed := newFeed(EXCHANGE_COINBASE, "ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws", httpServer.URL)
+	return NewFeedWSocketClient(feed, EXCHANGE_COINBASE, bus), server, &refuse, events, func() {
+		bus.Close()
+		httpServer.Close()
+	}
+}
+
+// Run client in the background. The function returned cancels it and checks that it stops
+func runClient(t *testing.T, client *WSocketClient, events chan MarketEvent) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- client.Run(ctx, "BTC-EUR") }()
+	return func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run = %s, want nil once cancelled", err.Error())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run didn't stop")
+		}
+		waitEvent(t, events, isConnection(CONNECTION_STOPPED))
+	}
+}
+
+// Events received until one matches, included
+func waitEvent(t *testing.T, events chan MarketEvent, match func(event MarketEvent) bool) []MarketEvent {
+	t.Helper()
+	var received []MarketEvent
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+			if match(event) {
+				return received
+			}
+		case <-timeout:
+			t.Fatalf("No event expected among %d received", len(received))
+		}
+	}
+}
+
+func isConnection(state string) func(event MarketEvent) bool {
+	return func(event MarketEvent) bool {
+		connection, ok := event.(*ConnectionEvent)
+		return ok && connection.State == state
+	}
+}
+
+// The status snapshot follows the last subscription: the client receives the trades published after
+func isStatus(event MarketEvent) bool {
+	_, ok := event.(*StatusEvent)
+	return ok
+}
+
+func isTrade(tradeId int) func(event MarketEvent) bool {
+	return func(event MarketEvent) bool {
+		trade, ok := event.(*TradeEvent)
+		return ok && trade.TradeId == tradeId
+	}
+}
+
+func tradesOf(events []MarketEvent) []*TradeEvent {
+	var trades []*TradeEvent
+	for _, event := range events {
+		if trade, ok := event.(*TradeEvent); ok {
+			trades = append(trades, trade)
+		}
+	}
+	return trades
+}
+
+func tradeIds(trades []*TradeEvent) []int {
+	var ids []int
+	for _, trade := range trades {
+		ids = append(ids, trade.TradeId)
+	}
+	return ids
+}
+
+// The trades missed while the feed was down are backfilled once, the duplicates of the feed are dropped
+func TestWSocketClientReconnect(t *testing.T) {
+	client, server, refuse, events, closeFeed := newFakeFeedClient(t)
+	defer closeFeed()
+	stopClient := runClient(t, client, events)
+
+	if up := waitEvent(t, events, isStatus); !isConnection(CONNECTION_UP)(up[0]) {
+		t.Fatalf("First event %+v, want the connection up", up[0])
+	}
+	for i := 1; i <= 3; i++ {
+		server.PublishTrade("BTC-EUR", 20000+float64(i), 0.01, "buy")
+	}
+	trades := tradesOf(waitEvent(t, events, isTrade(3)))
+	if len(trades) != 3 {
+		t.Fatalf("%d trades received, want 3", len(trades))
+	}
+	for i, trade := range trades {
+		if trade.TradeId != i+1 || trade.Price != 20000+float64(i+1) || trade.Venue != EXCHANGE_COINBASE || trade.Backfill {
+			t.Errorf("Trade %+v, want the trade %d received live", *trade, i+1)
+		}
+	}
+
+	// Trades 4 and 5 while the client can't reconnect
+	atomic.StoreInt32(refuse, 1)
+	server.DropConnections()
+	waitEvent(t, events, isConnection(CONNECTION_DOWN))
+	server.PublishTrade("BTC-EUR", 20004, 0.01, "sell")
+	server.PublishTrade("BTC-EUR", 20005, 0.01, "sell")
+	atomic.StoreInt32(refuse, 0)
+	reconnected := waitEvent(t, events, isStatus)
+	trades = tradesOf(reconnected)
+	if len(trades) != 2 || trades[0].TradeId != 4 || trades[1].TradeId != 5 || !trades[0].Backfill || !trades[1].Backfill {
+		t.Fatalf("Trades after the reconnection %v, want 4 and 5 backfilled", tradeIds(trades))
+	}
+	if !isConnection(CONNECTION_UP)(reconnected[2]) {
+		t.Errorf("Event %+v after the backfill, want the connection up", reconnected[2])
+	}
+
+	server.RepeatTrades("BTC-EUR", 3)
+	server.PublishTrade("BTC-EUR", 20006, 0.01, "buy")
+	if trades = tradesOf(waitEvent(t, events, isTrade(6))); len(trades) != 1 {
+		t.Errorf("Trades %v, want 6 only, the trades repeated dropped", tradeIds(trades))
+	}
+	stopClient()
+}
+
+// A feed sending heartbeats is reconnected after Websocket.StaleSeconds (2) without message
+func TestWSocketClientStale(t *testing.T) {
+	client, server, _, events, closeFeed := newFakeFeedClient(t)
+	defer closeFeed()
+	stop := make(chan struct{})
+	go server.Heartbeats(100*time.Millisecond, stop)
+	stopClient := runClient(t, client, events)
+	waitEvent(t, events, func(event MarketEvent) bool {
+		_, ok := event.(*HeartbeatEvent)
+		return ok
+	})
+
+	close(stop)
+	silent := time.Now()
+	stale := waitEvent(t, events, isConnection(CONNECTION_STALE))
+	if elapsed := time.Since(silent); elapsed < 2*time.Second-staleCheckPeriod {
+		t.Errorf("Stale after %s of silence, want 2s", elapsed)
+	}
+	if err := stale[len(stale)-1].(*ConnectionEvent).Err; !strings.HasPrefix(err, "feed stale: ") {
+		t.Errorf("Cause of the stale connection %s", err)
+	}
+
+	stop = make(chan struct{})
+	go server.Heartbeats(100*time.Millisecond, stop)
+	defer close(stop)
+	waitEvent(t, events, isConnection(CONNECTION_UP))
+	quiet := time.After(3 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case event := <-events:
+			if connection, ok := event.(*ConnectionEvent); ok {
+				t.Fatalf("Connection %s while the heartbeats are received: %s", connection.State, connection.Err)
+			}
+		case <-quiet:
+			waiting = false
+		}
+	}
+	stopClient()
+}